@@ -1,21 +1,39 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/docker/docker/client"
+	"golang.org/x/term"
+	"io"
 	"log/slog"
 	"nqk/internal"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
 
+// closeDockerClient closes a client returned by GenerateBindings once the caller is done with it
+func closeDockerClient(cli *client.Client) {
+	err := cli.Close()
+	if err != nil {
+		slog.Error("Failed to close the CLI client due to error!", "error", err)
+	}
+}
+
+// GenerateBindings queries docker for the bindings of every project. The client is left open for the caller to keep
+// using, who has to close it with closeDockerClient, unless an error is returned in which case it is already closed
 func GenerateBindings(ctx *globalContext, b *BindingStruct) (*client.Client, *context.Context, *internal.BindingResult, error) {
 	projects, err := internal.LoadProjectsFromPaths(b.Paths)
 	if err != nil {
-		slog.Error("Failed to load set of projects due to error", err)
+		slog.Error("Failed to load set of projects due to error", "error", err)
 		os.Exit(1)
 	}
 
@@ -24,70 +42,296 @@ func GenerateBindings(ctx *globalContext, b *BindingStruct) (*client.Client, *co
 		slog.Error("Failed to create the docker client!", "error", err)
 		os.Exit(1)
 	}
-	defer func(cli *client.Client) {
-		err := cli.Close()
-		if err != nil {
-			slog.Error("Failed to close the CLI client due to error!", "error", err)
-		}
-	}(cli)
+	asleep, err := internal.ReadAsleepProjects(b.AsleepFile)
+	if err != nil {
+		slog.Error("Failed to read which projects are asleep, assuming none are", "file", b.AsleepFile, "error", err)
+	}
 
 	dctx := context.Background()
-	result, err := internal.GetBindingsForAllProjects(cli, dctx, projects)
+	result, err := internal.GetBindingsForAllProjects(cli, dctx, projects, asleep)
 	if err != nil {
 		slog.Error("Failed to get bindings for all projects due to an error", "error", err)
-		return cli, &dctx, nil, err
+		closeDockerClient(cli)
+		return nil, &dctx, nil, err
 	}
 
 	return cli, &dctx, &result, nil
 }
 
-func RunNginxBinding(n *NginxStruct, b *BindingStruct, ctx *globalContext) error {
-	cli, dctx, bindings, err := GenerateBindings(ctx, b)
+// networkWakerAddress returns the address of the waker as reached from containers on the network, see
+// internal.WakerAddressOnNetwork, or the address unchanged if the gateway of the network can't be found
+func networkWakerAddress(cli *client.Client, network string, address string) string {
+	gateway, err := internal.NetworkGateway(cli, context.Background(), network)
 	if err != nil {
-		return err
+		slog.Error("Failed to find the gateway of the network, the waker may not be reachable from it", "network", network, "error", err)
+		return address
+	}
+	resolved, err := internal.WakerAddressOnNetwork(address, gateway)
+	if err != nil {
+		slog.Error("The waker address is not a host and port", "address", address, "error", err)
+		return address
 	}
+	return resolved
+}
 
-	binding, err := internal.GenerateFilesForNginxBinding(
-		cli,
-		*dctx,
-		*bindings,
-		internal.BindingConfiguration{
-			DefaultDomain:  CLI.Binding.DefaultDomain,
-			SslCertificate: CLI.Binding.SslCertificate,
-			SslPrivateKey:  CLI.Binding.SslPrivateKey,
-		},
-	)
+// bindingConfiguration builds the configuration for resolving routes from the flags, using the client to look up the
+// network when one is given
+func bindingConfiguration(cli *client.Client, b *BindingStruct) internal.BindingConfiguration {
+	config := internal.BindingConfiguration{
+		DefaultDomain:  b.DefaultDomain,
+		SslCertificate: b.SslCertificate,
+		SslPrivateKey:  b.SslPrivateKey,
+		HtpasswdDir:    b.HtpasswdDir,
+		WakerAddress:   b.Waker,
+		Network:        b.Network,
+		Ipv6:           b.Ipv6,
+	}
+	// the proxy is in a container on the network, where loopback is its own rather than the host the waker is on
+	if b.Network != "" {
+		config.WakerAddress = networkWakerAddress(cli, b.Network, b.Waker)
+	}
+	if b.SnippetDir != nil {
+		config.SnippetDir = *b.SnippetDir
+	}
+	if b.MaintenancePages != nil {
+		config.MaintenancePages = *b.MaintenancePages
+	}
+
+	maintenance, err := internal.ReadMaintenanceProjects(b.MaintenanceFile)
 	if err != nil {
-		slog.Error("Failed to generate nginx configuration due to error", "error", err)
-		return err
+		slog.Error("Failed to read which projects are in maintenance, assuming none are", "file", b.MaintenanceFile, "error", err)
+	} else {
+		config.Maintenance = maintenance
 	}
 
-	needsUpdate, err := internal.WriteFileSetWithDiff(binding, n.OutDir)
+	asleep, err := internal.ReadAsleepProjects(b.AsleepFile)
 	if err != nil {
-		if needsUpdate {
-			slog.Error("Failed to write all files due to an error, however some files were edited", "error", err)
+		slog.Error("Failed to read which projects are asleep, assuming none are", "file", b.AsleepFile, "error", err)
+	} else {
+		config.Asleep = asleep
+	}
+
+	if b.SslCertificate != "" {
+		pair, err := internal.ReadCertificatePair(b.SslCertificate, b.SslPrivateKey)
+		if err != nil {
+			slog.Warn("Could not read the default certificate, it will be used without checking which domains it covers", "certificate", b.SslCertificate, "error", err)
 		} else {
-			slog.Error("Failed to write all files due to an error, no files were changed", "error", err)
+			config.DefaultCertificate = pair
 		}
-		return nil
 	}
 
-	if needsUpdate {
-		slog.Info("Files written to target, system now needs updating")
-
-		if n.Executable == nil {
-			slog.Info("Can't handle automatic restarts because no executable has been provided")
+	if b.CertDir != nil {
+		store, err := internal.LoadCertificateDirectory(*b.CertDir)
+		if err != nil {
+			slog.Error("Failed to load the certificate directory, only the default certificate will be used", "dir", *b.CertDir, "error", err)
 		} else {
-			if ok, err := internal.ValidateNginx(*n.Executable); !ok || err != nil {
-				slog.Error("Failed to restart nginx because the generated config is invalid!", "ok", ok, "error", err)
+			config.Certificates = store
+		}
+	}
+
+	if b.AcmeOptions.Directory != "" {
+		config.AcmeWebroot = b.AcmeOptions.Webroot
+
+		store, err := internal.LoadCertificateDirectory(b.AcmeOptions.Store)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to load the ACME certificates", "dir", b.AcmeOptions.Store, "error", err)
+		} else if err == nil {
+			if config.Certificates == nil {
+				config.Certificates = store
 			} else {
-				err := internal.RelaunchNginx(n.ServiceName)
-				if err != nil {
-					slog.Error("Failed to restart nginx - the config was valid but failed to launch", "error", err)
-					return err
+				for _, pair := range store.Pairs {
+					config.Certificates.Add(pair)
 				}
 			}
 		}
+	}
+
+	if b.LocalCa != nil {
+		ca, err := internal.LoadLocalCertificateAuthority(*b.LocalCa)
+		if err != nil {
+			slog.Error("Failed to load the local certificate authority, internal ports will select a certificate as normal", "dir", *b.LocalCa, "error", err)
+		} else {
+			config.LocalCa = ca
+		}
+	}
+
+	return config
+}
+
+// resolveRoutes resolves the bindings into routes using the configuration from the flags. Certificates for routes
+// using the local certificate authority are issued or rotated before returning so they exist before any output refers
+// to them. Returns whether any certificate was written, as outputs may need reloading to pick it up. When watching, the
+// bindings are resolved at least once a minute (see watchWithEvents), which is what rotates certificates as they near
+// expiry or after the root is replaced
+func resolveRoutes(cli *client.Client, b *BindingStruct, bindings *internal.BindingResult) (internal.BindingConfiguration, []internal.Route, bool, error) {
+	config := bindingConfiguration(cli, b)
+	routes, err := internal.ResolveRoutes(*bindings, config)
+	if err != nil {
+		return config, nil, false, err
+	}
+
+	if config.LocalCa == nil {
+		return config, routes, false, nil
+	}
+
+	issued, err := config.LocalCa.EnsureCertificates(internal.LocalCaDomains(routes))
+	if err != nil {
+		slog.Error("Failed to issue some certificates from the local certificate authority", "error", err)
+	}
+	return config, routes, issued, nil
+}
+
+// acmeManager is kept between runs so failed domains are not retried on every run when watching
+var acmeManager *internal.AcmeManager
+
+// ensureAcmeCertificates obtains or renews certificates for the tls routes if ACME is enabled. Failures are logged and
+// otherwise ignored so one bad domain doesn't hold up the rest of the binding. Returns whether any certificate changed
+func ensureAcmeCertificates(b *BindingStruct, config internal.BindingConfiguration, routes []internal.Route) bool {
+	if b.AcmeOptions.Directory == "" {
+		return false
+	}
+
+	ctx := context.Background()
+	if acmeManager == nil {
+		config := internal.AcmeConfiguration{
+			DirectoryUrl:     b.AcmeOptions.Directory,
+			Email:            b.AcmeOptions.Email,
+			StoreDir:         b.AcmeOptions.Store,
+			Webroot:          b.AcmeOptions.Webroot,
+			RootCertificates: b.AcmeOptions.Ca,
+			RenewBefore:      b.AcmeOptions.RenewBefore,
+		}
+		if b.AcmeOptions.DnsCommand != "" {
+			config.DnsProvider = internal.AcmeDnsCommand{Command: b.AcmeOptions.DnsCommand}
+		}
+
+		manager, err := internal.NewAcmeManager(ctx, config)
+		if err != nil {
+			slog.Error("Failed to set up ACME, no certificates will be requested", "error", err)
+			return false
+		}
+		acmeManager = manager
+	}
+
+	changed, err := acmeManager.EnsureCertificates(ctx, internal.AcmeDomains(routes, config, b.AcmeOptions.Store, b.AcmeOptions.DnsCommand != ""))
+	if err != nil {
+		slog.Error("Failed to obtain some certificates", "error", err)
+	}
+	return changed
+}
+
+// warnAcmeUnmanaged warns when ACME is enabled for an output which doesn't request certificates itself. The
+// certificates in the ACME store are still selected by domain, so `nqkd binding acme` can manage them alongside it
+func warnAcmeUnmanaged(b *BindingStruct, output string) {
+	if b.AcmeOptions.Directory != "" {
+		slog.Warn("Certificates are only requested by the nginx and acme bindings, run `nqkd binding acme` alongside this output", "output", output)
+	}
+}
+
+func RunNginxBinding(n *NginxStruct, b *BindingStruct, ctx *globalContext) error {
+	cli, _, bindings, err := GenerateBindings(ctx, b)
+	if err != nil {
+		return err
+	}
+	defer closeDockerClient(cli)
+
+	reload := internal.NginxReloadConfiguration{
+		Strategy:   n.Reload,
+		Executable: n.Executable,
+		Service:    n.ServiceName,
+		PidFile:    n.PidFile,
+		Container:  n.Container,
+		Timeout:    n.ReloadTimeout,
+		MainConfig: n.Config,
+	}
+	if reload.Strategy != internal.NginxReloadDocker && reload.Executable != "" {
+		if _, err := exec.LookPath(reload.Executable); err != nil {
+			slog.Error("Failed to find the nginx executable, pass --executable \"\" to skip validation and reloads", "executable", reload.Executable, "error", err)
+			return err
+		}
+	}
+	apply := func(renewed bool) (internal.BindingConfiguration, []internal.Route, bool, error) {
+		config, routes, issued, err := resolveRoutes(cli, b, bindings)
+		if err != nil {
+			slog.Error("Failed to resolve routes for nginx due to error", "error", err)
+			return config, nil, false, err
+		}
+
+		config.OutputDir, err = filepath.Abs(n.OutDir)
+		if err != nil {
+			return config, nil, false, err
+		}
+
+		binding, err := internal.GenerateFilesForNginxRoutes(routes, config)
+		if err != nil {
+			slog.Error("Failed to generate nginx configuration due to error", "error", err)
+			return config, nil, false, err
+		}
+
+		needsUpdate, err := internal.ApplyNginxFileSet(binding, n.OutDir, reload)
+		if err != nil {
+			slog.Error("Failed to apply the nginx configuration, the previous configuration is still in place", "error", err)
+			return config, nil, false, err
+		}
+
+		// certificates are always written to the same path, so nginx has to be told to reload them even when the
+		// config itself didn't change
+		if (renewed || issued) && !needsUpdate && reload.CanReload() {
+			slog.Info("Certificates changed, reloading nginx to pick them up")
+			err = internal.ReloadNginx(reload)
+			if err != nil {
+				slog.Error("Failed to reload nginx onto the new certificates", "error", err)
+				return config, nil, false, err
+			}
+			needsUpdate = true
+		}
+		return config, routes, needsUpdate, nil
+	}
+
+	config, routes, needsUpdate, err := apply(false)
+	if err != nil {
+		return err
+	}
+
+	// challenges can only be answered once nginx is serving the config above, so certificates are requested after it
+	// has been applied and the config is generated again to pick up any new certificates
+	if ensureAcmeCertificates(b, config, routes) {
+		_, _, updated, err := apply(true)
+		if err != nil {
+			return err
+		}
+		needsUpdate = needsUpdate || updated
+	}
+
+	if needsUpdate {
+		slog.Info("Nginx configuration updated")
+	} else {
+		slog.Info("No changes made")
+	}
+
+	return nil
+}
+
+func RunAcmeBinding(ctx *globalContext, b *BindingStruct) error {
+	if b.AcmeOptions.Directory == "" {
+		return errors.New("no ACME directory has been provided, use --acme-directory")
+	}
+
+	cli, _, bindings, err := GenerateBindings(ctx, b)
+	if err != nil {
+		return err
+	}
+	defer closeDockerClient(cli)
+
+	config := bindingConfiguration(cli, b)
+	routes, err := internal.ResolveRoutes(*bindings, config)
+	if err != nil {
+		slog.Error("Failed to resolve routes for ACME due to error", "error", err)
+		return err
+	}
+
+	if ensureAcmeCertificates(b, config, routes) {
+		slog.Info("Certificates updated")
 	} else {
 		slog.Info("No changes made")
 	}
@@ -95,11 +339,33 @@ func RunNginxBinding(n *NginxStruct, b *BindingStruct, ctx *globalContext) error
 	return nil
 }
 
+func RunCaRoot(b *BindingStruct) error {
+	if b.LocalCa == nil {
+		return errors.New("no local certificate authority has been provided, use --local-ca")
+	}
+
+	ca, err := internal.LoadLocalCertificateAuthority(*b.LocalCa)
+	if err != nil {
+		slog.Error("Failed to load the local certificate authority", "dir", *b.LocalCa, "error", err)
+		return err
+	}
+
+	root, err := os.ReadFile(ca.RootCertificate())
+	if err != nil {
+		slog.Error("Failed to read the root certificate", "file", ca.RootCertificate(), "error", err)
+		return err
+	}
+
+	fmt.Printf("%v", string(root))
+	return nil
+}
+
 func RunJsonBinding(ctx *globalContext, b *BindingStruct) error {
-	_, _, bindings, err := GenerateBindings(ctx, b)
+	cli, _, bindings, err := GenerateBindings(ctx, b)
 	if err != nil {
 		return err
 	}
+	defer closeDockerClient(cli)
 
 	marshal, err := json.Marshal(bindings)
 	if err != nil {
@@ -111,88 +377,410 @@ func RunJsonBinding(ctx *globalContext, b *BindingStruct) error {
 	return nil
 }
 
+func RunRoutesBinding(ctx *globalContext, b *BindingStruct) error {
+	cli, _, bindings, err := GenerateBindings(ctx, b)
+	if err != nil {
+		return err
+	}
+	defer closeDockerClient(cli)
+
+	routes, err := internal.ResolveRoutes(*bindings, bindingConfiguration(cli, b))
+	if err != nil {
+		slog.Error("Successfully queried for bindings but failed to resolve them into routes", "error", err)
+		return err
+	}
+
+	marshal, err := json.Marshal(routes)
+	if err != nil {
+		slog.Error("Successfully resolved routes but failed to marshall to json", "error", err)
+		return err
+	}
+
+	fmt.Printf("%v", string(marshal))
+	return nil
+}
+
+// watchOrRun will call the runner once, or if the binding is being watched, every time the paths change and once a
+// minute. The name is only used to identify the runner in logs
+func watchOrRun(b *BindingStruct, name string, runner func() error) error {
+	if !b.Watch {
+		return runner()
+	}
+
+	oneMinute := 1 * time.Minute
+	err := internal.WatchAndExecute(
+		b.Paths,
+		func() {
+			err := runner()
+			if err != nil {
+				slog.Error("Failed to execute "+name+" bindings due to error!", "error", err)
+			}
+		},
+		&oneMinute,
+	)
+	if err != nil {
+		slog.Error("Failed to launch the watcher", "error", err)
+		return err
+	}
+
+	return nil
+}
+
 func RunJson(b *BindingStruct, ctx *globalContext) error {
-	if b.Watch {
-		oneMinute := 1 * time.Minute
-		err := internal.WatchAndExecute(
-			b.Paths,
-			func() {
-				err := RunJsonBinding(ctx, b)
-				if err != nil {
-					slog.Error("Failed to execute json bindings due to error!", "error", err)
-				}
-			},
-			&oneMinute,
-		)
+	return watchOrRun(b, "json", func() error {
+		return RunJsonBinding(ctx, b)
+	})
+}
+
+func RunAcme(b *BindingStruct, ctx *globalContext) error {
+	return watchOrRun(b, "acme", func() error {
+		return RunAcmeBinding(ctx, b)
+	})
+}
+
+func RunRoutes(b *BindingStruct, ctx *globalContext) error {
+	return watchOrRun(b, "routes", func() error {
+		return RunRoutesBinding(ctx, b)
+	})
+}
+
+// watchWithEvents will call the runner once, or if the binding is being watched, every time the paths, the maintenance
+// file or the asleep file change, every time a container changes state and once a minute. Calls to the runner never
+// overlap. The name is only used to identify the runner in logs
+func watchWithEvents(b *BindingStruct, name string, runner func() error) error {
+	if !b.Watch {
+		return runner()
+	}
+
+	var lock sync.Mutex
+	events := make(chan internal.DockerEvent, 30)
+
+	executor := func() {
+		lock.Lock()
+		err := runner()
 		if err != nil {
-			slog.Error("Failed to launch the watcher", "error", err)
-			return err
+			slog.Error("Failed to execute "+name+" bindings due to error!", "error", err)
 		}
-	} else {
-		err := RunJsonBinding(ctx, b)
-		if err != nil {
-			return err
+		lock.Unlock()
+	}
+
+	go func() {
+		for event := range events {
+			switch event.Type.TypeMeta {
+			case internal.ContainerDestroyEvent.TypeMeta,
+				internal.ContainerDetachEvent.TypeMeta,
+				internal.ContainerDieEvent.TypeMeta,
+				internal.ContainerKillEvent.TypeMeta,
+				internal.ContainerRestartEvent.TypeMeta,
+				internal.ContainerOomEvent.TypeMeta,
+				internal.ContainerStartEvent.TypeMeta,
+				internal.ContainerStopEvent.TypeMeta:
+				slog.Info("Got event to trigger rebind", "event", event)
+				executor()
+			default:
+				slog.Debug("Got unsupported event dropping", "event", event)
+			}
+		}
+	}()
+
+	err := internal.SubscribeToDockerEvents(events)
+	if err != nil {
+		slog.Error("Could not start watching, could not attach to docker events", "error", err)
+		return err
+	}
+
+	// The maintenance and asleep files are replaced with a rename so their directories are watched rather than the files
+	paths := slices.Clone(b.Paths)
+	for _, file := range []string{b.MaintenanceFile, b.AsleepFile} {
+		if _, err := os.Stat(filepath.Dir(file)); err == nil && !slices.Contains(paths, filepath.Dir(file)) {
+			paths = append(paths, filepath.Dir(file))
 		}
 	}
 
+	oneMinute := 1 * time.Minute
+	err = internal.WatchAndExecute(
+		paths,
+		executor,
+		&oneMinute,
+	)
+	if err != nil {
+		slog.Error("Failed to launch the watcher", "error", err)
+		return err
+	}
+
 	return nil
 }
 
 func RunNginx(n *NginxStruct, b *BindingStruct, ctx *globalContext) error {
-	if b.Watch {
-		var lock sync.Mutex
-		events := make(chan internal.DockerEvent, 30)
+	// the output directory is replaced on every change, so it is resolved once in case it is the working directory
+	dir, err := filepath.Abs(n.OutDir)
+	if err != nil {
+		return err
+	}
+	n.OutDir = dir
 
-		executor := func() {
-			lock.Lock()
-			err := RunNginxBinding(n, b, ctx)
-			if err != nil {
-				slog.Error("Failed to execute nginx bindings due to error!", "error", err)
-			}
-			lock.Unlock()
-		}
-
-		go func() {
-			for event := range events {
-				switch event.Type.TypeMeta {
-				case internal.ContainerDestroyEvent.TypeMeta:
-				case internal.ContainerDetachEvent.TypeMeta:
-				case internal.ContainerDieEvent.TypeMeta:
-				case internal.ContainerKillEvent.TypeMeta:
-				case internal.ContainerRestartEvent.TypeMeta:
-				case internal.ContainerOomEvent.TypeMeta:
-				case internal.ContainerStartEvent.TypeMeta:
-				case internal.ContainerStopEvent.TypeMeta:
-					slog.Info("Got event to trigger rebind", "event", event)
-					executor()
-				default:
-					slog.Debug("Got unsupported event dropping", "event", event)
-				}
-			}
-		}()
+	return watchWithEvents(b, "nginx", func() error {
+		return RunNginxBinding(n, b, ctx)
+	})
+}
 
-		err := internal.SubscribeToDockerEvents(events)
-		if err != nil {
-			slog.Error("Could not start watching, could not attach to docker events", "error", err)
-			return err
+func RunNginxDoctor(n *NginxDoctorStruct) error {
+	err := internal.CheckNginxIncludes(n.Config, n.OutDir)
+	if err != nil {
+		for _, problem := range strings.Split(err.Error(), "\n") {
+			fmt.Println(problem)
 		}
+		return errors.New("the generated nginx configuration is not included correctly")
+	}
+
+	fmt.Println("The generated nginx configuration is included correctly")
+	return nil
+}
+
+func RunCaddyBinding(c *CaddyStruct, b *BindingStruct, ctx *globalContext) error {
+	warnAcmeUnmanaged(b, "caddy")
+
+	cli, _, bindings, err := GenerateBindings(ctx, b)
+	if err != nil {
+		return err
+	}
+	defer closeDockerClient(cli)
+
+	_, routes, issued, err := resolveRoutes(cli, b, bindings)
+	if err != nil {
+		slog.Error("Failed to resolve routes for caddy due to error", "error", err)
+		return err
+	}
+
+	var admin internal.CaddyAdmin
+	if c.Admin != "" {
+		admin = internal.CaddyAdminApi{Url: c.Admin}
+	} else {
+		slog.Info("Can't handle automatic reloads because no admin api has been provided")
+	}
+
+	// certificates are always written to the same path, so caddy has to be told to reload them even when the config
+	// itself didn't change
+	needsUpdate, err := internal.WriteCaddyConfiguration(routes, c.OutDir, c.Format, admin, issued)
+	if err != nil {
+		return err
+	}
+
+	if needsUpdate {
+		slog.Info("Caddy configuration updated")
+	} else {
+		slog.Info("No changes made")
+	}
+
+	return nil
+}
+
+func RunCaddy(c *CaddyStruct, b *BindingStruct, ctx *globalContext) error {
+	return watchWithEvents(b, "caddy", func() error {
+		return RunCaddyBinding(c, b, ctx)
+	})
+}
+
+func RunTraefikBinding(t *TraefikStruct, b *BindingStruct, ctx *globalContext) error {
+	warnAcmeUnmanaged(b, "traefik")
+
+	cli, _, bindings, err := GenerateBindings(ctx, b)
+	if err != nil {
+		return err
+	}
+	defer closeDockerClient(cli)
 
-		oneMinute := 1 * time.Minute
-		err = internal.WatchAndExecute(
-			b.Paths,
-			executor,
-			&oneMinute,
-		)
+	_, routes, issued, err := resolveRoutes(cli, b, bindings)
+	if err != nil {
+		slog.Error("Failed to resolve routes for traefik due to error", "error", err)
+		return err
+	}
+
+	files, err := internal.GenerateFilesForTraefikRoutes(routes, internal.TraefikConfiguration{
+		HttpEntrypoint:  t.HttpEntrypoint,
+		HttpsEntrypoint: t.HttpsEntrypoint,
+	})
+	if err != nil {
+		slog.Error("Failed to generate traefik configuration due to error", "error", err)
+		return err
+	}
+
+	needsUpdate, err := internal.SyncSuffixedFileSetWithDiff(files, t.OutDir, internal.TraefikFileSuffix)
+	if err != nil {
+		slog.Error("Failed to write traefik configuration due to an error", "error", err)
+		return err
+	}
+
+	// traefik reads certificates when the dynamic configuration is loaded, so the unchanged files are touched to have
+	// it load certificates which were replaced at the same path
+	if issued && !needsUpdate {
+		err = internal.TouchFileSet(files, t.OutDir)
 		if err != nil {
-			slog.Error("Failed to launch the watcher", "error", err)
+			slog.Error("Failed to have traefik reload the new certificates", "error", err)
 			return err
 		}
+		needsUpdate = true
+	}
+
+	if needsUpdate {
+		slog.Info("Files written to target, traefik will reload them automatically")
+	} else {
+		slog.Info("No changes made")
+	}
+
+	return nil
+}
+
+func RunTraefik(t *TraefikStruct, b *BindingStruct, ctx *globalContext) error {
+	return watchWithEvents(b, "traefik", func() error {
+		return RunTraefikBinding(t, b, ctx)
+	})
+}
+
+func RunHaproxyBinding(h *HaproxyStruct, b *BindingStruct, ctx *globalContext) error {
+	warnAcmeUnmanaged(b, "haproxy")
+
+	cli, _, bindings, err := GenerateBindings(ctx, b)
+	if err != nil {
+		return err
+	}
+	defer closeDockerClient(cli)
+
+	_, routes, issued, err := resolveRoutes(cli, b, bindings)
+	if err != nil {
+		slog.Error("Failed to resolve routes for haproxy due to error", "error", err)
+		return err
+	}
+
+	needsUpdate, err := internal.WriteHaproxyConfiguration(
+		internal.GenerateHaproxyConfiguration(routes),
+		h.OutDir,
+		h.Executable,
+		h.Config,
+	)
+	if err != nil {
+		slog.Error("Failed to write haproxy configuration, the previous configuration has been left in place", "error", err)
+		return err
+	}
+
+	if needsUpdate || issued {
+		slog.Info("Files written to target, system now needs updating")
+
+		if h.Executable == "" {
+			slog.Info("Can't handle automatic reloads because no executable has been provided")
+		} else {
+			err := internal.RelaunchHaproxy(h.ServiceName)
+			if err != nil {
+				slog.Error("Failed to reload haproxy - the config was valid but failed to load", "error", err)
+				return err
+			}
+		}
+	} else {
+		slog.Info("No changes made")
+	}
+
+	return nil
+}
+
+func RunHaproxy(h *HaproxyStruct, b *BindingStruct, ctx *globalContext) error {
+	return watchWithEvents(b, "haproxy", func() error {
+		return RunHaproxyBinding(h, b, ctx)
+	})
+}
+
+func RunTemplateBinding(t *TemplateStruct, b *BindingStruct, ctx *globalContext) error {
+	warnAcmeUnmanaged(b, "template")
+
+	cli, _, bindings, err := GenerateBindings(ctx, b)
+	if err != nil {
+		return err
+	}
+	defer closeDockerClient(cli)
+
+	config, routes, _, err := resolveRoutes(cli, b, bindings)
+	if err != nil {
+		slog.Error("Failed to resolve routes for templates due to error", "error", err)
+		return err
+	}
+
+	templates := internal.DefaultNginxTemplates
+	if t.Template != nil {
+		templates = os.DirFS(*t.Template)
+	}
+
+	config.OutputDir, err = filepath.Abs(t.OutDir)
+	if err != nil {
+		return err
+	}
+
+	files, err := internal.RenderTemplateSet(templates, routes, config)
+	if err != nil {
+		slog.Error("Failed to render templates due to error", "error", err)
+		return err
+	}
+
+	needsUpdate, err := internal.SyncFileSetWithDiff(files, t.OutDir)
+	if err != nil {
+		slog.Error("Failed to write rendered templates due to an error", "error", err)
+		return err
+	}
+
+	if needsUpdate {
+		slog.Info("Rendered templates written to target")
 	} else {
-		err := RunNginxBinding(n, b, ctx)
+		slog.Info("No changes made")
+	}
+
+	return nil
+}
+
+func RunTemplate(t *TemplateStruct, b *BindingStruct, ctx *globalContext) error {
+	return watchWithEvents(b, "template", func() error {
+		return RunTemplateBinding(t, b, ctx)
+	})
+}
+
+// readPassword prompts for the password twice on the terminal without echoing it, or reads the first line of stdin if
+// it isn't a terminal, so the password never ends up in argv or the shell history
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	entered := make([]string, 0, 2)
+	for _, prompt := range []string{"Password: ", "Retype password: "} {
+		fmt.Fprint(os.Stderr, prompt)
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
 		if err != nil {
-			return err
+			return "", err
 		}
+		entered = append(entered, string(password))
 	}
+	if entered[0] != entered[1] {
+		return "", errors.New("the passwords do not match")
+	}
+	return entered[0], nil
+}
 
-	return nil
+func RunHtpasswdSet(b *BindingStruct, name string, user string) error {
+	password, err := readPassword()
+	if err != nil {
+		slog.Error("Failed to read the password", "error", err)
+		return err
+	}
+	if password == "" {
+		return errors.New("no password provided, enter it when prompted or write it to stdin")
+	}
+
+	return internal.SetHtpasswdUser(b.HtpasswdDir, name, user, password)
+}
+
+func RunHtpasswdRemove(b *BindingStruct, name string, user string) error {
+	return internal.RemoveHtpasswdUser(b.HtpasswdDir, name, user)
 }
@@ -34,6 +34,26 @@ func Apply(cli *InnerCli) {
 	slog.Info("Request submitted successfully")
 }
 
+func Maintenance(cli *InnerCli, options *InnerMaintenance) {
+	client, err := makeRpc(cli)
+	if err != nil {
+		slog.Error("Failed to initialise the connection with the daemon due to an error!", "error", err)
+		os.Exit(1)
+	}
+
+	changed, err := nrpc.SetMaintenance(client, options.Project, options.State == "on")
+	if err != nil {
+		slog.Error("Failed to change the maintenance state of the project", "project", options.Project, "error", err)
+		os.Exit(1)
+	}
+
+	if changed {
+		slog.Info("Maintenance state changed, bindings will pick it up on their next run", "project", options.Project, "maintenance", options.State)
+	} else {
+		slog.Info("Project was already in this maintenance state", "project", options.Project, "maintenance", options.State)
+	}
+}
+
 func Status(cli *InnerCli, options *InnerStatus) {
 	client, err := makeRpc(cli)
 	if err != nil {
@@ -61,10 +81,10 @@ func Status(cli *InnerCli, options *InnerStatus) {
 	} else if options.Format == "table" {
 		headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
 		columnFmt := color.New(color.FgYellow).SprintfFunc()
-		tbl := table.New("Project", "Source", "Last Updated", "Current State")
+		tbl := table.New("Project", "Source", "Last Updated", "Current State", "Crash Looping")
 		tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
 		for _, v := range status {
-			tbl.AddRow(v.Project.Name, v.Project.Source, v.LastUpdated, stateToString(v.State))
+			tbl.AddRow(v.Project.Name, v.Project.Source, v.LastUpdated, stateToString(v.State), crashLoopingToString(v))
 		}
 		tbl.Print()
 
@@ -92,3 +112,21 @@ func stateToString(state internal.ProjectState) string {
 		return "Unknown (!!)"
 	}
 }
+
+func crashLoopingToString(state internal.ActiveProjectState) string {
+	services := make([]string, 0)
+	for name, service := range state.Services {
+		if !service.CrashLooping {
+			continue
+		}
+
+		if service.Stopped {
+			services = append(services, name+" (stopped)")
+		} else {
+			services = append(services, fmt.Sprintf("%v (%v restarts, %v ooms)", name, service.Restarts, service.Ooms))
+		}
+	}
+	slices.Sort(services)
+
+	return strings.Join(services, ", ")
+}
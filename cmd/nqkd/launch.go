@@ -1,19 +1,23 @@
 package main
 
 import (
+	"context"
+	"github.com/docker/docker/client"
 	"log/slog"
+	"net/http"
 	"nqk/internal"
 	"nqk/internal/nrpc"
 	"os"
+	"slices"
 	"sync"
 	"time"
 )
 
-func runLaunchCommand(l *LaunchStruct, record *internal.StateRecord) error {
+func runLaunchCommand(l *LaunchStruct, record *internal.StateRecord, sleeper *internal.Sleeper, cli *client.Client) error {
 	slog.Info("Checking all projects...")
 	projects, err := internal.LoadProjectsFromPaths(l.Paths)
 	if err != nil {
-		slog.Error("Failed to load set of projects due to error", err)
+		slog.Error("Failed to load set of projects due to error", "error", err)
 		os.Exit(1)
 	}
 
@@ -31,6 +35,16 @@ func runLaunchCommand(l *LaunchStruct, record *internal.StateRecord) error {
 	}
 
 	for _, project := range projects {
+		if record.Projects[project.Name].HasStoppedServices() {
+			slog.Warn("Not applying project because services were stopped for crash looping, change the configuration to retry", "file", project.Source)
+			continue
+		}
+
+		if sleeper.Sleeping(project.Name) {
+			slog.Debug("Not applying project because it is asleep, it will be applied when it is woken", "file", project.Source)
+			continue
+		}
+
 		needsApplying, err := internal.DoesProjectNeedApplying(project)
 		if err != nil {
 			slog.Error("Could not tell if the project needs applying - ran into an error running the command", "file", project.Source, "error", err)
@@ -55,6 +69,14 @@ func runLaunchCommand(l *LaunchStruct, record *internal.StateRecord) error {
 			slog.Debug("File does not need applying", "file", project.Source)
 			record.Update(project, internal.ProjectOk)
 		}
+
+		// containers recreated by compose lose any network they were attached to outside of the compose file
+		if l.Network != "" && !l.DryRun {
+			err = internal.ConnectProjectContainers(cli, context.Background(), l.Network, project.Name)
+			if err != nil {
+				slog.Error("Failed to attach the project to the network, the proxy may not be able to reach it", "file", project.Source, "network", l.Network, "error", err)
+			}
+		}
 	}
 	return nil
 }
@@ -65,18 +87,94 @@ func Launch(l *LaunchStruct) error {
 
 	record := internal.StateRecord{
 		Projects: map[string]*internal.ActiveProjectState{},
-		//Lock:     &lock,
+		Lock:     &lock,
+	}
+
+	detector := internal.NewCrashLoopDetector(internal.CrashLoopConfiguration{
+		Window:          l.CrashWindow,
+		Threshold:       l.CrashThreshold,
+		StopOnCrashLoop: l.CrashStop,
+		Notifications: internal.NotificationConfiguration{
+			Webhook: l.NotifyWebhook,
+			Command: l.NotifyCommand,
+		},
+	})
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		slog.Error("Failed to create the docker client!", "error", err)
+		return err
+	}
+	if l.Network != "" && !l.DryRun {
+		err = internal.EnsureNetwork(cli, context.Background(), l.Network)
+		if err != nil {
+			slog.Error("Failed to create the network, containers will not be attached to it", "network", l.Network, "error", err)
+			l.Network = ""
+		}
+	}
+
+	wakerAllow := slices.Clone(l.WakerAllow)
+	// the proxy reaches the waker from its address on the network when it runs in a container on it
+	if l.Network != "" {
+		subnets, err := internal.NetworkSubnets(cli, context.Background(), l.Network)
+		if err != nil {
+			slog.Error("Failed to find the subnets of the network, the waker will refuse requests from it", "network", l.Network, "error", err)
+		}
+		wakerAllow = append(wakerAllow, subnets...)
+	}
+	sleeper, err := internal.NewSleeper(internal.SleepConfiguration{
+		File:        l.AsleepFile,
+		WakeTimeout: l.WakeTimeout,
+		DryRun:      l.DryRun,
+		WakerAllow:  wakerAllow,
+	}, &record, &lock)
+	if err != nil {
+		slog.Error("Failed to set up putting idle projects to sleep", "error", err)
+		return err
 	}
 
 	executor := func() {
 		lock.Lock()
-		err := runLaunchCommand(l, &record)
+		err := runLaunchCommand(l, &record, sleeper, cli)
 		if err != nil {
 			slog.Error("Failed to execute launch due to error!", "error", err)
 		}
+		detector.Expire(&record, time.Now())
 		lock.Unlock()
 	}
 
+	events := make(chan internal.DockerEvent, 30)
+	go func() {
+		for event := range events {
+			switch event.Type.TypeMeta {
+			case internal.ContainerDieEvent.TypeMeta, internal.ContainerOomEvent.TypeMeta, internal.ContainerRestartEvent.TypeMeta:
+				var actions []internal.CrashLoopAction
+				lock.Lock()
+				// containers of projects being put to sleep exit as they are stopped, which isn't a crash
+				if !sleeper.Sleeping(event.Attributes()[internal.LabelComposeProject]) {
+					actions = detector.Observe(event, &record, time.Now())
+				}
+				lock.Unlock()
+				detector.Dispatch(actions, &record)
+			case internal.ContainerStartEvent.TypeMeta:
+				attributes := event.Attributes()
+				lock.Lock()
+				_, managed := record.Projects[attributes[internal.LabelComposeProject]]
+				lock.Unlock()
+				if managed && l.Network != "" && !l.DryRun {
+					if err := internal.ConnectContainer(cli, context.Background(), l.Network, attributes["name"], attributes); err != nil {
+						slog.Error("Failed to attach the started container to the network", "container", attributes["name"], "network", l.Network, "error", err)
+					}
+				}
+			}
+		}
+	}()
+
+	err = internal.SubscribeToDockerEvents(events)
+	if err != nil {
+		slog.Error("Could not attach to docker events, crash loops will not be detected", "error", err)
+	}
+
 	go func() {
 		for command := range action {
 			switch command {
@@ -87,7 +185,31 @@ func Launch(l *LaunchStruct) error {
 	}()
 
 	go func() {
-		err := nrpc.Launch(record, action)
+		for range time.Tick(time.Minute) {
+			sleeper.Check(time.Now())
+		}
+	}()
+
+	if l.WakerListen != "" {
+		addresses := []string{l.WakerListen}
+		// a proxy on the network reaches the host through the gateway of the network rather than loopback
+		if l.Network != "" {
+			if address := networkWakerAddress(cli, l.Network, l.WakerListen); address != l.WakerListen {
+				addresses = append(addresses, address)
+			}
+		}
+		for _, address := range addresses {
+			go func(address string) {
+				err := http.ListenAndServe(address, sleeper)
+				if err != nil {
+					slog.Error("Failed to launch the waker, asleep projects can't be woken", "address", address, "error", err)
+				}
+			}(address)
+		}
+	}
+
+	go func() {
+		err := nrpc.Launch(record, action, l.MaintenanceFile)
 		if err != nil {
 			slog.Error("Failed to launch the rpc server", "error", err)
 		}
@@ -95,7 +217,7 @@ func Launch(l *LaunchStruct) error {
 
 	//if l.Watch {
 	fiveMinutes := 5 * time.Minute
-	err := internal.WatchAndExecute(
+	err = internal.WatchAndExecute(
 		l.Paths,
 		executor,
 		&fiveMinutes,
@@ -5,6 +5,7 @@ import (
 	"github.com/alecthomas/kong"
 	"log/slog"
 	"os"
+	"time"
 )
 
 const Version = "v0.0.7"
@@ -17,6 +18,18 @@ type globalContext struct {
 type LaunchStruct struct {
 	Paths  []string `help:"The set of folders to watch for changes and query for updates" name:"path" type:"path"`
 	DryRun bool     `help:"Don't actually apply any changes, just list what files need applying'" name:"dry-run"`
+
+	CrashWindow     time.Duration `help:"The window over which container restarts are counted" name:"crash-window" default:"10m"`
+	CrashThreshold  int           `help:"The number of restarts within the window after which a service is crash looping" name:"crash-threshold" default:"5"`
+	CrashStop       bool          `help:"Stop services which are crash looping" name:"crash-stop"`
+	NotifyWebhook   string        `help:"A URL which will receive a JSON POST for each notification" name:"notify-webhook"`
+	NotifyCommand   string        `help:"A command which will be run for each notification" name:"notify-command"`
+	MaintenanceFile string        `help:"The file recording which projects are in maintenance, read by the bindings" name:"maintenance-file" default:"/var/lib/nqkd/maintenance.json"`
+	AsleepFile      string        `help:"The file recording which projects were stopped for being idle, read by the bindings" name:"asleep-file" default:"/var/lib/nqkd/asleep.json"`
+	WakerListen     string        `help:"The address the waker listens on for requests to asleep projects, empty to disable it. With --network it also listens on the gateway of the network" name:"waker-listen" default:"127.0.0.1:7380"`
+	WakeTimeout     time.Duration `help:"How long a woken project has to become healthy before requests are sent to it regardless" name:"wake-timeout" default:"2m"`
+	WakerAllow      []string      `help:"The addresses and CIDRs the waker accepts requests from, with --network the subnets of the network are added" name:"waker-allow" default:"127.0.0.0/8,::1"`
+	Network         string        `help:"A docker network to create and attach every container with nqk labels to, so the proxy can reach them without published ports" name:"network"`
 }
 
 func (l *LaunchStruct) Run(ctx *globalContext) error {
@@ -29,23 +42,144 @@ type BindingStruct struct {
 	Paths []string `help:"The set of folders to watch for changes and query for updates" name:"path" type:"path"`
 	Watch bool     `name:"watch" default:"false"`
 
-	SslCertificate string      `name:"ssl-cert"`
-	SslPrivateKey  string      `name:"ssl-privkey"`
-	DefaultDomain  string      `name:"domain"`
-	Nginx          NginxStruct `cmd:""`
-	Json           JsonStruct  `cmd:""`
+	SslCertificate   string            `name:"ssl-cert"`
+	SslPrivateKey    string            `name:"ssl-privkey"`
+	CertDir          *string           `help:"A directory of certificates to choose from by matching the domain of each route" name:"cert-dir" type:"existingdir"`
+	LocalCa          *string           `help:"The directory of the local certificate authority used for ports marked internal, created if missing" name:"local-ca"`
+	HtpasswdDir      string            `help:"The directory of htpasswd files used by the auth.basic label" name:"htpasswd-dir" default:"/etc/nginx/nqkd-htpasswd"`
+	SnippetDir       *string           `help:"The directory nginx snippets can be included from with the nginx.snippet label" name:"snippet-dir" type:"existingdir"`
+	MaintenanceFile  string            `help:"The file the daemon records which projects are in maintenance in" name:"maintenance-file" default:"/var/lib/nqkd/maintenance.json"`
+	MaintenancePages *string           `help:"The directory maintenance pages can be served from with the maintenance.page label" name:"maintenance-pages" type:"existingdir"`
+	AsleepFile       string            `help:"The file the daemon records which projects were stopped for being idle in" name:"asleep-file" default:"/var/lib/nqkd/asleep.json"`
+	Waker            string            `help:"The address of the daemon's waker, which requests to asleep projects are sent to. With --network a loopback address is replaced with the gateway of the network" name:"waker" default:"127.0.0.1:7380"`
+	Network          string            `help:"The docker network the proxy is attached to, proxying to container addresses on it instead of published ports" name:"network"`
+	Ipv6             bool              `help:"Also listen on every IPv6 address wherever every IPv4 address is listened on" name:"ipv6"`
+	DefaultDomain    string            `name:"domain"`
+	AcmeOptions      AcmeFlags         `embed:"" prefix:"acme-"`
+	Nginx            NginxStruct       `cmd:""`
+	NginxDoctor      NginxDoctorStruct `cmd:"" name:"nginx-doctor" help:"Check that nginx.conf includes the generated http and stream configuration from the right blocks"`
+	Caddy            CaddyStruct       `cmd:"" help:"Write a caddyfile or caddy json configuration, loading it through the admin api"`
+	Traefik          TraefikStruct     `cmd:"" help:"Write traefik dynamic configuration for the file provider"`
+	Haproxy          HaproxyStruct     `cmd:"" help:"Write a haproxy configuration, validating it before it is swapped in"`
+	Template         TemplateStruct    `cmd:"" help:"Render a directory of text/template files against the routing table"`
+	Acme             AcmeStruct        `cmd:"" help:"Obtain and renew certificates for every tls domain without writing any proxy configuration"`
+	CaRoot           CaRootStruct      `cmd:"" name:"ca-root" help:"Print the root certificate of the local certificate authority for clients to trust"`
+	Htpasswd         HtpasswdStruct    `cmd:"" help:"Manage the users in the htpasswd files used by the auth.basic label"`
+	Json             JsonStruct        `cmd:""`
+	Routes           RoutesStruct      `cmd:"" help:"Export the resolved routing table as json"`
+}
+
+type AcmeFlags struct {
+	Directory   string        `help:"The ACME directory certificates are requested from, ACME is disabled if empty" name:"directory"`
+	Email       string        `help:"The contact email registered with the ACME account" name:"email"`
+	Store       string        `help:"The directory the ACME account and certificates are stored in" name:"store" default:"/var/lib/nqkd/acme"`
+	Webroot     string        `help:"The directory http-01 challenges are written to and served from on port 80" name:"webroot"`
+	DnsCommand  string        `help:"A command run as '<command> present|cleanup <record> <value>' to solve dns-01 challenges" name:"dns-command"`
+	Ca          string        `help:"A PEM file of roots trusted when talking to the ACME directory, ie for pebble" name:"ca" type:"existingfile"`
+	RenewBefore time.Duration `help:"How long before expiry certificates are renewed" name:"renew-before" default:"720h"`
 }
 
 type NginxStruct struct {
-	OutDir      string  `name:"dir" default:"."`
-	Executable  *string `name:"executable"`
-	ServiceName string  `name:"service" default:"nginx"`
+	OutDir        string        `name:"dir" default:"."`
+	Executable    string        `help:"The nginx executable used for validation and the nginx reload strategy, validation and reloads are skipped if empty and nginx isn't in docker" name:"executable" default:"nginx"`
+	ServiceName   string        `name:"service" default:"nginx"`
+	Reload        string        `help:"How nginx is told about new config, service restarts it while the others reload it gracefully" name:"reload" enum:"service,nginx,systemctl,pid,docker" default:"nginx"`
+	PidFile       string        `help:"The pid file of the nginx master process, used to confirm the nginx, pid and service reload strategies" name:"pid-file" default:"/run/nginx.pid"`
+	Container     string        `help:"The container running nginx for the docker reload strategy" name:"container" default:"nginx"`
+	ReloadTimeout time.Duration `help:"How long to wait for nginx to confirm a reload" name:"reload-timeout" default:"10s"`
+	Config        string        `help:"The main nginx config file, a copy pointing at the staged files is validated before they are swapped in" name:"config" default:"/etc/nginx/nginx.conf"`
 }
 
 func (n *NginxStruct) Run(ctx *globalContext, b *BindingStruct) error {
 	return RunNginx(n, b, ctx)
 }
 
+type NginxDoctorStruct struct {
+	OutDir string `help:"The directory the nginx binding writes to" name:"dir" default:"."`
+	Config string `help:"The main nginx config file" name:"config" default:"/etc/nginx/nginx.conf" type:"existingfile"`
+}
+
+func (n *NginxDoctorStruct) Run(ctx *globalContext, b *BindingStruct) error {
+	return RunNginxDoctor(n)
+}
+
+type CaddyStruct struct {
+	OutDir string `name:"dir" default:"."`
+	Format string `name:"format" enum:"caddyfile,json" default:"caddyfile"`
+	Admin  string `help:"The url of the caddy admin api (usually http://localhost:2019) to load the configuration through. This replaces caddy's whole configuration, leave empty to only write the file" name:"admin"`
+}
+
+func (c *CaddyStruct) Run(ctx *globalContext, b *BindingStruct) error {
+	return RunCaddy(c, b, ctx)
+}
+
+type TraefikStruct struct {
+	OutDir          string `help:"The directory watched by the traefik file provider" name:"dir" default:"."`
+	HttpEntrypoint  string `help:"The traefik entrypoint serving http on port 80" name:"http-entrypoint" default:"web"`
+	HttpsEntrypoint string `help:"The traefik entrypoint serving https on port 443" name:"https-entrypoint" default:"websecure"`
+}
+
+func (t *TraefikStruct) Run(ctx *globalContext, b *BindingStruct) error {
+	return RunTraefik(t, b, ctx)
+}
+
+type HaproxyStruct struct {
+	OutDir      string   `name:"dir" default:"."`
+	Executable  string   `help:"The haproxy executable the configuration is validated with, validation and reloads are skipped if empty" name:"executable" default:"haproxy"`
+	Config      []string `help:"The main haproxy config files the generated file is validated alongside" name:"config"`
+	ServiceName string   `name:"service" default:"haproxy"`
+}
+
+func (h *HaproxyStruct) Run(ctx *globalContext, b *BindingStruct) error {
+	return RunHaproxy(h, b, ctx)
+}
+
+type TemplateStruct struct {
+	OutDir   string  `name:"dir" default:"."`
+	Template *string `help:"The directory of templates to render, defaults to the built in nginx templates" name:"template" type:"existingdir"`
+}
+
+func (t *TemplateStruct) Run(ctx *globalContext, b *BindingStruct) error {
+	return RunTemplate(t, b, ctx)
+}
+
+type AcmeStruct struct {
+}
+
+func (a *AcmeStruct) Run(ctx *globalContext, b *BindingStruct) error {
+	return RunAcme(b, ctx)
+}
+
+type CaRootStruct struct {
+}
+
+func (c *CaRootStruct) Run(ctx *globalContext, b *BindingStruct) error {
+	return RunCaRoot(b)
+}
+
+type HtpasswdStruct struct {
+	Set    HtpasswdSetStruct    `cmd:"" help:"Add a user to an htpasswd file or change their password, which is prompted for or read from stdin"`
+	Remove HtpasswdRemoveStruct `cmd:"" help:"Remove a user from an htpasswd file"`
+}
+
+type HtpasswdSetStruct struct {
+	Name string `arg:"" help:"The name of the htpasswd file, as used in the auth.basic label"`
+	User string `arg:"" help:"The user to add or update"`
+}
+
+func (h *HtpasswdSetStruct) Run(ctx *globalContext, b *BindingStruct) error {
+	return RunHtpasswdSet(b, h.Name, h.User)
+}
+
+type HtpasswdRemoveStruct struct {
+	Name string `arg:"" help:"The name of the htpasswd file, as used in the auth.basic label"`
+	User string `arg:"" help:"The user to remove"`
+}
+
+func (h *HtpasswdRemoveStruct) Run(ctx *globalContext, b *BindingStruct) error {
+	return RunHtpasswdRemove(b, h.Name, h.User)
+}
+
 type JsonStruct struct {
 }
 
@@ -53,12 +187,20 @@ func (j *JsonStruct) Run(ctx *globalContext, b *BindingStruct) error {
 	return RunJson(b, ctx)
 }
 
+type RoutesStruct struct {
+}
+
+func (r *RoutesStruct) Run(ctx *globalContext, b *BindingStruct) error {
+	return RunRoutes(b, ctx)
+}
+
 // Inner CLI
 
 type InnerCli struct {
-	SocketFile string      `name:"socket" default:"/run/nqkd/nqkd.sock"`
-	Apply      InnerApply  `cmd:""`
-	Status     InnerStatus `cmd:""`
+	SocketFile  string           `name:"socket" default:"/run/nqkd/nqkd.sock"`
+	Apply       InnerApply       `cmd:""`
+	Status      InnerStatus      `cmd:""`
+	Maintenance InnerMaintenance `cmd:"" help:"Serve the maintenance page for every http route of a project instead of forwarding requests"`
 }
 
 type InnerApply struct {
@@ -78,6 +220,16 @@ func (s *InnerStatus) Run(cli *InnerCli) error {
 	return nil
 }
 
+type InnerMaintenance struct {
+	State   string `arg:"" enum:"on,off" help:"Whether the project should be in maintenance"`
+	Project string `arg:"" help:"The name of the project"`
+}
+
+func (m *InnerMaintenance) Run(cli *InnerCli) error {
+	Maintenance(cli, m)
+	return nil
+}
+
 // Version
 
 type VersionCommand struct{}
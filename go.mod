@@ -9,7 +9,9 @@ require (
 	github.com/fatih/color v1.16.0
 	github.com/kylelemons/godebug v1.1.0
 	github.com/rodaine/table v1.1.0
+	golang.org/x/crypto v0.17.0
 	golang.org/x/exp v0.0.0-20231127185646-65229373498e
+	golang.org/x/term v0.15.0
 	gopkg.in/fsnotify/fsnotify.v1 v1.4.7
 	gopkg.in/yaml.v2 v2.4.0
 )
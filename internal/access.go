@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HtpasswdPath returns the path of the named htpasswd file in the directory, or an error if the name is not just
+// letters, numbers, dots, dashes and underscores
+func HtpasswdPath(dir string, name string) (string, error) {
+	return safeFilePath(dir, name, "htpasswd")
+}
+
+// readHtpasswd returns the lines of the htpasswd file, or nothing if it doesn't exist
+func readHtpasswd(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return make([]string, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// writeHtpasswd replaces the line for the user in the htpasswd file, removing it if entry is empty, and keeps every
+// other line as is. New files are readable by everyone as nginx workers don't run as root and only hashes are stored,
+// existing files keep their mode and owner so they can be restricted to the group the workers run as
+func writeHtpasswd(path string, user string, entry string) error {
+	lines, err := readHtpasswd(path)
+	if err != nil {
+		return err
+	}
+
+	result := make([]string, 0, len(lines)+1)
+	replaced := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, user+":") {
+			if entry != "" && !replaced {
+				result = append(result, entry)
+			}
+			replaced = true
+			continue
+		}
+		result = append(result, line)
+	}
+	if !replaced && entry != "" {
+		result = append(result, entry)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	content := strings.Join(result, "\n")
+	if len(result) > 0 {
+		content += "\n"
+	}
+	return os.WriteFile(path, []byte(content), 0644)
+}
+
+// SetHtpasswdUser adds the user to the named htpasswd file with a bcrypt hash of the password, replacing their
+// password if they already exist. The file is created if it doesn't exist
+func SetHtpasswdUser(dir string, name string, user string, password string) error {
+	if user == "" || strings.ContainsAny(user, ":\n") {
+		return errors.New("invalid htpasswd user " + strconv.Quote(user))
+	}
+	path, err := HtpasswdPath(dir, name)
+	if err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	err = writeHtpasswd(path, user, user+":"+string(hash))
+	if err != nil {
+		slog.Error("Failed to write htpasswd file", "file", path, "error", err)
+		return err
+	}
+	return nil
+}
+
+// RemoveHtpasswdUser removes the user from the named htpasswd file
+func RemoveHtpasswdUser(dir string, name string, user string) error {
+	path, err := HtpasswdPath(dir, name)
+	if err != nil {
+		return err
+	}
+
+	err = writeHtpasswd(path, user, "")
+	if err != nil {
+		slog.Error("Failed to write htpasswd file", "file", path, "error", err)
+		return err
+	}
+	return nil
+}
+
+// ParseAccessList splits a comma separated list of addresses and CIDRs (or `all`), returning the valid entries and
+// whether every entry was valid. Invalid entries are logged
+func ParseAccessList(value string) ([]string, bool) {
+	result := make([]string, 0)
+	valid := true
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if entry != "all" && net.ParseIP(entry) == nil {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				slog.Error("Ignoring access list entry because it is not an address, a CIDR or all", "entry", entry)
+				valid = false
+				continue
+			}
+		}
+		result = append(result, entry)
+	}
+	return result, valid
+}
+
+// RouteForwardAuth is a service requests are checked against before they are forwarded, as with nginx's auth_request.
+// A 2xx response allows the request, 401 or 403 reject it
+type RouteForwardAuth struct {
+	// Target is the service from the label, as <service>:<port> in the same project or <project>/<service>:<port>
+	Target string `json:"target"`
+	// Address is the url of the resolved target including its path, this is empty if the target couldn't be found and
+	// every request should be denied
+	Address string `json:"address,omitempty"`
+	// Path is the path on the target requests are checked against
+	Path string `json:"path"`
+}
+
+// resolveForwardAuth finds the route the forward auth target refers to and sets Address to it
+func resolveForwardAuth(route *Route, routes []Route) {
+	target := route.ForwardAuth.Target
+	project := route.Project
+	if before, after, found := strings.Cut(target, "/"); found {
+		project, target = before, after
+	}
+	service, portString, _ := strings.Cut(target, ":")
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		slog.Error("Denying every request to route because the forward auth target is not <service>:<port>", "target", route.ForwardAuth.Target, "project", route.Project, "container", route.Container, "port", route.ContainerPort)
+		return
+	}
+
+	for _, candidate := range routes {
+		if candidate.Project == project && (candidate.Service == service || candidate.Container == service) && candidate.ContainerPort == uint16(port) {
+			if candidate.Asleep {
+				slog.Error("Denying every request to route because the forward auth target is asleep, it can only be woken by its own requests", "target", route.ForwardAuth.Target, "project", route.Project, "container", route.Container, "port", route.ContainerPort)
+				return
+			}
+			scheme := ValueTypeHttp
+			if candidate.Upstream.IsTls() {
+				scheme = ValueTypeHttps
+			}
+			route.ForwardAuth.Address = scheme + "://" + candidate.Upstream.Address() + route.ForwardAuth.Path
+			return
+		}
+	}
+
+	slog.Error("Denying every request to route because the forward auth target could not be found", "target", route.ForwardAuth.Target, "project", route.Project, "container", route.Container, "port", route.ContainerPort)
+}
+
+// HasAccessControl returns whether any access control label applies to the route, generators which can't enforce them
+// skip these routes rather than serve them unprotected
+func (r Route) HasAccessControl() bool {
+	return len(r.Allow) > 0 || len(r.Deny) > 0 || r.BasicAuth != "" || r.ForwardAuth != nil
+}
+
+// resolveAccessLists sets the addresses allowed and denied by the allow and deny labels. Access lists fail closed, so a
+// typo in a label never opens a route up to more addresses than intended
+func resolveAccessLists(route *Route, labels portLabels) {
+	if allow := labels.get(LabelGlobalAllow, LabelPortAllow); allow != nil {
+		route.Allow, _ = ParseAccessList(*allow)
+		if len(route.Allow) == 0 {
+			route.Deny = append(route.Deny, "all")
+		}
+	}
+	if deny := labels.get(LabelGlobalDeny, LabelPortDeny); deny != nil {
+		entries, valid := ParseAccessList(*deny)
+		if !valid {
+			slog.Error("Denying every address because the deny label has an invalid entry", "deny", *deny, "port", labels.port, "container", labels.container)
+			entries = []string{"all"}
+		}
+		route.Deny = append(entries, route.Deny...)
+	}
+}
+
+// resolveAuth sets the htpasswd file and forward auth service an http route requires a login from. An invalid basic
+// auth name denies every request, and returns false if the port should be skipped because the forward auth path isn't
+// valid, as the path is written into proxy_pass and leaving the port out is safer than serving it unprotected
+func resolveAuth(route *Route, labels portLabels, config BindingConfiguration) bool {
+	if name := labels.get(LabelGlobalAuthBasic, LabelPortAuthBasic); name != nil {
+		path, err := HtpasswdPath(config.HtpasswdDir, *name)
+		if err != nil {
+			slog.Error("Denying every request because the basic auth label is not a valid htpasswd name", "name", *name, "port", labels.port, "container", labels.container, "error", err)
+			route.Deny = append(route.Deny, "all")
+		} else {
+			if _, err := os.Stat(path); err != nil {
+				slog.Warn("The htpasswd file for basic auth does not exist, every request will be rejected until it is created", "file", path, "port", labels.port, "container", labels.container)
+			}
+			route.BasicAuth = path
+		}
+	}
+
+	if target := labels.get(LabelGlobalAuthForward, LabelPortAuthForward); target != nil {
+		route.ForwardAuth = &RouteForwardAuth{
+			Target: *target,
+			Path:   labels.value(LabelGlobalAuthForwardPath, LabelPortAuthForwardPath, "/"),
+		}
+		if !pathRegex.MatchString(route.ForwardAuth.Path) {
+			slog.Error("Skipping port because the forward auth path may only contain letters, digits, /, %, -, ., _ and ~", "path", route.ForwardAuth.Path, "port", labels.port, "container", labels.container)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswdUsers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admins")
+	readUsers := func() map[string]string {
+		t.Helper()
+		lines, err := readHtpasswd(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users := make(map[string]string)
+		for _, line := range lines {
+			user, hash, _ := strings.Cut(line, ":")
+			users[user] = hash
+		}
+		return users
+	}
+
+	if err := SetHtpasswdUser(dir, "admins", "alice", "first"); err != nil {
+		t.Fatalf("SetHtpasswdUser() error = %v", err)
+	}
+	if err := SetHtpasswdUser(dir, "admins", "bob", "second"); err != nil {
+		t.Fatalf("SetHtpasswdUser() error = %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("htpasswd stat = %v, %v, want a file nginx workers can read", info, err)
+	}
+
+	t.Run("passwords are replaced", func(t *testing.T) {
+		if err := SetHtpasswdUser(dir, "admins", "alice", "changed"); err != nil {
+			t.Fatal(err)
+		}
+		users := readUsers()
+		if len(users) != 2 {
+			t.Fatalf("users = %v, want alice and bob once each", users)
+		}
+		if bcrypt.CompareHashAndPassword([]byte(users["alice"]), []byte("changed")) != nil {
+			t.Errorf("alice's hash doesn't match the new password")
+		}
+		if bcrypt.CompareHashAndPassword([]byte(users["bob"]), []byte("second")) != nil {
+			t.Errorf("bob's hash was changed")
+		}
+	})
+
+	t.Run("existing modes are kept", func(t *testing.T) {
+		if err := os.Chmod(path, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := SetHtpasswdUser(dir, "admins", "carol", "third"); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+			t.Errorf("htpasswd stat = %v, %v, want the restricted mode kept", info, err)
+		}
+	})
+
+	t.Run("users are removed", func(t *testing.T) {
+		if err := RemoveHtpasswdUser(dir, "admins", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		if err := RemoveHtpasswdUser(dir, "admins", "nobody"); err != nil {
+			t.Fatalf("RemoveHtpasswdUser() error = %v for a missing user", err)
+		}
+		if users := readUsers(); len(users) != 2 || users["alice"] != "" {
+			t.Errorf("users = %v, want only alice removed", users)
+		}
+	})
+
+	t.Run("invalid names and users are rejected", func(t *testing.T) {
+		for _, user := range []string{"", "a:b", "a\nb"} {
+			if err := SetHtpasswdUser(dir, "admins", user, "x"); err == nil {
+				t.Errorf("SetHtpasswdUser() accepted the user %q", user)
+			}
+		}
+		if err := SetHtpasswdUser(dir, "../escape", "alice", "x"); err == nil {
+			t.Errorf("SetHtpasswdUser() accepted a name outside the directory")
+		}
+	})
+}
+
+func TestResolveAccessLists(t *testing.T) {
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		wantAllow []string
+		wantDeny  []string
+	}{
+		{name: "no labels"},
+		{
+			name:      "port labels replace the global ones",
+			labels:    map[string]string{LabelGlobalAllow: "10.0.0.0/8", "org.xiomi.nqkd.80.allow": "192.168.1.0/24, 192.168.2.1"},
+			wantAllow: []string{"192.168.1.0/24", "192.168.2.1"},
+		},
+		{
+			name:      "deny is checked before allow",
+			labels:    map[string]string{LabelGlobalAllow: "10.0.0.0/8", LabelGlobalDeny: "10.0.0.1"},
+			wantAllow: []string{"10.0.0.0/8"},
+			wantDeny:  []string{"10.0.0.1"},
+		},
+		{
+			name:      "invalid allow entries are dropped",
+			labels:    map[string]string{LabelGlobalAllow: "10.0.0.0/8,nope"},
+			wantAllow: []string{"10.0.0.0/8"},
+		},
+		{
+			name:      "allow without a valid entry denies everything",
+			labels:    map[string]string{LabelGlobalAllow: "nope"},
+			wantAllow: []string{},
+			wantDeny:  []string{"all"},
+		},
+		{
+			name:     "invalid deny entries deny everything",
+			labels:   map[string]string{LabelGlobalDeny: "10.0.0.1,10.0.0.300"},
+			wantDeny: []string{"all"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route := testRoute("shop", "example.com", 8080)
+			resolveAccessLists(&route, portLabels{labels: test.labels, port: 80, container: route.Container})
+			if !slices.Equal(route.Allow, test.wantAllow) || !slices.Equal(route.Deny, test.wantDeny) {
+				t.Errorf("allow = %v, deny = %v, want %v and %v", route.Allow, route.Deny, test.wantAllow, test.wantDeny)
+			}
+		})
+	}
+}
+
+func TestResolveForwardAuth(t *testing.T) {
+	sso := testRoute("sso", "sso.example.com", 9091, func(route *Route) { route.Service, route.ContainerPort = "authelia", 9091 })
+	secure := testRoute("shop", "api.example.com", 9443, func(route *Route) {
+		route.Service, route.ContainerPort, route.Upstream.Scheme = "auth", 443, ValueTypeHttps
+	})
+	asleep := testRoute("idle", "idle.example.com", 9000, func(route *Route) { route.Service, route.Asleep = "auth", true })
+	routes := []Route{sso, secure, asleep}
+
+	tests := []struct {
+		name   string
+		target string
+		path   string
+		want   string
+	}{
+		{name: "service in the same project", target: "auth:443", path: "/verify", want: "https://127.0.0.1:9443/verify"},
+		{name: "service in another project", target: "sso/authelia:9091", path: "/api/verify", want: "http://127.0.0.1:9091/api/verify"},
+		{name: "container name", target: "sso/sso-web-1:9091", path: "/", want: "http://127.0.0.1:9091/"},
+		{name: "missing port", target: "auth", path: "/"},
+		{name: "unknown service", target: "sso/missing:9091", path: "/"},
+		{name: "asleep target", target: "idle/auth:80", path: "/"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route := testRoute("shop", "example.com", 8080)
+			route.ForwardAuth = &RouteForwardAuth{Target: test.target, Path: test.path}
+			resolveForwardAuth(&route, routes)
+			if route.ForwardAuth.Address != test.want {
+				t.Errorf("address = %q, want %q", route.ForwardAuth.Address, test.want)
+			}
+		})
+	}
+}
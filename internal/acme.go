@@ -0,0 +1,449 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// AcmeChallengePath is the path http-01 challenges are served from, relative to both the domain and the webroot
+	AcmeChallengePath = "/.well-known/acme-challenge/"
+	// AcmeAccountKeyFile is the name of the file in the store directory which holds the ACME account key
+	AcmeAccountKeyFile = "account.key"
+	// acmeRetryDelay is how long to wait before trying to obtain a certificate for a domain again after a failure, so
+	// a misconfigured domain doesn't run into the rate limits of the ACME server
+	acmeRetryDelay = 1 * time.Hour
+)
+
+// AcmeDnsProvider creates and removes the TXT records used to solve dns-01 challenges
+type AcmeDnsProvider interface {
+	// Present creates a TXT record with the given name (ie _acme-challenge.example.com) and value
+	Present(ctx context.Context, record string, value string) error
+	// CleanUp removes the TXT record created by Present
+	CleanUp(ctx context.Context, record string, value string) error
+}
+
+// AcmeDnsCommand is an AcmeDnsProvider which calls out to an executable as `<command> present <record> <value>` and
+// `<command> cleanup <record> <value>`. The command should only exit once the record is visible to the ACME server
+type AcmeDnsCommand struct {
+	Command string
+}
+
+func (a AcmeDnsCommand) run(ctx context.Context, action string, record string, value string) error {
+	cmd := RunContext(ctx, a.Command, action, record, value)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		slog.Error("The dns provider command failed", "command", a.Command, "action", action, "record", record, "error", err, "output", cleanNewLineTabFromString(string(out)))
+		return err
+	}
+	return nil
+}
+
+func (a AcmeDnsCommand) Present(ctx context.Context, record string, value string) error {
+	return a.run(ctx, "present", record, value)
+}
+
+func (a AcmeDnsCommand) CleanUp(ctx context.Context, record string, value string) error {
+	return a.run(ctx, "cleanup", record, value)
+}
+
+// AcmeConfiguration describes the ACME server certificates are requested from and how challenges are solved
+type AcmeConfiguration struct {
+	// DirectoryUrl is the url of the ACME directory, ie https://acme-v02.api.letsencrypt.org/directory
+	DirectoryUrl string
+	// Email is the contact address registered with the account, this may be empty
+	Email string
+	// StoreDir is where the account key and every certificate is written. Certificates are written as <domain>.crt and
+	// <domain>.key so the directory can be loaded with LoadCertificateDirectory
+	StoreDir string
+	// Webroot is the directory http-01 challenge responses are written to, under AcmeChallengePath. The proxy is
+	// expected to serve this directory for every domain on port 80
+	Webroot string
+	// DnsProvider solves dns-01 challenges. If set it is preferred over http-01, and it is required for wildcards
+	DnsProvider AcmeDnsProvider
+	// RootCertificates is an optional PEM file of roots trusted when talking to the directory, ie for a local pebble
+	RootCertificates string
+	// RenewBefore is how long before expiry a certificate is renewed
+	RenewBefore time.Duration
+}
+
+// AcmeManager obtains and renews certificates from an ACME server. It remembers failures so a domain which can't be
+// validated is only retried after acmeRetryDelay
+type AcmeManager struct {
+	config     AcmeConfiguration
+	client     *acme.Client
+	retryAfter map[string]time.Time
+}
+
+// readOrCreateAccountKey loads the ECDSA account key from the store, generating and saving a new one if it is missing
+func readOrCreateAccountKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM encoded key found in " + path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	err = writePrivateKey(path, key)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Generated a new ACME account key", "file", path)
+	return key, nil
+}
+
+// encodePrivateKey returns the key as a PEM encoded EC private key
+func encodePrivateKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// writePrivateKey writes the key to the path as a PEM encoded EC private key readable only by the owner
+func writePrivateKey(path string, key *ecdsa.PrivateKey) error {
+	encoded, err := encodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, encoded, 0600)
+}
+
+// writeCertificatePair replaces the certificate and private key on disk with the PEM encoded chain and the key. Both
+// are written to temporary files first and renamed into place one straight after the other, so a proxy reloading
+// while a certificate is renewed never reads a half written file and only sees a mismatched pair for the instant
+// between the renames
+func writeCertificatePair(certificatePath string, keyPath string, chain []byte, key *ecdsa.PrivateKey) error {
+	encoded, err := encodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(keyPath+".tmp", encoded, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(certificatePath+".tmp", chain, 0644)
+	if err != nil {
+		_ = os.Remove(keyPath + ".tmp")
+		return err
+	}
+
+	err = os.Rename(keyPath+".tmp", keyPath)
+	if err != nil {
+		_ = os.Remove(keyPath + ".tmp")
+		_ = os.Remove(certificatePath + ".tmp")
+		return err
+	}
+	return os.Rename(certificatePath+".tmp", certificatePath)
+}
+
+// NewAcmeManager loads (or creates) the account key in the store directory and registers it with the ACME server,
+// accepting its terms of service. An account which is already registered is reused
+func NewAcmeManager(ctx context.Context, config AcmeConfiguration) (*AcmeManager, error) {
+	err := os.MkdirAll(config.StoreDir, 0700)
+	if err != nil {
+		slog.Error("Failed to create the ACME store directory", "dir", config.StoreDir, "error", err)
+		return nil, err
+	}
+
+	key, err := readOrCreateAccountKey(filepath.Join(config.StoreDir, AcmeAccountKeyFile))
+	if err != nil {
+		slog.Error("Failed to load the ACME account key", "dir", config.StoreDir, "error", err)
+		return nil, err
+	}
+
+	client := &acme.Client{Key: key, DirectoryURL: config.DirectoryUrl, UserAgent: "nqkd"}
+	if config.RootCertificates != "" {
+		roots, err := os.ReadFile(config.RootCertificates)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(roots) {
+			return nil, errors.New("no certificates found in " + config.RootCertificates)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+
+	account := &acme.Account{}
+	if config.Email != "" {
+		account.Contact = []string{"mailto:" + config.Email}
+	}
+	_, err = client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		slog.Error("Failed to register the ACME account", "directory", config.DirectoryUrl, "error", err)
+		return nil, err
+	}
+
+	return &AcmeManager{
+		config:     config,
+		client:     client,
+		retryAfter: make(map[string]time.Time),
+	}, nil
+}
+
+// acmeFileName returns the name certificates for the domain are stored under, wildcards are replaced with _wildcard.
+// Returns false if the domain isn't valid, as it would otherwise be able to name a file outside the store
+func acmeFileName(domain string) (string, bool) {
+	if !ValidDomain(domain) {
+		return "", false
+	}
+	return strings.ReplaceAll(strings.ToLower(domain), "*", "_wildcard"), true
+}
+
+// CertificatePath returns where the certificate and private key for the domain are stored, or empty paths if the
+// domain isn't valid
+func (m *AcmeManager) CertificatePath(domain string) (string, string) {
+	name, ok := acmeFileName(domain)
+	if !ok {
+		return "", ""
+	}
+	base := filepath.Join(m.config.StoreDir, name)
+	return base + ".crt", base + ".key"
+}
+
+// solve completes a single authorization, using the dns provider if there is one and http-01 otherwise
+func (m *AcmeManager) solve(ctx context.Context, authorizationUrl string) error {
+	authorization, err := m.client.GetAuthorization(ctx, authorizationUrl)
+	if err != nil {
+		return err
+	}
+	if authorization.Status == acme.StatusValid {
+		return nil
+	}
+
+	wanted := "http-01"
+	if m.config.DnsProvider != nil {
+		wanted = "dns-01"
+	}
+	index := slices.IndexFunc(authorization.Challenges, func(c *acme.Challenge) bool { return c.Type == wanted })
+	if index == -1 {
+		return fmt.Errorf("the ACME server did not offer a %v challenge for %v", wanted, authorization.Identifier.Value)
+	}
+	challenge := authorization.Challenges[index]
+
+	if wanted == "dns-01" {
+		value, err := m.client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return err
+		}
+		record := "_acme-challenge." + authorization.Identifier.Value
+		err = m.config.DnsProvider.Present(ctx, record, value)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := m.config.DnsProvider.CleanUp(ctx, record, value); err != nil {
+				slog.Warn("Failed to clean up the dns-01 challenge record", "record", record, "error", err)
+			}
+		}()
+	} else {
+		if m.config.Webroot == "" {
+			return errors.New("http-01 challenges need a webroot or a dns provider to be configured")
+		}
+		response, err := m.client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(m.config.Webroot, AcmeChallengePath, challenge.Token)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(path, []byte(response), 0644)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := os.Remove(path); err != nil {
+				slog.Warn("Failed to clean up the http-01 challenge response", "file", path, "error", err)
+			}
+		}()
+	}
+
+	_, err = m.client.Accept(ctx, challenge)
+	if err != nil {
+		return err
+	}
+	_, err = m.client.WaitAuthorization(ctx, authorization.URI)
+	return err
+}
+
+// Obtain requests a new certificate for the domain, solving every challenge, and writes it and a freshly generated
+// private key to the store with writeCertificatePair
+func (m *AcmeManager) Obtain(ctx context.Context, domain string) (*CertificatePair, error) {
+	if !ValidDomain(domain) {
+		return nil, fmt.Errorf("invalid domain %q", domain)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, authorizationUrl := range order.AuthzURLs {
+		err = m.solve(ctx, authorizationUrl)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded []byte
+	for _, der := range chain {
+		encoded = append(encoded, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	certificatePath, keyPath := m.CertificatePath(domain)
+	err = writeCertificatePair(certificatePath, keyPath, encoded, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadCertificatePair(certificatePath, keyPath)
+}
+
+// EnsureCertificates obtains a certificate for every domain which does not have one in the store, or whose
+// certificate expires within RenewBefore. Domains which fail are logged and skipped until acmeRetryDelay has passed,
+// and every failure is returned joined together. Returns whether any certificate was written
+func (m *AcmeManager) EnsureCertificates(ctx context.Context, domains []string) (bool, error) {
+	changed := false
+	failures := make([]error, 0)
+	now := time.Now()
+
+	for _, domain := range domains {
+		if !ValidDomain(domain) {
+			slog.Error("Skipping domain because it is not a valid hostname", "domain", domain)
+			failures = append(failures, fmt.Errorf("invalid domain %q", domain))
+			continue
+		}
+		if retry, ok := m.retryAfter[domain]; ok && now.Before(retry) {
+			slog.Debug("Skipping domain because obtaining a certificate failed recently", "domain", domain, "retry", retry)
+			continue
+		}
+
+		existing, err := ReadCertificatePair(m.CertificatePath(domain))
+		if err == nil && existing.NotAfter.Sub(now) > m.config.RenewBefore {
+			continue
+		}
+
+		slog.Info("Requesting a certificate from the ACME server", "domain", domain, "renewal", err == nil)
+		pair, err := m.Obtain(ctx, domain)
+		if err != nil {
+			slog.Error("Failed to obtain a certificate", "domain", domain, "error", err)
+			m.retryAfter[domain] = now.Add(acmeRetryDelay)
+			failures = append(failures, fmt.Errorf("%v: %w", domain, err))
+			continue
+		}
+
+		slog.Info("Obtained a certificate", "domain", domain, "expires", pair.NotAfter)
+		delete(m.retryAfter, domain)
+		changed = true
+	}
+
+	return changed, errors.Join(failures...)
+}
+
+// tlsDomains returns the sorted, unique domains and aliases of every tls route for which needed returns true given the
+// certificate the domain is served with, skipping wildcards unless they are allowed
+func tlsDomains(routes []Route, wildcards bool, needed func(domain string, certificate string) bool) []string {
+	result := make([]string, 0)
+	for _, route := range routes {
+		if !route.Tls {
+			continue
+		}
+
+		certificates := map[string]string{route.Domain: route.Certificate}
+		domains := []string{route.Domain}
+		for _, alias := range route.Aliases {
+			certificates[alias.Domain] = alias.Certificate
+			domains = append(domains, alias.Domain)
+		}
+		for _, domain := range domains {
+			if domain == "" || slices.Contains(result, domain) || !needed(domain, certificates[domain]) {
+				continue
+			}
+			if !ValidDomain(domain) {
+				slog.Error("Skipping domain because it is not a valid hostname", "domain", domain)
+				continue
+			}
+			if strings.HasPrefix(domain, "*.") && !wildcards {
+				slog.Warn("Skipping wildcard domain because wildcard certificates need a dns provider", "domain", domain)
+				continue
+			}
+			result = append(result, domain)
+		}
+	}
+
+	slices.Sort(result)
+	return result
+}
+
+// AcmeDomains returns the sorted, unique domains of every tls route which should have a certificate requested. Routes
+// using the local certificate authority are left out, as are domains already served with a certificate from their
+// labels or the certificate directory, or with a default certificate which covers them. Domains served from the ACME
+// store are kept so they are renewed. Wildcards are skipped when only http-01 is available as they can only be
+// validated over dns
+func AcmeDomains(routes []Route, config BindingConfiguration, store string, dnsAvailable bool) []string {
+	store = filepath.Clean(store)
+	needed := func(domain string, certificate string) bool {
+		switch {
+		case certificate == "" || filepath.Dir(certificate) == store:
+			return true
+		case certificate == config.SslCertificate:
+			return config.DefaultCertificate == nil || !config.DefaultCertificate.Matches(domain)
+		default:
+			return false
+		}
+	}
+	return tlsDomains(filterRoutes(routes, func(route Route) bool { return !route.Internal }), dnsAvailable, needed)
+}
@@ -0,0 +1,296 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAcmeDomains(t *testing.T) {
+	tlsRoute := func(domain string, internal bool, aliases ...string) Route {
+		route := Route{Domain: domain, Tls: true, Internal: internal}
+		for _, alias := range aliases {
+			route.Aliases = append(route.Aliases, RouteAlias{Domain: alias})
+		}
+		return route
+	}
+	servedWith := func(route Route, certificate string) Route {
+		route.Certificate = certificate
+		return route
+	}
+	defaults := BindingConfiguration{
+		SslCertificate:     "/etc/ssl/default.crt",
+		DefaultCertificate: &CertificatePair{Certificate: "/etc/ssl/default.crt", Names: []string{"*.default.example.com"}},
+	}
+
+	tests := []struct {
+		name         string
+		routes       []Route
+		config       BindingConfiguration
+		dnsAvailable bool
+		want         []string
+	}{
+		{
+			name:   "domains and aliases are sorted and unique",
+			routes: []Route{tlsRoute("b.example.com", false, "www.b.example.com"), tlsRoute("a.example.com", false), tlsRoute("a.example.com", false)},
+			want:   []string{"a.example.com", "b.example.com", "www.b.example.com"},
+		},
+		{
+			name:   "plain routes and internal routes are left out",
+			routes: []Route{{Domain: "plain.example.com"}, tlsRoute("internal.example.com", true), tlsRoute("a.example.com", false)},
+			want:   []string{"a.example.com"},
+		},
+		{
+			name:   "invalid domains are left out",
+			routes: []Route{tlsRoute("../../../etc/x", false, "a.example.com"), tlsRoute("b.example.com", false, "x;y")},
+			want:   []string{"a.example.com", "b.example.com"},
+		},
+		{
+			name:   "wildcards need dns",
+			routes: []Route{tlsRoute("*.example.com", false), tlsRoute("a.example.com", false)},
+			want:   []string{"a.example.com"},
+		},
+		{
+			name:         "wildcards with dns",
+			routes:       []Route{tlsRoute("*.example.com", false)},
+			dnsAvailable: true,
+			want:         []string{"*.example.com"},
+		},
+		{
+			name:   "label and certificate directory certificates are left out",
+			routes: []Route{servedWith(tlsRoute("label.example.com", false), "/etc/ssl/label.crt"), tlsRoute("a.example.com", false)},
+			want:   []string{"a.example.com"},
+		},
+		{
+			name: "aliases are checked against their own certificate",
+			routes: []Route{func() Route {
+				route := servedWith(tlsRoute("a.example.com", false), "/var/lib/nqkd/acme/a.example.com.crt")
+				route.Aliases = []RouteAlias{{Domain: "www.a.example.com", Certificate: "/etc/ssl/www.crt"}}
+				return route
+			}()},
+			want: []string{"a.example.com"},
+		},
+		{
+			name:   "certificates from the store are renewed",
+			routes: []Route{servedWith(tlsRoute("a.example.com", false), "/var/lib/nqkd/acme/a.example.com.crt")},
+			want:   []string{"a.example.com"},
+		},
+		{
+			name:   "default certificate covering the domain",
+			routes: []Route{servedWith(tlsRoute("a.default.example.com", false), "/etc/ssl/default.crt"), servedWith(tlsRoute("other.example.com", false), "/etc/ssl/default.crt")},
+			config: defaults,
+			want:   []string{"other.example.com"},
+		},
+		{
+			name:   "unreadable default certificate",
+			routes: []Route{servedWith(tlsRoute("a.default.example.com", false), "/etc/ssl/default.crt")},
+			config: BindingConfiguration{SslCertificate: "/etc/ssl/default.crt"},
+			want:   []string{"a.default.example.com"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := AcmeDomains(test.routes, test.config, "/var/lib/nqkd/acme/", test.dnsAvailable); !slices.Equal(got, test.want) {
+				t.Errorf("AcmeDomains() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCertificatePath(t *testing.T) {
+	dir := t.TempDir()
+	authority, err := LoadLocalCertificateAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := &AcmeManager{config: AcmeConfiguration{StoreDir: dir}}
+
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{domain: "example.com", want: "example.com"},
+		{domain: "Example.COM", want: "example.com"},
+		{domain: "*.example.com", want: "_wildcard.example.com"},
+		{domain: "../../../etc/x", want: ""},
+		{domain: "example.com/../../x", want: ""},
+		{domain: "", want: ""},
+	}
+
+	for _, test := range tests {
+		wantAcme, wantLocal := "", ""
+		if test.want != "" {
+			wantAcme = filepath.Join(dir, test.want+".crt")
+			wantLocal = filepath.Join(dir, localCaIssuedDir, test.want+".crt")
+		}
+		if got, _ := manager.CertificatePath(test.domain); got != wantAcme {
+			t.Errorf("AcmeManager.CertificatePath(%q) = %q, want %q", test.domain, got, wantAcme)
+		}
+		if got, _ := authority.CertificatePath(test.domain); got != wantLocal {
+			t.Errorf("LocalCertificateAuthority.CertificatePath(%q) = %q, want %q", test.domain, got, wantLocal)
+		}
+	}
+
+	changed, err := authority.EnsureCertificates([]string{"../../../etc/x", "example.com"})
+	if err == nil || !changed {
+		t.Errorf("EnsureCertificates() = %v, %v, want the valid domain issued and the invalid one returned", changed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "..", "..", "..", "etc", "x.crt")); err == nil {
+		t.Errorf("EnsureCertificates() wrote outside the store")
+	}
+	if _, err := ReadCertificatePair(authority.CertificatePath("example.com")); err != nil {
+		t.Errorf("certificate for example.com can't be read: %v", err)
+	}
+}
+
+func TestWriteCertificatePair(t *testing.T) {
+	dir := t.TempDir()
+	oldCertificate, oldKey := writeTestCertificate(t, dir, "example.com")
+	newCertificate, _ := writeTestCertificate(t, t.TempDir(), "example.com")
+	chain, err := os.ReadFile(newCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeCertificatePair(oldCertificate, oldKey, chain, key)
+	if err != nil {
+		t.Fatalf("writeCertificatePair() error = %v", err)
+	}
+
+	written, err := os.ReadFile(oldCertificate)
+	if err != nil || string(written) != string(chain) {
+		t.Errorf("certificate was not replaced: %v", err)
+	}
+	if err := readPrivateKey(oldKey); err != nil {
+		t.Errorf("private key was not replaced with a key: %v", err)
+	}
+	if info, err := os.Stat(oldKey); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("private key should only be readable by the owner")
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == ".tmp" {
+			t.Errorf("left behind temporary file %v", entry.Name())
+		}
+	}
+}
+
+func TestAcmeDnsCommandContext(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "dns.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nsleep 30\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := AcmeDnsCommand{Command: script}.Present(ctx, "_acme-challenge.example.com", "value")
+	if err == nil {
+		t.Fatalf("Present() should fail once the context is done")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Present() took %v, the command should be killed with the context", elapsed)
+	}
+}
+
+// acmeDnsRecorder is an AcmeDnsProvider which records the challenges it is asked to present and clean up
+type acmeDnsRecorder struct {
+	presented []string
+	cleaned   []string
+}
+
+func (a *acmeDnsRecorder) Present(ctx context.Context, record string, value string) error {
+	a.presented = append(a.presented, record)
+	return nil
+}
+
+func (a *acmeDnsRecorder) CleanUp(ctx context.Context, record string, value string) error {
+	a.cleaned = append(a.cleaned, record)
+	return nil
+}
+
+// TestAcmePebble obtains and renews certificates from a pebble server. It only runs when NQKD_PEBBLE_DIRECTORY is set
+// to the directory url of a pebble started with PEBBLE_VA_ALWAYS_VALID=1, and NQKD_PEBBLE_CA to the pebble.minica.pem
+// it serves its api with, ie:
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json &
+//	NQKD_PEBBLE_DIRECTORY=https://localhost:14000/dir NQKD_PEBBLE_CA=test/certs/pebble.minica.pem go test ./internal
+func TestAcmePebble(t *testing.T) {
+	directory := os.Getenv("NQKD_PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("NQKD_PEBBLE_DIRECTORY is not set")
+	}
+
+	tests := []struct {
+		name    string
+		domains []string
+		dns     bool
+	}{
+		{name: "http-01", domains: []string{"a.example.com", "b.example.com"}},
+		{name: "dns-01 with a wildcard", domains: []string{"*.example.com"}, dns: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := AcmeConfiguration{
+				DirectoryUrl:     directory,
+				Email:            "nqkd@example.com",
+				StoreDir:         t.TempDir(),
+				Webroot:          t.TempDir(),
+				RootCertificates: os.Getenv("NQKD_PEBBLE_CA"),
+				RenewBefore:      time.Hour,
+			}
+			recorder := &acmeDnsRecorder{}
+			if test.dns {
+				config.DnsProvider = recorder
+			}
+
+			manager, err := NewAcmeManager(context.Background(), config)
+			if err != nil {
+				t.Fatalf("NewAcmeManager() error = %v", err)
+			}
+
+			changed, err := manager.EnsureCertificates(context.Background(), test.domains)
+			if err != nil || !changed {
+				t.Fatalf("EnsureCertificates() = %v, %v, want a certificate for every domain", changed, err)
+			}
+			for _, domain := range test.domains {
+				pair, err := ReadCertificatePair(manager.CertificatePath(domain))
+				if err != nil {
+					t.Fatalf("certificate for %v can't be read: %v", domain, err)
+				}
+				if !slices.Contains(pair.Names, domain) {
+					t.Errorf("certificate for %v names %v", domain, pair.Names)
+				}
+			}
+			if test.dns && (len(recorder.presented) == 0 || len(recorder.cleaned) != len(recorder.presented)) {
+				t.Errorf("dns challenges presented %v and cleaned up %v", recorder.presented, recorder.cleaned)
+			}
+
+			// certificates which aren't close to expiring are left alone
+			changed, err = manager.EnsureCertificates(context.Background(), test.domains)
+			if err != nil || changed {
+				t.Errorf("second EnsureCertificates() = %v, %v, want nothing renewed", changed, err)
+			}
+
+			// and renewed once they are
+			manager.config.RenewBefore = 10 * 365 * 24 * time.Hour
+			changed, err = manager.EnsureCertificates(context.Background(), test.domains)
+			if err != nil || !changed {
+				t.Errorf("renewing EnsureCertificates() = %v, %v, want every certificate renewed", changed, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// CaddyFormatCaddyfile renders the bindings as a Caddyfile
+	CaddyFormatCaddyfile = "caddyfile"
+	// CaddyFormatJson renders the bindings as native Caddy JSON config
+	CaddyFormatJson = "json"
+)
+
+// caddySite is a single site block in caddy, made up of every http route sharing the same address
+type caddySite struct {
+	Domain        string
+	ListenAddress string
+	ListenPort    uint16
+	DualStack     bool
+	Tls           bool
+	Certificate   string
+	PrivateKey    string
+	Upstreams     []RouteUpstream
+}
+
+// Address returns the site address as it should be written in a Caddyfile. Sites without tls are prefixed with http://
+// so caddy does not try to enable automatic https for them
+func (c caddySite) Address() string {
+	address := c.Domain + ":" + strconv.Itoa(int(c.ListenPort))
+	if !c.Tls {
+		return "http://" + address
+	}
+	return address
+}
+
+// BindHost returns the listen address as it should be written in a Caddyfile bind, with IPv6 addresses in brackets
+func (c caddySite) BindHost() string {
+	if strings.Contains(c.ListenAddress, ":") {
+		return "[" + c.ListenAddress + "]"
+	}
+	return c.ListenAddress
+}
+
+// groupCaddySites merges every http route into the site blocks they will be served from. Caddy cannot proxy plain TCP
+// or UDP traffic without plugins, so those routes are logged and skipped. Sites are sorted by address
+func groupCaddySites(routes []Route) []*caddySite {
+	sites := make(map[string]*caddySite)
+	for _, route := range routes {
+		if !route.IsHttp() {
+			slog.Warn("Skipping route because caddy does not support plain tcp or udp proxying", "project", route.Project, "container", route.Container, "port", route.ContainerPort, "protocol", route.Protocol)
+			continue
+		}
+		if route.Asleep {
+			slog.Warn("Skipping route because waking asleep projects is only supported by the nginx binding", "project", route.Project, "container", route.Container, "port", route.ContainerPort)
+			continue
+		}
+		if route.HasAccessControl() {
+			slog.Warn("Skipping route because access control labels are only supported by the nginx binding", "project", route.Project, "container", route.Container, "port", route.ContainerPort)
+			continue
+		}
+		if route.Path != "/" {
+			slog.Warn("Skipping route because path based routing is only supported by the nginx and traefik bindings", "project", route.Project, "container", route.Container, "port", route.ContainerPort, "path", route.Path)
+			continue
+		}
+		if unsupported := caddyUnsupportedFeatures(route); len(unsupported) > 0 {
+			slog.Warn("Serving route without the features caddy does not support", "project", route.Project, "container", route.Container, "port", route.ContainerPort, "features", unsupported)
+		}
+
+		key := route.ListenAddress + "/" + route.Domain + ":" + strconv.Itoa(int(route.ListenPort))
+		if _, ok := sites[key]; !ok {
+			sites[key] = &caddySite{
+				Domain:        route.Domain,
+				ListenAddress: route.ListenAddress,
+				ListenPort:    route.ListenPort,
+				DualStack:     route.DualStack,
+				Tls:           route.Tls,
+				Certificate:   route.Certificate,
+				PrivateKey:    route.PrivateKey,
+				Upstreams:     make([]RouteUpstream, 0),
+			}
+		}
+		sites[key].Upstreams = append(sites[key].Upstreams, route.Upstream)
+	}
+
+	result := make([]*caddySite, 0, len(sites))
+	for _, site := range sites {
+		result = append(result, site)
+	}
+	slices.SortFunc(result, func(a, b *caddySite) int {
+		if v := strings.Compare(a.Address(), b.Address()); v != 0 {
+			return v
+		}
+		return strings.Compare(a.ListenAddress, b.ListenAddress)
+	})
+
+	return result
+}
+
+// caddyUnsupportedFeatures returns the features set on the route which the caddy binding drops. Caddy serves HTTP/2
+// and HTTP/3 on every tls site by default, so those are only unsupported on plain http routes
+func caddyUnsupportedFeatures(route Route) []string {
+	return slices.DeleteFunc(route.Features(), func(feature string) bool {
+		return route.Tls && (feature == "http2" || feature == "quic")
+	})
+}
+
+// GenerateCaddyfile renders every http route into a single Caddyfile. Routes sharing a domain and listen address are
+// load balanced between within one site block. Sites with tls use the route certificate if one is set, otherwise they
+// are left to caddy's automatic https
+func GenerateCaddyfile(routes []Route) string {
+	var builder strings.Builder
+	for _, site := range groupCaddySites(routes) {
+		builder.WriteString(site.Address() + " {\n")
+		// caddy binds every IPv4 and IPv6 address when no bind is given
+		if !site.DualStack {
+			builder.WriteString("\tbind " + site.BindHost() + "\n")
+		}
+		if site.Tls && site.Certificate != "" {
+			builder.WriteString("\ttls " + site.Certificate + " " + site.PrivateKey + "\n")
+		}
+
+		upstreams := make([]string, 0, len(site.Upstreams))
+		for _, upstream := range site.Upstreams {
+			upstreams = append(upstreams, upstream.UrlScheme()+"://"+upstream.Address())
+		}
+		builder.WriteString("\treverse_proxy " + strings.Join(upstreams, " ") + "\n")
+		builder.WriteString("}\n")
+	}
+
+	return builder.String()
+}
+
+// GenerateCaddyJson renders every http route into native caddy JSON config. This produces one caddy server per listen
+// address with a host matched route per site, and loads any certificates set on the routes
+func GenerateCaddyJson(routes []Route) (string, error) {
+	servers := make(map[string]interface{})
+	certificates := make([]map[string]string, 0)
+	seenCertificates := make(map[string]bool)
+
+	for _, site := range groupCaddySites(routes) {
+		listen := net.JoinHostPort(site.ListenAddress, strconv.Itoa(int(site.ListenPort)))
+		name := "nqkd_" + CleanName(listen)
+		if _, ok := servers[name]; !ok {
+			address := listen
+			if site.DualStack {
+				// an empty host binds every IPv4 and IPv6 address
+				address = ":" + strconv.Itoa(int(site.ListenPort))
+			}
+			server := map[string]interface{}{
+				"listen": []string{address},
+				"routes": make([]interface{}, 0),
+			}
+			if !site.Tls {
+				server["automatic_https"] = map[string]interface{}{"disable": true}
+			}
+			servers[name] = server
+		}
+
+		upstreams := make([]map[string]string, 0, len(site.Upstreams))
+		var transport map[string]interface{}
+		for _, upstream := range site.Upstreams {
+			upstreams = append(upstreams, map[string]string{"dial": upstream.Address()})
+			if upstream.IsTls() {
+				transport = map[string]interface{}{"protocol": "http", "tls": map[string]interface{}{}}
+			}
+			if upstream.IsHttp2() {
+				if transport == nil {
+					transport = map[string]interface{}{"protocol": "http", "versions": []string{"h2c", "2"}}
+				} else {
+					transport["versions"] = []string{"2"}
+				}
+			}
+		}
+		handler := map[string]interface{}{
+			"handler":   "reverse_proxy",
+			"upstreams": upstreams,
+		}
+		if transport != nil {
+			handler["transport"] = transport
+		}
+
+		server := servers[name].(map[string]interface{})
+		server["routes"] = append(server["routes"].([]interface{}), map[string]interface{}{
+			"match":    []interface{}{map[string]interface{}{"host": []string{site.Domain}}},
+			"handle":   []interface{}{handler},
+			"terminal": true,
+		})
+
+		if site.Tls && site.Certificate != "" && !seenCertificates[site.Certificate] {
+			seenCertificates[site.Certificate] = true
+			certificates = append(certificates, map[string]string{"certificate": site.Certificate, "key": site.PrivateKey})
+		}
+	}
+
+	apps := map[string]interface{}{
+		"http": map[string]interface{}{"servers": servers},
+	}
+	if len(certificates) > 0 {
+		apps["tls"] = map[string]interface{}{
+			"certificates": map[string]interface{}{"load_files": certificates},
+		}
+	}
+
+	marshal, err := json.MarshalIndent(map[string]interface{}{"apps": apps}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(marshal) + "\n", nil
+}
+
+// WriteCaddyConfiguration renders the routes in the given format and writes them to dir. If the content changed, or
+// reload is set because certificates were replaced in place, the configuration is loaded into caddy through admin
+// first and only written once caddy accepts it, so a rejected config is retried on the next run. Admin may be nil to
+// skip reloading. Returns whether the configuration changed on disk or was reloaded
+func WriteCaddyConfiguration(routes []Route, dir string, format string, admin CaddyAdmin, reload bool) (bool, error) {
+	var config string
+	var filename string
+	if format == CaddyFormatJson {
+		filename = "nqkd.caddy.json"
+		generated, err := GenerateCaddyJson(routes)
+		if err != nil {
+			slog.Error("Failed to generate caddy json configuration due to error", "error", err)
+			return false, err
+		}
+		config = generated
+	} else {
+		filename = "nqkd.Caddyfile"
+		config = GenerateCaddyfile(routes)
+	}
+
+	existing, err := os.ReadFile(filepath.Join(dir, filename))
+	unchanged := err == nil && string(existing) == config
+	if unchanged && (!reload || admin == nil) {
+		slog.Debug("Skipping caddy configuration because contents are the same", "dir", dir)
+		return false, nil
+	}
+
+	if admin != nil {
+		err = admin.Load([]byte(config), format)
+		if err != nil {
+			slog.Error("Failed to reload caddy with the new configuration, it will be retried on the next run", "error", err)
+			return false, err
+		}
+	}
+
+	needsUpdate, err := WriteFileSetWithDiff(map[string]string{filename: config}, dir)
+	if err != nil {
+		slog.Error("Failed to write caddy configuration due to an error", "error", err)
+		return needsUpdate, err
+	}
+
+	return needsUpdate || unchanged, nil
+}
+
+// CaddyAdmin is something which can load a new configuration into a running caddy instance. Loading replaces the
+// whole running configuration, so nqkd owns every site caddy serves once it is given an admin
+type CaddyAdmin interface {
+	// Load replaces the active caddy configuration with config, which is in the given format (one of the CaddyFormat*
+	// constants). Caddy is reloaded even if config is the same as the running one, so certificates are read again
+	Load(config []byte, format string) error
+}
+
+// CaddyAdminApi loads configuration through the caddy admin API at the given URL (usually http://localhost:2019)
+type CaddyAdminApi struct {
+	Url string
+}
+
+// Load will POST the config to the /load endpoint of the admin API, which caddy applies gracefully. This replaces
+// caddy's whole configuration, including anything not generated by nqkd. Caddy validates the configuration before
+// applying it so a rejected config leaves the running config untouched
+func (c CaddyAdminApi) Load(config []byte, format string) error {
+	contentType := "application/json"
+	if format == CaddyFormatCaddyfile {
+		contentType = "text/caddyfile"
+	}
+
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.Url, "/")+"/load", bytes.NewReader(config))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	// caddy skips loading a config identical to the running one unless told to revalidate it
+	request.Header.Set("Cache-Control", "must-revalidate")
+
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		slog.Error("Failed to reach the caddy admin api", "url", c.Url, "error", err)
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var body bytes.Buffer
+		_, _ = body.ReadFrom(response.Body)
+		slog.Error("Caddy rejected the configuration", "status", response.Status, "response", body.String())
+		return fmt.Errorf("caddy rejected the configuration with status %v", response.Status)
+	}
+
+	return nil
+}
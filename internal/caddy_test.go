@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGenerateCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		routes  []Route
+		want    []string
+		notWant []string
+	}{
+		{
+			name:   "plain http site",
+			routes: []Route{testRoute("project", "example.com", 8080)},
+			want:   []string{"http://example.com:80 {\n", "\tbind 0.0.0.0\n", "\treverse_proxy http://127.0.0.1:8080\n"},
+		},
+		{
+			name: "replicas are load balanced in one site",
+			routes: []Route{
+				testRoute("project", "example.com", 8081, onPort(443), withTls("")),
+				testRoute("project", "example.com", 8080, onPort(443), withTls("")),
+			},
+			want:    []string{"example.com:443 {\n", "\treverse_proxy http://127.0.0.1:8081 http://127.0.0.1:8080\n"},
+			notWant: []string{"http://example.com", "\ttls "},
+		},
+		{
+			name:   "certificate from labels",
+			routes: []Route{testRoute("project", "example.com", 8080, onPort(443), withTls("/etc/ssl/example.pem"))},
+			want:   []string{"\ttls /etc/ssl/example.pem /etc/ssl/example.pem.key\n"},
+		},
+		{
+			name: "dual stack sites bind everything",
+			routes: func() []Route {
+				route := testRoute("project", "example.com", 8080)
+				route.DualStack = true
+				return []Route{route}
+			}(),
+			want:    []string{"http://example.com:80 {\n"},
+			notWant: []string{"bind"},
+		},
+		{
+			name: "tcp, asleep and path routes are skipped",
+			routes: func() []Route {
+				asleep := testRoute("project", "asleep.example.com", 8080)
+				asleep.Asleep = true
+				return []Route{
+					testRoute("project", "example.com", 5432, withProtocol(ValueTypeTcp), onPort(5432)),
+					asleep,
+					testRoute("project", "path.example.com", 8080, withPath("/api")),
+				}
+			}(),
+			notWant: []string{"{"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expectContent(t, "GenerateCaddyfile()", GenerateCaddyfile(test.routes), test.want, test.notWant)
+		})
+	}
+}
+
+func TestCaddyUnsupportedFeatures(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(route *Route)
+		want   []string
+	}{
+		{name: "plain route", modify: func(route *Route) {}, want: []string{}},
+		{
+			name: "dropped features are listed",
+			modify: func(route *Route) {
+				route.Maintenance = true
+				route.Aliases = []RouteAlias{{Domain: "www.example.com"}}
+				route.Headers = []RouteHeader{{Name: "X-Frame-Options", Value: "DENY"}}
+			},
+			want: []string{"maintenance", "aliases", "headers"},
+		},
+		{
+			name:   "http2 and quic are served by default on tls sites",
+			modify: func(route *Route) { route.Tls, route.Http2, route.Quic, route.Hsts = true, true, true, 300 },
+			want:   []string{"hsts"},
+		},
+		{
+			name:   "http2 on plain sites is dropped",
+			modify: func(route *Route) { route.Http2 = true },
+			want:   []string{"http2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route := testRoute("project", "example.com", 8080)
+			test.modify(&route)
+			if got := caddyUnsupportedFeatures(route); !slices.Equal(got, test.want) {
+				t.Errorf("caddyUnsupportedFeatures() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGenerateCaddyJson(t *testing.T) {
+	route := testRoute("project", "example.com", 8080, onPort(443), withTls("/etc/ssl/example.pem"))
+
+	generated, err := GenerateCaddyJson([]Route{route, testRoute("project", "example.org", 8081)})
+	if err != nil {
+		t.Fatalf("GenerateCaddyJson() error = %v", err)
+	}
+
+	var config struct {
+		Apps struct {
+			Http struct {
+				Servers map[string]struct {
+					Listen         []string        `json:"listen"`
+					Routes         []interface{}   `json:"routes"`
+					AutomaticHttps json.RawMessage `json:"automatic_https"`
+				} `json:"servers"`
+			} `json:"http"`
+			Tls struct {
+				Certificates struct {
+					LoadFiles []map[string]string `json:"load_files"`
+				} `json:"certificates"`
+			} `json:"tls"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal([]byte(generated), &config); err != nil {
+		t.Fatalf("GenerateCaddyJson() produced invalid json: %v", err)
+	}
+
+	servers := config.Apps.Http.Servers
+	if len(servers) != 2 {
+		t.Fatalf("GenerateCaddyJson() has %v servers, want 2", len(servers))
+	}
+	if server := servers["nqkd_0_0_0_0_443"]; len(server.Listen) != 1 || server.Listen[0] != "0.0.0.0:443" || server.AutomaticHttps != nil {
+		t.Errorf("tls server = %+v, want listen on 0.0.0.0:443 with automatic https", server)
+	}
+	if server := servers["nqkd_0_0_0_0_80"]; len(server.Routes) != 1 || server.AutomaticHttps == nil {
+		t.Errorf("http server = %+v, want one route with automatic https disabled", server)
+	}
+	if files := config.Apps.Tls.Certificates.LoadFiles; len(files) != 1 || files[0]["certificate"] != route.Certificate {
+		t.Errorf("loaded certificates = %v, want only %v", files, route.Certificate)
+	}
+}
+
+func TestWriteCaddyConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	routes := []Route{testRoute("project", "example.com", 8080)}
+	stub := &CaddyAdminStub{}
+
+	changed, err := WriteCaddyConfiguration(routes, dir, CaddyFormatCaddyfile, stub, false)
+	if err != nil || !changed {
+		t.Fatalf("first write = %v, %v, want changed without error", changed, err)
+	}
+	if len(stub.Loads) != 1 || stub.Formats[0] != CaddyFormatCaddyfile || string(stub.Loads[0]) != GenerateCaddyfile(routes) {
+		t.Errorf("first write loaded %v configurations, want the generated caddyfile once", len(stub.Loads))
+	}
+
+	changed, err = WriteCaddyConfiguration(routes, dir, CaddyFormatCaddyfile, stub, false)
+	if err != nil || changed {
+		t.Fatalf("second write = %v, %v, want unchanged without error", changed, err)
+	}
+	if len(stub.Loads) != 1 {
+		t.Errorf("unchanged configuration was loaded again, %v loads", len(stub.Loads))
+	}
+
+	// certificates replaced in place reload caddy without changing the file
+	changed, err = WriteCaddyConfiguration(routes, dir, CaddyFormatCaddyfile, stub, true)
+	if err != nil || !changed || len(stub.Loads) != 2 {
+		t.Fatalf("reloading write = %v, %v with %v loads, want changed and loaded again", changed, err, len(stub.Loads))
+	}
+
+	changed, err = WriteCaddyConfiguration(routes, dir, CaddyFormatJson, nil, false)
+	if err != nil || !changed {
+		t.Fatalf("write without admin = %v, %v, want changed without error", changed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nqkd.caddy.json")); err != nil {
+		t.Errorf("json configuration was not written: %v", err)
+	}
+}
+
+func TestWriteCaddyConfigurationRejected(t *testing.T) {
+	dir := t.TempDir()
+	previous := GenerateCaddyfile([]Route{testRoute("project", "example.com", 8080)})
+	if err := os.WriteFile(filepath.Join(dir, "nqkd.Caddyfile"), []byte(previous), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	routes := []Route{testRoute("project", "example.com", 9090)}
+	stub := &CaddyAdminStub{Err: errors.New("rejected")}
+
+	changed, err := WriteCaddyConfiguration(routes, dir, CaddyFormatCaddyfile, stub, false)
+	if err == nil || changed {
+		t.Fatalf("rejected write = %v, %v, want unchanged with an error", changed, err)
+	}
+	if len(stub.Loads) != 0 {
+		t.Errorf("stub recorded %v loads while failing, want 0", len(stub.Loads))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "nqkd.Caddyfile"))
+	if err != nil || string(data) != previous {
+		t.Errorf("rejected configuration replaced the previous file: %q", data)
+	}
+
+	// once caddy accepts it again the same configuration must still be loaded and written
+	stub.Err = nil
+	changed, err = WriteCaddyConfiguration(routes, dir, CaddyFormatCaddyfile, stub, false)
+	if err != nil || !changed || len(stub.Loads) != 1 {
+		t.Fatalf("retried write = %v, %v with %v loads, want changed and loaded once", changed, err, len(stub.Loads))
+	}
+	data, _ = os.ReadFile(filepath.Join(dir, "nqkd.Caddyfile"))
+	if !strings.Contains(string(data), "127.0.0.1:9090") {
+		t.Errorf("retried write did not update the file: %q", data)
+	}
+}
+
+// CaddyAdminStub is a CaddyAdmin which records every configuration it is asked to load instead of contacting caddy.
+// If Err is set, it is returned from every call to Load and nothing is recorded
+type CaddyAdminStub struct {
+	Loads   [][]byte
+	Formats []string
+	Err     error
+}
+
+// Load records the config and format, or returns Err if set
+func (c *CaddyAdminStub) Load(config []byte, format string) error {
+	if c.Err != nil {
+		return c.Err
+	}
+
+	c.Loads = append(c.Loads, config)
+	c.Formats = append(c.Formats, format)
+	return nil
+}
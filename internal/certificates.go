@@ -0,0 +1,309 @@
+package internal
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// domainRegex matches an RFC 1123 hostname made of one or more labels, optionally behind a wildcard
+var domainRegex = regexp.MustCompile(`^(\*\.)?([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// ValidDomain returns whether the domain is an RFC 1123 hostname, optionally with a leading *. wildcard. Domains come
+// from labels and end up in file names and proxy configuration, so anything else is rejected
+func ValidDomain(domain string) bool {
+	return len(domain) <= 253 && domainRegex.MatchString(domain)
+}
+
+// CertificatePair is a certificate on disk along with its private key and the names it is valid for
+type CertificatePair struct {
+	// Certificate is the path to the PEM encoded certificate (or full chain)
+	Certificate string `json:"certificate"`
+	// PrivateKey is the path to the PEM encoded private key for Certificate
+	PrivateKey string `json:"private_key"`
+	// Names are the DNS names the certificate is valid for, these may include wildcards
+	Names []string `json:"names"`
+	// NotAfter is when the certificate expires
+	NotAfter time.Time `json:"not_after"`
+}
+
+// Matches returns whether the certificate is valid for the given domain
+func (c CertificatePair) Matches(domain string) bool {
+	for _, name := range c.Names {
+		if MatchesCertificateName(name, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesCertificateName returns whether a DNS name from a certificate covers the domain. Names are compared case
+// insensitively, and a wildcard name (ie *.example.com) matches exactly one label in its place, so it covers
+// a.example.com but neither example.com nor a.b.example.com
+func MatchesCertificateName(name string, domain string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if !strings.HasPrefix(name, "*.") {
+		return name == domain
+	}
+
+	first, rest, found := strings.Cut(domain, ".")
+	return found && first != "" && rest == name[2:]
+}
+
+// ReadCertificatePair parses the first certificate in the PEM file and pairs it with the given private key path. The
+// private key is not read, only checked for existence
+func ReadCertificatePair(certificate string, privateKey string) (*CertificatePair, error) {
+	data, err := os.ReadFile(certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	var block *pem.Block
+	for rest := data; ; {
+		block, rest = pem.Decode(rest)
+		if block == nil || block.Type == "CERTIFICATE" {
+			break
+		}
+	}
+	if block == nil {
+		return nil, errors.New("no PEM encoded certificate found in " + certificate)
+	}
+
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.IsCA {
+		return nil, errors.New("certificate is a CA certificate " + certificate)
+	}
+
+	if _, err := os.Stat(privateKey); err != nil {
+		return nil, err
+	}
+
+	names := parsed.DNSNames
+	if len(names) == 0 && parsed.Subject.CommonName != "" {
+		names = []string{parsed.Subject.CommonName}
+	}
+
+	return &CertificatePair{
+		Certificate: certificate,
+		PrivateKey:  privateKey,
+		Names:       names,
+		NotAfter:    parsed.NotAfter,
+	}, nil
+}
+
+// SafeCertificatePath returns whether the path can be written into proxy configuration as it is. Only clean absolute
+// paths without whitespace, quotes or the characters nginx and caddy treat as syntax are allowed, so a label can't add
+// directives of its own
+func SafeCertificatePath(path string) bool {
+	return filepath.IsAbs(path) && filepath.Clean(path) == path && !strings.ContainsFunc(path, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune(";{}#'\"`$\\", r)
+	})
+}
+
+// readPrivateKey checks the file holds a PEM encoded private key
+func readPrivateKey(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return errors.New("no PEM encoded private key found in " + path)
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return nil
+		}
+	}
+}
+
+// labelCertificate returns the certificate and private key given by the ssl.cert and ssl.key labels, or false if the
+// labels aren't set or don't name a certificate and key which exist, parse and are safe to write into configuration
+func labelCertificate(labels map[string]string, port uint16) (string, string, bool) {
+	certificate := GetLabelForPort(labels, LabelGlobalSslCert, LabelPortSslCert, port)
+	if certificate == nil {
+		return "", "", false
+	}
+	key := StringOrElse(
+		GetLabelForPort(labels, LabelGlobalSslKey, LabelPortSslKey, port),
+		strings.TrimSuffix(*certificate, filepath.Ext(*certificate))+".key",
+	)
+
+	if !SafeCertificatePath(*certificate) || !SafeCertificatePath(key) {
+		slog.Error("Ignoring ssl labels because the certificate and key must be clean absolute paths without whitespace or ;{}", "certificate", *certificate, "key", key, "port", port)
+		return "", "", false
+	}
+	if _, err := ReadCertificatePair(*certificate, key); err != nil {
+		slog.Error("Ignoring ssl labels because the certificate can't be read", "certificate", *certificate, "port", port, "error", err)
+		return "", "", false
+	}
+	if err := readPrivateKey(key); err != nil {
+		slog.Error("Ignoring ssl labels because the private key can't be read", "key", key, "port", port, "error", err)
+		return "", "", false
+	}
+
+	return *certificate, key, true
+}
+
+// CertificateStore is a set of certificates which can be searched by domain
+type CertificateStore struct {
+	Pairs []CertificatePair
+}
+
+// privateKeyFor returns where the private key for a certificate is expected to be. This is the certificate path with
+// a .key extension if that exists, otherwise privkey.pem in the same directory which is the layout used by certbot
+func privateKeyFor(certificate string) string {
+	key := strings.TrimSuffix(certificate, filepath.Ext(certificate)) + ".key"
+	if _, err := os.Stat(key); err == nil {
+		return key
+	}
+
+	return filepath.Join(filepath.Dir(certificate), "privkey.pem")
+}
+
+// LoadCertificateDirectory walks the directory for certificates (files ending .crt, .cer or .pem) which have a private
+// key alongside them, see privateKeyFor. Files which are not certificates, CA certificates and certificates without a
+// key are skipped, so certbot's live directory can be used directly
+func LoadCertificateDirectory(dir string) (*CertificateStore, error) {
+	store := &CertificateStore{Pairs: make([]CertificatePair, 0)}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		name := d.Name()
+		extension := filepath.Ext(name)
+		if (extension != ".crt" && extension != ".cer" && extension != ".pem") || name == "privkey.pem" || name == "chain.pem" {
+			return nil
+		}
+
+		if !SafeCertificatePath(path) || !SafeCertificatePath(privateKeyFor(path)) {
+			slog.Warn("Skipping certificate because its path can't be written into proxy configuration", "file", path)
+			return nil
+		}
+
+		pair, err := ReadCertificatePair(path, privateKeyFor(path))
+		if err != nil {
+			slog.Debug("Skipping file in certificate directory", "file", path, "error", err)
+			return nil
+		}
+
+		store.Pairs = append(store.Pairs, *pair)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("Loaded certificate directory", "dir", dir, "certificates", len(store.Pairs))
+	return store, nil
+}
+
+// Add adds a certificate to the store, replacing any existing entry for the same certificate path
+func (c *CertificateStore) Add(pair CertificatePair) {
+	for i, existing := range c.Pairs {
+		if existing.Certificate == pair.Certificate {
+			c.Pairs[i] = pair
+			return
+		}
+	}
+	c.Pairs = append(c.Pairs, pair)
+}
+
+// Lookup returns the best certificate for the domain, or nil if none match. Expired certificates are never returned,
+// certificates naming the domain exactly are preferred over wildcards, and then the one which expires last is chosen
+func (c *CertificateStore) Lookup(domain string) *CertificatePair {
+	if c == nil {
+		return nil
+	}
+
+	var best *CertificatePair
+	bestExact := false
+	now := time.Now()
+	for i := range c.Pairs {
+		pair := &c.Pairs[i]
+		if !pair.Matches(domain) || pair.NotAfter.Before(now) {
+			continue
+		}
+
+		exact := false
+		for _, name := range pair.Names {
+			if strings.EqualFold(strings.TrimSuffix(name, "."), strings.TrimSuffix(domain, ".")) {
+				exact = true
+			}
+		}
+
+		if best == nil || (exact && !bestExact) || (exact == bestExact && pair.NotAfter.After(best.NotAfter)) {
+			best = pair
+			bestExact = exact
+		}
+	}
+
+	return best
+}
+
+// SelectCertificate chooses the certificate and private key for a tls route on the given domain and container port.
+// In order of preference this is the certificate given by the ssl.cert and ssl.key labels (if they are valid, see
+// labelCertificate), a certificate from the store in the configuration matching the domain, and finally the default
+// certificate from the configuration. A warning is logged if the default certificate is used but is known not to cover
+// the domain
+func SelectCertificate(domain string, labels map[string]string, port uint16, config BindingConfiguration) (string, string) {
+	if certificate, key, ok := labelCertificate(labels, port); ok {
+		return certificate, key
+	}
+
+	if pair := config.Certificates.Lookup(domain); pair != nil {
+		return pair.Certificate, pair.PrivateKey
+	}
+
+	if config.DefaultCertificate != nil && !config.DefaultCertificate.Matches(domain) {
+		slog.Warn("No certificate matches the domain and the default certificate does not cover it", "domain", domain, "default", config.SslCertificate, "names", config.DefaultCertificate.Names)
+	} else if config.Certificates != nil && config.DefaultCertificate == nil {
+		slog.Warn("No certificate in the certificate directory matches the domain, falling back to the default certificate", "domain", domain, "default", config.SslCertificate)
+	}
+
+	return config.SslCertificate, config.SslPrivateKey
+}
+
+// resolveTls sets whether a tls route uses the local certificate authority, and the certificate it is served with
+func resolveTls(route *Route, labels portLabels, config BindingConfiguration) {
+	if !route.Tls {
+		return
+	}
+
+	useLocalCa := labels.enabled(LabelGlobalSslInternal, LabelPortSslInternal, false)
+	if useLocalCa && config.LocalCa == nil {
+		slog.Warn("Port is marked internal but there is no local certificate authority, selecting a certificate as normal", "port", labels.port, "container", labels.container)
+	}
+	route.Internal = useLocalCa && config.LocalCa != nil
+	route.Certificate, route.PrivateKey = routeCertificate(*route, route.Domain, labels, config)
+}
+
+// routeCertificate returns the certificate and private key the route serves the domain (its own or an alias) with,
+// issued by the local certificate authority for internal routes and selected with SelectCertificate otherwise
+func routeCertificate(route Route, domain string, labels portLabels, config BindingConfiguration) (string, string) {
+	if route.Internal {
+		return config.LocalCa.CertificatePath(domain)
+	}
+	return SelectCertificate(domain, labels.labels, labels.port, config)
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self signed certificate for the names and its private key into dir, returning their
+// paths
+func writeTestCertificate(t *testing.T, dir string, names ...string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate := filepath.Join(dir, "cert.pem")
+	privateKey := filepath.Join(dir, "cert.key")
+	if err := os.WriteFile(certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(privateKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certificate, privateKey
+}
+
+func TestSafeCertificatePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/etc/ssl/example.com.pem", want: true},
+		{path: "/etc/letsencrypt/live/example.com/fullchain.pem", want: true},
+		{path: "relative/cert.pem", want: false},
+		{path: "", want: false},
+		{path: "/etc/ssl/../shadow", want: false},
+		{path: "/etc/ssl/cert.pem; include /etc/shadow", want: false},
+		{path: "/etc/ssl/cert.pem\nssl_verify_client off", want: false},
+		{path: "/etc/ssl/cert {", want: false},
+		{path: "/etc/ssl/cert}.pem", want: false},
+		{path: "/etc/ssl/my cert.pem", want: false},
+		{path: "/etc/ssl/$host.pem", want: false},
+	}
+
+	for _, test := range tests {
+		if got := SafeCertificatePath(test.path); got != test.want {
+			t.Errorf("SafeCertificatePath(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestSelectCertificateLabels(t *testing.T) {
+	dir := t.TempDir()
+	certificate, key := writeTestCertificate(t, dir, "example.com")
+	config := BindingConfiguration{SslCertificate: "/etc/ssl/default.pem", SslPrivateKey: "/etc/ssl/default.key"}
+
+	tests := []struct {
+		name            string
+		labels          map[string]string
+		wantCertificate string
+		wantKey         string
+	}{
+		{
+			name:            "valid labels",
+			labels:          map[string]string{LabelGlobalSslCert: certificate, LabelGlobalSslKey: key},
+			wantCertificate: certificate,
+			wantKey:         key,
+		},
+		{
+			name:            "key defaults to the certificate with a .key extension",
+			labels:          map[string]string{LabelGlobalSslCert: certificate},
+			wantCertificate: certificate,
+			wantKey:         key,
+		},
+		{
+			name:            "injected directive",
+			labels:          map[string]string{LabelGlobalSslCert: certificate + ";\n    include /etc/shadow", LabelGlobalSslKey: key},
+			wantCertificate: config.SslCertificate,
+			wantKey:         config.SslPrivateKey,
+		},
+		{
+			name:            "injected key",
+			labels:          map[string]string{LabelGlobalSslCert: certificate, LabelGlobalSslKey: key + "; }"},
+			wantCertificate: config.SslCertificate,
+			wantKey:         config.SslPrivateKey,
+		},
+		{
+			name:            "missing certificate",
+			labels:          map[string]string{LabelGlobalSslCert: filepath.Join(dir, "missing.pem")},
+			wantCertificate: config.SslCertificate,
+			wantKey:         config.SslPrivateKey,
+		},
+		{
+			name:            "key which isn't a key",
+			labels:          map[string]string{LabelGlobalSslCert: certificate, LabelGlobalSslKey: certificate},
+			wantCertificate: config.SslCertificate,
+			wantKey:         config.SslPrivateKey,
+		},
+		{
+			name:            "no labels",
+			labels:          map[string]string{},
+			wantCertificate: config.SslCertificate,
+			wantKey:         config.SslPrivateKey,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotCertificate, gotKey := SelectCertificate("example.com", test.labels, 443, config)
+			if gotCertificate != test.wantCertificate || gotKey != test.wantKey {
+				t.Errorf("SelectCertificate() = %q, %q, want %q, %q", gotCertificate, gotKey, test.wantCertificate, test.wantKey)
+			}
+		})
+	}
+}
+
+func TestValidDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{domain: "example.com", want: true},
+		{domain: "a-b.example.com", want: true},
+		{domain: "*.example.com", want: true},
+		{domain: "localhost", want: true},
+		{domain: "EXAMPLE.com", want: true},
+		{domain: "", want: false},
+		{domain: "../../../etc/x", want: false},
+		{domain: "example.com/../x", want: false},
+		{domain: "a.*.example.com", want: false},
+		{domain: "*example.com", want: false},
+		{domain: "-example.com", want: false},
+		{domain: "example-.com", want: false},
+		{domain: "example..com", want: false},
+		{domain: "example.com.", want: false},
+		{domain: "example.com; include /etc/shadow", want: false},
+		{domain: strings.Repeat("a", 64) + ".com", want: false},
+		{domain: strings.Repeat("a.", 127) + "com", want: false},
+	}
+
+	for _, test := range tests {
+		if got := ValidDomain(test.domain); got != test.want {
+			t.Errorf("ValidDomain(%q) = %v, want %v", test.domain, got, test.want)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"log/slog"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
 )
 
@@ -110,28 +111,116 @@ func ApplyCompose(project ProcessedDockerComposeFile) error {
 	return nil
 }
 
+// StopComposeService will invoke docker compose to stop a single service within the given project and wait for the
+// result. The containers are stopped rather than removed so they can be inspected afterwards.
+func StopComposeService(project ProcessedDockerComposeFile, service string) error {
+	return stopCompose(project, service)
+}
+
+// StopComposeProject will invoke docker compose to stop every service within the given project and wait for the
+// result. The containers are stopped rather than removed so ApplyCompose can start them again.
+func StopComposeProject(project ProcessedDockerComposeFile) error {
+	return stopCompose(project)
+}
+
+// stopCompose stops the given services within the project, or every service if none are given
+func stopCompose(project ProcessedDockerComposeFile, services ...string) error {
+	// docker compose -p {name} -f {file} stop {services...}
+	file, err := os.CreateTemp("", "active.nqkd.yaml")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			slog.Error("Failed to cleanup temp file", "temp", file.Name(), "error", err)
+		}
+	}()
+
+	err = os.WriteFile(file.Name(), []byte(project.Content), 0666)
+	if err != nil {
+		return err
+	}
+
+	command := Run("docker", append([]string{"compose", "-p", project.Name, "-f", file.Name(), "stop"}, services...)...)
+	out, err := command.CombinedOutput()
+	slog.Debug(
+		"command output",
+		"cmd",
+		command.Args,
+		"output",
+		cleanNewLineTabFromString(string(out)),
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // BindingPortMapping represents a mapping from a container to the host. This contains the port on the container, the
 // port it maps to on the host, the ip address it is bound to, and the type as returned by the docker API
 type BindingPortMapping struct {
 	// ContainerPort is the port exposed on the container
 	ContainerPort uint16 `json:"container_port"`
 	// HostPort is the port that is assigned to the container port, this can either be a manually assigned port or
-	// an ephermeral one
+	// an ephermeral one. This is 0 if the port is only exposed to docker networks, or is ephemeral and the container
+	// is stopped
 	HostPort uint16 `json:"host_port"`
-	// Binding is the IP Address that the port is listening on on the host
+	// Binding is the IP Address that the port is listening on on the host, empty if the port is not published
 	Binding string `json:"binding"`
 	// Type is the type of port as returned by the docker API
 	Type string `json:"type"`
 }
 
-// BindingContainer represents the set of bindings for a single container, identified by its name
+// BindingNetwork represents a single docker network a container is attached to and the addresses it was assigned on it
+type BindingNetwork struct {
+	// Name is the name of the docker network
+	Name string `json:"name"`
+	// IPAddress is the IPv4 address of the container on this network, this may be empty
+	IPAddress string `json:"ip_address"`
+	// IPv6Address is the global IPv6 address of the container on this network, this may be empty
+	IPv6Address string `json:"ipv6_address"`
+	// Aliases are the DNS names the container can be reached by on this network
+	Aliases []string `json:"aliases"`
+}
+
+// BindingContainer represents the set of bindings for a single container, identified by its name, along with the
+// details of the container needed to route to it
 type BindingContainer struct {
+	// ID is the docker ID of the container
+	ID string `json:"id"`
 	// Name is the name of the container on the host
 	Name string `json:"name"`
+	// Service is the name of the compose service this container was created for
+	Service string `json:"service"`
+	// Image is the image the container was created from
+	Image string `json:"image"`
+	// State is the state of the container as reported by docker (ie running, restarting, exited)
+	State string `json:"state"`
+	// Health is the result of the container health check (ie healthy, unhealthy, starting), or none if the container
+	// does not define a health check
+	Health string `json:"health"`
+	// Labels is the set of nqk labels (those prefixed with LabelPrefix) attached to the container
+	Labels map[string]string `json:"labels"`
+	// Networks is the set of docker networks the container is attached to, sorted by name
+	Networks []BindingNetwork `json:"networks"`
 	// Ports is the set of exposed ports
 	Ports []BindingPortMapping `json:"ports"`
 }
 
+// NetworkAddress returns the address of the container on the named docker network, preferring IPv4 over IPv6, or an
+// empty string if it is not attached to it
+func (c BindingContainer) NetworkAddress(network string) string {
+	for _, candidate := range c.Networks {
+		if candidate.Name == network {
+			if candidate.IPAddress != "" {
+				return candidate.IPAddress
+			}
+			return candidate.IPv6Address
+		}
+	}
+	return ""
+}
+
 // BindingProject contains a mapping between a single nqk project and the set of containers that have been spawned from
 // it
 type BindingProject struct {
@@ -148,11 +237,12 @@ type BindingResult struct {
 }
 
 // GetBindingsForAllProjects will process every docker compose file given and attempt to extract their currently running
-// containers and the ports that are exposed from them as a result, returning the entire set as a tree
-func GetBindingsForAllProjects(cli *client.Client, dctx context.Context, projects []ProcessedDockerComposeFile) (BindingResult, error) {
+// containers and the ports that are exposed from them as a result, returning the entire set as a tree. Stopped
+// containers are included for the asleep projects so their routes can still be generated to wake them
+func GetBindingsForAllProjects(cli *client.Client, dctx context.Context, projects []ProcessedDockerComposeFile, asleep []string) (BindingResult, error) {
 	result := BindingResult{Projects: make(map[string]BindingProject)}
 	for _, project := range projects {
-		binding, err := GetProjectBinding(cli, dctx, project)
+		binding, err := GetProjectBinding(cli, dctx, project, slices.Contains(asleep, project.Name))
 		if err != nil {
 			return BindingResult{}, err
 		}
@@ -165,11 +255,14 @@ func GetBindingsForAllProjects(cli *client.Client, dctx context.Context, project
 
 // GetProjectBinding will return all the containers that are associated with the compose project file and then find
 // their exposed bindings. Container should be returned in a consistent ordering as well as their ports however this
-// is not guaranteed, any requirements on sorting should be implemented by the caller
-func GetProjectBinding(cli *client.Client, dctx context.Context, project ProcessedDockerComposeFile) (*BindingProject, error) {
+// is not guaranteed, any requirements on sorting should be implemented by the caller. Only running containers are
+// returned unless includeStopped is set, in which case stopped containers report the ports they are configured to
+// publish, with a host port of 0 where docker picks one when the container starts
+func GetProjectBinding(cli *client.Client, dctx context.Context, project ProcessedDockerComposeFile, includeStopped bool) (*BindingProject, error) {
 	bind := BindingProject{Project: project.Name, Containers: make(map[string]BindingContainer, 0)}
 
 	list, err := cli.ContainerList(dctx, types.ContainerListOptions{
+		All: includeStopped,
 		Filters: filters.NewArgs(
 			filters.KeyValuePair{
 				Key:   "label",
@@ -187,11 +280,82 @@ func GetProjectBinding(cli *client.Client, dctx context.Context, project Process
 	slog.Debug("Found containers for project", "project", project.Name, "source", project.Source, "container_count", len(list))
 	validPorts := make([]types.Port, 0)
 	for _, container := range list {
-		bindContainer := BindingContainer{Name: container.ID, Ports: make([]BindingPortMapping, 0)}
+		bindContainer := BindingContainer{
+			ID:       container.ID,
+			Name:     container.ID,
+			Service:  container.Labels[LabelComposeService],
+			Image:    container.Image,
+			State:    container.State,
+			Health:   "none",
+			Labels:   make(map[string]string),
+			Networks: make([]BindingNetwork, 0),
+			Ports:    make([]BindingPortMapping, 0),
+		}
+		if len(container.Names) > 0 {
+			bindContainer.Name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		for k, v := range container.Labels {
+			if strings.HasPrefix(k, LabelPrefix) {
+				bindContainer.Labels[k] = v
+			}
+		}
+
+		inspect, err := cli.ContainerInspect(dctx, container.ID)
+		if err != nil {
+			slog.Error("Failed to inspect container as part of project, cannot produce bindings", "project", project.Name, "container", bindContainer.Name, "error", err)
+			return nil, err
+		}
+		if inspect.State != nil && inspect.State.Health != nil {
+			bindContainer.Health = inspect.State.Health.Status
+		}
+
+		if container.NetworkSettings != nil {
+			for name, network := range container.NetworkSettings.Networks {
+				if network == nil {
+					continue
+				}
+				bindContainer.Networks = append(bindContainer.Networks, BindingNetwork{
+					Name:        name,
+					IPAddress:   network.IPAddress,
+					IPv6Address: network.GlobalIPv6Address,
+					Aliases:     network.Aliases,
+				})
+			}
+		}
+		slices.SortFunc(bindContainer.Networks, func(a, b BindingNetwork) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+
 		portCopy := make([]types.Port, len(container.Ports))
 		for i, port := range container.Ports {
 			portCopy[i] = port
 		}
+		// docker only reports ports for running containers, so stopped ones fall back to their configuration
+		if container.State != "running" && inspect.HostConfig != nil {
+			portCopy = make([]types.Port, 0)
+			if inspect.Config != nil {
+				for containerPort := range inspect.Config.ExposedPorts {
+					if _, published := inspect.HostConfig.PortBindings[containerPort]; !published {
+						portCopy = append(portCopy, types.Port{PrivatePort: uint16(containerPort.Int()), Type: containerPort.Proto()})
+					}
+				}
+			}
+			for containerPort, bindings := range inspect.HostConfig.PortBindings {
+				for _, binding := range bindings {
+					hostIp := binding.HostIP
+					if hostIp == "" {
+						hostIp = "0.0.0.0"
+					}
+					hostPort, _ := strconv.ParseUint(binding.HostPort, 10, 16)
+					portCopy = append(portCopy, types.Port{
+						IP:          hostIp,
+						PrivatePort: uint16(containerPort.Int()),
+						PublicPort:  uint16(hostPort),
+						Type:        containerPort.Proto(),
+					})
+				}
+			}
+		}
 		slices.SortFunc(portCopy, func(a, b types.Port) int {
 			if v := a.PublicPort - b.PublicPort; v != 0 {
 				return int(v)
@@ -208,13 +372,14 @@ func GetProjectBinding(cli *client.Client, dctx context.Context, project Process
 		for _, port := range portCopy {
 			if port.PublicPort != 0 {
 				validPorts = append(validPorts, port)
-				bindContainer.Ports = append(bindContainer.Ports, BindingPortMapping{
-					ContainerPort: port.PrivatePort,
-					HostPort:      port.PublicPort,
-					Binding:       port.IP,
-					Type:          port.Type,
-				})
 			}
+			// unpublished ports are kept so they can be reached over docker networks instead of through the host
+			bindContainer.Ports = append(bindContainer.Ports, BindingPortMapping{
+				ContainerPort: port.PrivatePort,
+				HostPort:      port.PublicPort,
+				Binding:       port.IP,
+				Type:          port.Type,
+			})
 		}
 
 		bind.Containers[bindContainer.Name] = bindContainer
@@ -376,6 +541,31 @@ type DockerEvent struct {
 	Meta map[string]interface{}
 }
 
+// Attributes returns the actor attributes attached to the event. For container events this includes the container
+// labels (such as com.docker.compose.project) alongside values like the name and exitCode. Returns an empty map if the
+// event has no attributes
+func (d DockerEvent) Attributes() map[string]string {
+	result := make(map[string]string)
+
+	actor, ok := d.Meta["Actor"].(map[string]interface{})
+	if !ok {
+		return result
+	}
+
+	attributes, ok := actor["Attributes"].(map[string]interface{})
+	if !ok {
+		return result
+	}
+
+	for k, v := range attributes {
+		if vs, ok := v.(string); ok {
+			result[k] = vs
+		}
+	}
+
+	return result
+}
+
 func SubscribeToDockerEvents(queue chan DockerEvent) error {
 	cmd := Run("docker", "events", "--format", "{{json .}}")
 	stdout, err := cmd.StdoutPipe()
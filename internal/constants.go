@@ -1,17 +1,90 @@
 package internal
 
-import "fmt"
-
 const (
+	// LabelPrefix is the prefix shared by every label nqk reads from containers
+	LabelPrefix = "org.xiomi.nqkd."
+
 	LabelGlobalDomain = "org.xiomi.nqkd.domain"
 	LabelPortDomain   = "org.xiomi.nqkd.$port.domain"
 
+	LabelGlobalDomainAliases = "org.xiomi.nqkd.domain.aliases"
+	LabelPortDomainAliases   = "org.xiomi.nqkd.$port.domain.aliases"
+
+	LabelGlobalPath = "org.xiomi.nqkd.path"
+	LabelPortPath   = "org.xiomi.nqkd.$port.path"
+
+	LabelGlobalPathStrip = "org.xiomi.nqkd.path.strip"
+	LabelPortPathStrip   = "org.xiomi.nqkd.$port.path.strip"
+
+	LabelGlobalHttpRedirect = "org.xiomi.nqkd.http.redirect"
+	LabelPortHttpRedirect   = "org.xiomi.nqkd.$port.http.redirect"
+
+	LabelGlobalHsts = "org.xiomi.nqkd.hsts"
+	LabelPortHsts   = "org.xiomi.nqkd.$port.hsts"
+
+	LabelGlobalBalance = "org.xiomi.nqkd.balance"
+	LabelPortBalance   = "org.xiomi.nqkd.$port.balance"
+
+	LabelGlobalMaxFails = "org.xiomi.nqkd.health.max_fails"
+	LabelPortMaxFails   = "org.xiomi.nqkd.$port.health.max_fails"
+
+	LabelGlobalFailTimeout = "org.xiomi.nqkd.health.fail_timeout"
+	LabelPortFailTimeout   = "org.xiomi.nqkd.$port.health.fail_timeout"
+
+	LabelGlobalAuthBasic = "org.xiomi.nqkd.auth.basic"
+	LabelPortAuthBasic   = "org.xiomi.nqkd.$port.auth.basic"
+
+	LabelGlobalAuthForward = "org.xiomi.nqkd.auth.forward"
+	LabelPortAuthForward   = "org.xiomi.nqkd.$port.auth.forward"
+
+	LabelGlobalAuthForwardPath = "org.xiomi.nqkd.auth.forward.path"
+	LabelPortAuthForwardPath   = "org.xiomi.nqkd.$port.auth.forward.path"
+
+	LabelGlobalAllow = "org.xiomi.nqkd.allow"
+	LabelPortAllow   = "org.xiomi.nqkd.$port.allow"
+
+	LabelGlobalDeny = "org.xiomi.nqkd.deny"
+	LabelPortDeny   = "org.xiomi.nqkd.$port.deny"
+
+	// LabelGlobalNginxPrefix prefixes the labels which set an allowlisted nginx directive, ie
+	// `org.xiomi.nqkd.nginx.client_max_body_size`
+	LabelGlobalNginxPrefix = "org.xiomi.nqkd.nginx."
+	LabelPortNginxPrefix   = "org.xiomi.nqkd.$port.nginx."
+
+	// LabelGlobalHeaderPrefix prefixes the labels which add a response header, ie `org.xiomi.nqkd.header.X-Frame-Options`
+	LabelGlobalHeaderPrefix = "org.xiomi.nqkd.header."
+	LabelPortHeaderPrefix   = "org.xiomi.nqkd.$port.header."
+
+	LabelGlobalNginxSnippet = "org.xiomi.nqkd.nginx.snippet"
+	LabelPortNginxSnippet   = "org.xiomi.nqkd.$port.nginx.snippet"
+
+	LabelGlobalHttp2 = "org.xiomi.nqkd.http2"
+	LabelPortHttp2   = "org.xiomi.nqkd.$port.http2"
+
+	LabelGlobalQuic = "org.xiomi.nqkd.quic"
+	LabelPortQuic   = "org.xiomi.nqkd.$port.quic"
+
+	LabelGlobalMaintenancePage = "org.xiomi.nqkd.maintenance.page"
+	LabelPortMaintenancePage   = "org.xiomi.nqkd.$port.maintenance.page"
+
 	LabelGlobalNonstandardHttp = "org.xiomi.nqkd.http.nonstandard"
 	LabelPortNonstandardHttp   = "org.xiomi.nqkd.$port.http.nonstandard"
 
 	LabelGlobalSsl = "org.xiomi.nqkd.ssl"
 	LabelPortSsl   = "org.xiomi.nqkd.$port.ssl"
 
+	LabelGlobalSslCert = "org.xiomi.nqkd.ssl.cert"
+	LabelPortSslCert   = "org.xiomi.nqkd.$port.ssl.cert"
+
+	LabelGlobalSslKey = "org.xiomi.nqkd.ssl.key"
+	LabelPortSslKey   = "org.xiomi.nqkd.$port.ssl.key"
+
+	LabelGlobalSslInternal = "org.xiomi.nqkd.ssl.internal"
+	LabelPortSslInternal   = "org.xiomi.nqkd.$port.ssl.internal"
+
+	LabelGlobalSslPassthrough = "org.xiomi.nqkd.ssl.passthrough"
+	LabelPortSslPassthrough   = "org.xiomi.nqkd.$port.ssl.passthrough"
+
 	LabelGlobalBind = "org.xiomi.nqkd.bind"
 	LabelPortBind   = "org.xiomi.nqkd.$port.bind"
 
@@ -23,94 +96,55 @@ const (
 
 	LabelPortHide = "org.xiomi.nqkd.$port.hide"
 
+	// LabelIdleTimeout is how long a project can go without network traffic before it is put to sleep, the shortest
+	// timeout on any of its containers is used. This applies to the whole project so there is no port version
+	LabelIdleTimeout = "org.xiomi.nqkd.idle.timeout"
+
 	ValueTypeHttp  = "http"
 	ValueTypeHttps = "https"
-	ValueTypeTcp   = "tcp"
-	ValueTypeUdp   = "udp"
-
-	NginxConfigHttp = `server {
-    listen %s;
-    %s
-    server_name %s;
-    location / {
-        proxy_pass %s://%s:%d;
-
-		# WebSocket support
-		proxy_http_version 1.1;
-		proxy_set_header Upgrade $http_upgrade;
-		proxy_set_header Connection $http_connection;
-    }
-}
-`
-	NginxConfigTcp = `server {
-    listen %s;
-    %s
-    proxy_pass %s:%d;
-}
-`
-	NginxConfigUdp = `server {
-    listen %s udp;
-    proxy_pass %s:%d;
-}
-`
-	NginxConfigSsl = `ssl_certificate %s;
-ssl_certificate_key %s;
-ssl_protocols TLSv1.3;
-ssl_ciphers     HIGH:!aNULL:!MD5;`
+	// ValueTypeGrpc is http traffic for a plaintext gRPC upstream
+	ValueTypeGrpc = "grpc"
+	// ValueTypeGrpcs is http traffic for a gRPC upstream which expects tls
+	ValueTypeGrpcs = "grpcs"
+	// ValueTypeH2c is http traffic for an upstream which speaks plaintext HTTP/2 rather than HTTP/1.1
+	ValueTypeH2c = "h2c"
+	ValueTypeTcp = "tcp"
+	ValueTypeUdp = "udp"
 )
 
-func NginxSsl(config BindingConfiguration) string {
-	return fmt.Sprintf(NginxConfigSsl, config.SslCertificate, config.SslPrivateKey)
-}
-
-func NginxHttp(listen string, useSsl bool, domain string, protocol string, ip string, targetPort uint16, config BindingConfiguration) string {
-	ssl := ""
-	if useSsl {
-		ssl = NginxSsl(config)
-	}
-
-	realListen := listen
-	if useSsl {
-		realListen += " ssl"
-	}
-
-	return fmt.Sprintf(
-		NginxConfigHttp,
-		realListen,
-		ssl,
-		domain,
-		protocol,
-		ip,
-		targetPort,
-	)
-}
-
-func NginxTcp(listen string, useSsl bool, ip string, port uint16, config BindingConfiguration) string {
-	ssl := ""
-	if useSsl {
-		ssl = NginxSsl(config)
-	}
-
-	return fmt.Sprintf(
-		NginxConfigTcp,
-		listen,
-		ssl,
-		ip,
-		port,
-	)
-}
-
-func NginxUdp(listen string, ip string, port uint16) string {
-	return fmt.Sprintf(
-		NginxConfigUdp,
-		listen,
-		ip,
-		port,
-	)
-}
-
 type BindingConfiguration struct {
 	DefaultDomain  string
 	SslCertificate string
 	SslPrivateKey  string
+	// DefaultCertificate is the parsed SslCertificate, used to warn when it is served for a domain it doesn't cover.
+	// This is nil if the certificate couldn't be read
+	DefaultCertificate *CertificatePair
+	// Certificates is searched for a certificate matching the domain of each tls route, this may be nil
+	Certificates *CertificateStore
+	// LocalCa issues certificates for routes marked internal, if nil those routes are treated like any other
+	LocalCa *LocalCertificateAuthority
+	// HtpasswdDir is the directory of htpasswd files referred to by the auth.basic label
+	HtpasswdDir string
+	// SnippetDir is the only directory nginx snippets can be included from by the nginx.snippet label, if empty the
+	// label is ignored
+	SnippetDir string
+	// OutputDir is the absolute directory generated files are written to, used by templates which refer to other
+	// generated files. This is empty when nothing is written
+	OutputDir string
+	// MaintenancePages is the only directory maintenance pages can be served from by the maintenance.page label, if
+	// empty the label is ignored
+	MaintenancePages string
+	// Maintenance are the names of the projects in maintenance, see ReadMaintenanceProjects
+	Maintenance []string
+	// Asleep are the names of the projects stopped for being idle, see ReadAsleepProjects
+	Asleep []string
+	// WakerAddress is the address of the daemon's waker which requests for asleep projects are sent to
+	WakerAddress string
+	// Ipv6 is whether routes bound to every IPv4 address should also be bound to every IPv6 address
+	Ipv6 bool
+	// Network is the docker network the proxy is attached to, if set upstreams are the addresses of containers on it
+	// rather than the ports they publish on the host, so ports don't need to be published
+	Network string
+	// AcmeWebroot is the directory http-01 challenges are served from, if empty no challenge locations are generated
+	AcmeWebroot string
 }
@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// LabelComposeProject is the label docker compose attaches to every container with the name of its project
+	LabelComposeProject = "com.docker.compose.project"
+	// LabelComposeService is the label docker compose attaches to every container with the name of its service
+	LabelComposeService = "com.docker.compose.service"
+)
+
+// restartPairWindow is how long after a non-zero die event a restart event of the same container is treated as part of
+// the same restart. A manual docker restart emits both, and should only be counted once
+const restartPairWindow = time.Minute
+
+// CrashLoopConfiguration controls how container events are interpreted when looking for crash looping services
+type CrashLoopConfiguration struct {
+	// Window is the period over which restarts and OOMs are counted
+	Window time.Duration
+	// Threshold is the number of restarts within Window at which a service is considered to be crash looping
+	Threshold int
+	// StopOnCrashLoop will stop the service through docker compose as soon as it is flagged as crash looping
+	StopOnCrashLoop bool
+	// Notifications is where notifications about crash looping and OOM killed services are sent
+	Notifications NotificationConfiguration
+}
+
+// CrashLoopDetector consumes docker events and tracks restarts and OOMs for each compose service, flagging services on
+// the StateRecord when they restart too often. It is not safe for concurrent use, callers should hold the same lock
+// they use to update the StateRecord
+type CrashLoopDetector struct {
+	config   CrashLoopConfiguration
+	restarts map[string][]time.Time
+	ooms     map[string][]time.Time
+	// dies holds the time of the last counted die event of each container, by name, until a restart event is paired
+	// with it
+	dies map[string]time.Time
+	// send and stop deliver notifications and stop services, these are SendNotification and StopComposeService
+	// outside of tests
+	send func(config NotificationConfiguration, notification Notification) error
+	stop func(project ProcessedDockerComposeFile, service string) error
+}
+
+// CrashLoopAction is a notification or a stop decided on by Observe. Notifications go to webhooks and commands and
+// stopping runs docker compose, both of which can take seconds, so they are carried out by Dispatch once the state lock
+// has been released
+type CrashLoopAction struct {
+	// Project and Service are the compose service the action is for
+	Project string
+	Service string
+	// Message is sent as a notification, if it isn't empty
+	Message string
+	// Stop is the project to stop the service in, nil if the service shouldn't be stopped
+	Stop *ProcessedDockerComposeFile
+}
+
+// NewCrashLoopDetector creates a detector with no history using the given configuration
+func NewCrashLoopDetector(config CrashLoopConfiguration) *CrashLoopDetector {
+	return &CrashLoopDetector{
+		config:   config,
+		restarts: make(map[string][]time.Time),
+		ooms:     make(map[string][]time.Time),
+		dies:     make(map[string]time.Time),
+		send:     SendNotification,
+		stop:     StopComposeService,
+	}
+}
+
+// pruneWindow removes any times which fall before the start of the window
+func pruneWindow(times []time.Time, start time.Time) []time.Time {
+	result := make([]time.Time, 0, len(times))
+	for _, t := range times {
+		if !t.Before(start) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// Observe processes a single docker event at the given time. Only die (with a non-zero exit code), restart and oom
+// events for containers belonging to a project in the record are considered, all other events are ignored. When a
+// service crosses the restart threshold it is flagged as crash looping and, if configured, marked as stopped. A restart
+// event following a counted die event of the same container is not counted again. Returns the notifications and stops
+// which should be passed to Dispatch once the lock is released
+func (c *CrashLoopDetector) Observe(event DockerEvent, record *StateRecord, now time.Time) []CrashLoopAction {
+	isOom := event.Type.TypeMeta == ContainerOomEvent.TypeMeta
+	isRestart := event.Type.TypeMeta == ContainerRestartEvent.TypeMeta
+	attributes := event.Attributes()
+	if event.Type.TypeMeta == ContainerDieEvent.TypeMeta {
+		isRestart = attributes["exitCode"] != "" && attributes["exitCode"] != "0"
+		if isRestart {
+			c.dies[attributes["name"]] = now
+		}
+	} else if isRestart {
+		if died, ok := c.dies[attributes["name"]]; ok {
+			delete(c.dies, attributes["name"])
+			isRestart = now.Sub(died) > restartPairWindow
+		}
+	}
+	if !isOom && !isRestart {
+		return nil
+	}
+
+	project, service := attributes[LabelComposeProject], attributes[LabelComposeService]
+	state := record.Service(project, service)
+	if state == nil {
+		slog.Debug("Ignoring crash event for container not managed by nqk", "project", project, "service", service)
+		return nil
+	}
+
+	key := project + "/" + service
+	// the state is new if the project content changed since the service last misbehaved, the history is from the old
+	// configuration and shouldn't count against the new one
+	if state.LastEvent.IsZero() {
+		delete(c.restarts, key)
+		delete(c.ooms, key)
+	}
+	if isOom {
+		c.ooms[key] = append(c.ooms[key], now)
+	}
+	if isRestart {
+		c.restarts[key] = append(c.restarts[key], now)
+	}
+	state.LastEvent = now
+	wasLooping := state.CrashLooping
+	c.refresh(key, state, now)
+
+	actions := make([]CrashLoopAction, 0)
+	if isOom {
+		actions = append(actions, CrashLoopAction{Project: project, Service: service, Message: fmt.Sprintf("container %v was killed for running out of memory (%v in the last %v)", attributes["name"], state.Ooms, c.config.Window)})
+	}
+
+	if state.CrashLooping && !wasLooping {
+		action := CrashLoopAction{Project: project, Service: service, Message: fmt.Sprintf("service is crash looping, %v restarts in the last %v", state.Restarts, c.config.Window)}
+		// marked stopped straight away so the launch loop doesn't apply the project again while it is being stopped
+		if c.config.StopOnCrashLoop && !state.Stopped {
+			state.Stopped = true
+			stop := record.Projects[project].Project
+			action.Stop = &stop
+		}
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+// Dispatch sends the notifications and stops the services for the actions returned by Observe. It must be called
+// without the lock of the record held, which is taken to record a stop which failed
+func (c *CrashLoopDetector) Dispatch(actions []CrashLoopAction, record *StateRecord) {
+	for _, action := range actions {
+		if action.Message != "" {
+			c.notify(action.Project, action.Service, action.Message)
+		}
+		if action.Stop == nil {
+			continue
+		}
+
+		err := c.stop(*action.Stop, action.Service)
+		if err != nil {
+			slog.Error("Failed to stop crash looping service", "project", action.Project, "service", action.Service, "error", err)
+			record.Lock.Lock()
+			if state, ok := record.Projects[action.Project]; ok && state.Services[action.Service] != nil {
+				state.Services[action.Service].Stopped = false
+			}
+			record.Lock.Unlock()
+			continue
+		}
+
+		c.notify(action.Project, action.Service, "service was stopped because it was crash looping, it will not be restarted until its configuration changes")
+	}
+}
+
+// Expire recalculates every tracked service against the window ending at now so services which have stopped
+// restarting are no longer reported as crash looping. Stopped services remain stopped
+func (c *CrashLoopDetector) Expire(record *StateRecord, now time.Time) {
+	tracked := make(map[string]bool)
+	for name, project := range record.Projects {
+		for service, state := range project.Services {
+			tracked[name+"/"+service] = true
+			c.refresh(name+"/"+service, state, now)
+		}
+	}
+	// services are no longer tracked once their project is removed or its content changes (see StateRecord.Update),
+	// so a redeploy starts counting from zero
+	for key := range c.restarts {
+		if !tracked[key] {
+			delete(c.restarts, key)
+		}
+	}
+	for key := range c.ooms {
+		if !tracked[key] {
+			delete(c.ooms, key)
+		}
+	}
+	for container, died := range c.dies {
+		if now.Sub(died) > restartPairWindow {
+			delete(c.dies, container)
+		}
+	}
+}
+
+// refresh prunes the history for the given key and recalculates the counters and crash loop flag on the state
+func (c *CrashLoopDetector) refresh(key string, state *ServiceCrashState, now time.Time) {
+	start := now.Add(-c.config.Window)
+	c.restarts[key] = pruneWindow(c.restarts[key], start)
+	c.ooms[key] = pruneWindow(c.ooms[key], start)
+
+	state.Restarts = len(c.restarts[key])
+	state.Ooms = len(c.ooms[key])
+	state.CrashLooping = state.Stopped || (c.config.Threshold > 0 && state.Restarts >= c.config.Threshold)
+}
+
+// notify sends a notification using the configured targets, logging any failures
+func (c *CrashLoopDetector) notify(project string, service string, message string) {
+	err := c.send(c.config.Notifications, Notification{
+		Project: project,
+		Service: service,
+		Message: message,
+		Time:    time.Now(),
+	})
+	if err != nil {
+		slog.Error("Failed to send notification", "project", project, "service", service, "error", err)
+	}
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// crashEvent is a docker event of the given type for a container of the web service in the shop project
+func crashEvent(definition EventDefinition, container string, exitCode string) DockerEvent {
+	attributes := map[string]interface{}{
+		"name":              container,
+		LabelComposeProject: "shop",
+		LabelComposeService: "web",
+	}
+	if exitCode != "" {
+		attributes["exitCode"] = exitCode
+	}
+	return DockerEvent{Type: definition, Meta: map[string]interface{}{"Actor": map[string]interface{}{"Attributes": attributes}}}
+}
+
+// crashRecord is a record managing only the shop project
+func crashRecord() *StateRecord {
+	record := &StateRecord{Projects: map[string]*ActiveProjectState{}, Lock: &sync.Mutex{}}
+	record.Update(ProcessedDockerComposeFile{Name: "shop", Content: "services: {}"}, ProjectOk)
+	return record
+}
+
+// timedEvent is an event observed at an offset from the start of a test
+type timedEvent struct {
+	at    time.Duration
+	event DockerEvent
+}
+
+func TestCrashLoopDetectorObserve(t *testing.T) {
+	die := func(at time.Duration) timedEvent {
+		return timedEvent{at: at, event: crashEvent(ContainerDieEvent, "shop-web-1", "1")}
+	}
+	restart := func(at time.Duration) timedEvent {
+		return timedEvent{at: at, event: crashEvent(ContainerRestartEvent, "shop-web-1", "")}
+	}
+	oom := func(at time.Duration) timedEvent {
+		return timedEvent{at: at, event: crashEvent(ContainerOomEvent, "shop-web-1", "")}
+	}
+
+	tests := []struct {
+		name         string
+		events       []timedEvent
+		wantRestarts int
+		wantOoms     int
+		wantLooping  bool
+	}{
+		{
+			name:         "non-zero exits are counted",
+			events:       []timedEvent{die(0), die(time.Minute * 2)},
+			wantRestarts: 2,
+		},
+		{
+			name:   "clean exits are ignored",
+			events: []timedEvent{{at: 0, event: crashEvent(ContainerDieEvent, "shop-web-1", "0")}},
+		},
+		{
+			name:         "threshold flags the service",
+			events:       []timedEvent{die(0), die(2 * time.Minute), die(4 * time.Minute)},
+			wantRestarts: 3,
+			wantLooping:  true,
+		},
+		{
+			name:         "restarts outside the window are dropped",
+			events:       []timedEvent{die(0), die(2 * time.Minute), die(12 * time.Minute)},
+			wantRestarts: 2,
+		},
+		{
+			name:         "restart paired with a die is counted once",
+			events:       []timedEvent{die(0), restart(time.Second)},
+			wantRestarts: 1,
+		},
+		{
+			name:         "restart long after a die is counted again",
+			events:       []timedEvent{die(0), restart(2 * time.Minute)},
+			wantRestarts: 2,
+		},
+		{
+			name:         "restart without a die is counted",
+			events:       []timedEvent{restart(0)},
+			wantRestarts: 1,
+		},
+		{
+			name:     "ooms are counted separately",
+			events:   []timedEvent{oom(0), oom(time.Minute)},
+			wantOoms: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			detector := NewCrashLoopDetector(CrashLoopConfiguration{Window: 10 * time.Minute, Threshold: 3})
+			detector.send = func(NotificationConfiguration, Notification) error { return nil }
+			record := crashRecord()
+			start := time.Now()
+
+			for _, event := range test.events {
+				detector.Observe(event.event, record, start.Add(event.at))
+			}
+
+			state := record.Projects["shop"].Services["web"]
+			if state == nil {
+				state = &ServiceCrashState{}
+			}
+			if state.Restarts != test.wantRestarts || state.Ooms != test.wantOoms || state.CrashLooping != test.wantLooping {
+				t.Errorf("state = %+v, want %v restarts, %v ooms and crash looping %v", *state, test.wantRestarts, test.wantOoms, test.wantLooping)
+			}
+		})
+	}
+}
+
+func TestCrashLoopDetectorActions(t *testing.T) {
+	tests := []struct {
+		name         string
+		stopOnLoop   bool
+		stopErr      error
+		wantMessages int
+		wantStops    int
+		wantStopped  bool
+	}{
+		{name: "notify only", wantMessages: 1},
+		{name: "stop", stopOnLoop: true, wantMessages: 2, wantStops: 1, wantStopped: true},
+		{name: "failed stop is undone", stopOnLoop: true, stopErr: errors.New("compose failed"), wantMessages: 1, wantStops: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			detector := NewCrashLoopDetector(CrashLoopConfiguration{Window: time.Minute, Threshold: 2, StopOnCrashLoop: test.stopOnLoop})
+			messages, stops := 0, 0
+			detector.send = func(NotificationConfiguration, Notification) error { messages++; return nil }
+			detector.stop = func(project ProcessedDockerComposeFile, service string) error {
+				if project.Name != "shop" || service != "web" {
+					t.Errorf("stopped %v/%v, want shop/web", project.Name, service)
+				}
+				stops++
+				return test.stopErr
+			}
+			record := crashRecord()
+			now := time.Now()
+
+			for i := 0; i < 3; i++ {
+				actions := detector.Observe(crashEvent(ContainerDieEvent, "shop-web-1", "137"), record, now.Add(time.Duration(i)*time.Second))
+				detector.Dispatch(actions, record)
+			}
+
+			if messages != test.wantMessages || stops != test.wantStops {
+				t.Errorf("sent %v notifications and stopped %v times, want %v and %v", messages, stops, test.wantMessages, test.wantStops)
+			}
+			if stopped := record.Projects["shop"].Services["web"].Stopped; stopped != test.wantStopped {
+				t.Errorf("stopped = %v, want %v", stopped, test.wantStopped)
+			}
+		})
+	}
+}
+
+func TestCrashLoopDetectorRedeploy(t *testing.T) {
+	detector := NewCrashLoopDetector(CrashLoopConfiguration{Window: time.Hour, Threshold: 3})
+	detector.send = func(NotificationConfiguration, Notification) error { return nil }
+	record := crashRecord()
+	now := time.Now()
+
+	detector.Observe(crashEvent(ContainerDieEvent, "shop-web-1", "1"), record, now)
+	detector.Observe(crashEvent(ContainerDieEvent, "shop-web-1", "1"), record, now.Add(time.Minute*2))
+
+	record.Update(ProcessedDockerComposeFile{Name: "shop", Content: "services: {web: {}}"}, ProjectOk)
+	detector.Observe(crashEvent(ContainerDieEvent, "shop-web-1", "1"), record, now.Add(time.Minute*4))
+
+	state := record.Projects["shop"].Services["web"]
+	if state.Restarts != 1 || state.CrashLooping {
+		t.Errorf("state = %+v, want the history from before the redeploy dropped", *state)
+	}
+
+	record.Update(ProcessedDockerComposeFile{Name: "shop", Content: "services: {web: {image: x}}"}, ProjectOk)
+	detector.Expire(record, now.Add(time.Minute*5))
+	if len(detector.restarts) != 0 {
+		t.Errorf("Expire() kept history %v for services no longer tracked", detector.restarts)
+	}
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	// safeNameRegex matches the names labels can give files, so a label can't point outside the directory it refers to
+	safeNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	// sizeRegex matches nginx sizes, a whole number with an optional unit (ie 512k or 100m)
+	sizeRegex = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+	// switchRegex matches nginx flags
+	switchRegex = regexp.MustCompile(`^(on|off)$`)
+	// mimeTypesRegex matches a space separated list of mime types, or *
+	mimeTypesRegex = regexp.MustCompile(`^(\*|[a-zA-Z0-9.+-]+/[a-zA-Z0-9.+*-]+( +[a-zA-Z0-9.+-]+/[a-zA-Z0-9.+*-]+)*)$`)
+	// headerNameRegex matches the header names which can be set by label
+	headerNameRegex = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+)
+
+// NginxDirectives are the nginx directives which can be set for a route by label, and the values each accepts. Every
+// value is matched in full, so none of them can end the directive or open a block
+var NginxDirectives = map[string]*regexp.Regexp{
+	"client_max_body_size":    sizeRegex,
+	"client_body_timeout":     durationRegex,
+	"proxy_connect_timeout":   durationRegex,
+	"proxy_read_timeout":      durationRegex,
+	"proxy_send_timeout":      durationRegex,
+	"proxy_buffering":         switchRegex,
+	"proxy_request_buffering": switchRegex,
+	"proxy_buffer_size":       sizeRegex,
+	"gzip":                    switchRegex,
+	"gzip_types":              mimeTypesRegex,
+	"gzip_min_length":         sizeRegex,
+}
+
+// RouteDirective is an nginx directive and its value set on a route by label
+type RouteDirective struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// RouteHeader is a response header added to every response from a route
+type RouteHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// safeFilePath returns the path of the named file in the directory, or an error if the name is not just letters,
+// numbers, dots, dashes and underscores
+func safeFilePath(dir string, name string, kind string) (string, error) {
+	if !safeNameRegex.MatchString(name) || name == "." || name == ".." {
+		return "", errors.New("invalid " + kind + " name " + strconv.Quote(name))
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// getLabelsWithPrefix returns every label starting with either prefix keyed by the rest of the label, with the port
+// labels taking priority over global ones of the same key
+func getLabelsWithPrefix(labels map[string]string, globalPrefix string, portPrefix string, port uint16) map[string]string {
+	resolvedPortPrefix := strings.ReplaceAll(portPrefix, "$port", strconv.Itoa(int(port)))
+	result := make(map[string]string)
+	for label, value := range labels {
+		if key, found := strings.CutPrefix(label, globalPrefix); found {
+			if _, exists := result[key]; !exists {
+				result[key] = value
+			}
+		}
+	}
+	for label, value := range labels {
+		if key, found := strings.CutPrefix(label, resolvedPortPrefix); found {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// ResolveNginxDirectives reads the directive labels for the port, returning the ones which are allowlisted in
+// NginxDirectives with a valid value sorted by name. Anything else is logged and left out
+func ResolveNginxDirectives(labels map[string]string, port uint16) []RouteDirective {
+	directives := make([]RouteDirective, 0)
+	for name, value := range getLabelsWithPrefix(labels, LabelGlobalNginxPrefix, LabelPortNginxPrefix, port) {
+		if name == "snippet" {
+			continue
+		}
+		valueRegex, ok := NginxDirectives[name]
+		if !ok {
+			slog.Error("Ignoring nginx directive label because the directive is not allowed", "directive", name, "port", port)
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if !valueRegex.MatchString(value) {
+			slog.Error("Ignoring nginx directive label because the value is not valid for the directive", "directive", name, "value", value, "port", port)
+			continue
+		}
+		directives = append(directives, RouteDirective{Name: name, Value: value})
+	}
+
+	slices.SortFunc(directives, func(a, b RouteDirective) int { return strings.Compare(a.Name, b.Name) })
+	return directives
+}
+
+// ResolveHeaders reads the header labels for the port, returning the headers with a valid name and a value which can
+// be quoted safely sorted by name. Anything else is logged and left out
+func ResolveHeaders(labels map[string]string, port uint16) []RouteHeader {
+	headers := make([]RouteHeader, 0)
+	for name, value := range getLabelsWithPrefix(labels, LabelGlobalHeaderPrefix, LabelPortHeaderPrefix, port) {
+		if !headerNameRegex.MatchString(name) {
+			slog.Error("Ignoring header label because the header name is not valid", "header", name, "port", port)
+			continue
+		}
+		if strings.ContainsAny(value, "\"\\\r\n") {
+			slog.Error("Ignoring header label because the value contains quotes, backslashes or newlines", "header", name, "value", value, "port", port)
+			continue
+		}
+		headers = append(headers, RouteHeader{Name: name, Value: value})
+	}
+
+	slices.SortFunc(headers, func(a, b RouteHeader) int { return strings.Compare(a.Name, b.Name) })
+	return headers
+}
+
+// ResolveNginxSnippet returns the path of the snippet named by the snippet label in the snippet directory, or an empty
+// string if there is no label. Snippets are only allowed from the directory so a label can't include arbitrary files
+func ResolveNginxSnippet(labels map[string]string, port uint16, snippetDir string) string {
+	name := GetLabelForPort(labels, LabelGlobalNginxSnippet, LabelPortNginxSnippet, port)
+	if name == nil {
+		return ""
+	}
+	if snippetDir == "" {
+		slog.Error("Ignoring nginx snippet label because no snippet directory has been provided, use --snippet-dir", "snippet", *name, "port", port)
+		return ""
+	}
+
+	path, err := safeFilePath(snippetDir, strings.TrimSuffix(*name, ".conf")+".conf", "snippet")
+	if err != nil {
+		slog.Error("Ignoring nginx snippet label", "snippet", *name, "port", port, "error", err)
+		return ""
+	}
+	if _, err := os.Stat(path); err != nil {
+		slog.Warn("The nginx snippet does not exist, nginx will refuse the configuration until it is created", "file", path, "port", port)
+	}
+	return path
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestResolveNginxDirectives(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   []RouteDirective
+	}{
+		{
+			name:   "allowlisted directives are sorted",
+			labels: map[string]string{"org.xiomi.nqkd.nginx.proxy_read_timeout": "60s", "org.xiomi.nqkd.nginx.client_max_body_size": " 100m "},
+			want:   []RouteDirective{{Name: "client_max_body_size", Value: "100m"}, {Name: "proxy_read_timeout", Value: "60s"}},
+		},
+		{
+			name:   "port labels override global ones",
+			labels: map[string]string{"org.xiomi.nqkd.nginx.gzip": "off", "org.xiomi.nqkd.80.nginx.gzip": "on", "org.xiomi.nqkd.8080.nginx.gzip": "off"},
+			want:   []RouteDirective{{Name: "gzip", Value: "on"}},
+		},
+		{
+			name:   "mime type lists",
+			labels: map[string]string{"org.xiomi.nqkd.nginx.gzip_types": "text/css application/json image/svg+xml"},
+			want:   []RouteDirective{{Name: "gzip_types", Value: "text/css application/json image/svg+xml"}},
+		},
+		{
+			name:   "directives outside the allowlist are left out",
+			labels: map[string]string{"org.xiomi.nqkd.nginx.root": "/", "org.xiomi.nqkd.nginx.gzip": "on"},
+			want:   []RouteDirective{{Name: "gzip", Value: "on"}},
+		},
+		{
+			name: "values which could inject config are left out",
+			labels: map[string]string{
+				"org.xiomi.nqkd.nginx.client_max_body_size": "1m; include /etc/shadow",
+				"org.xiomi.nqkd.nginx.proxy_read_timeout":   "60s }",
+				"org.xiomi.nqkd.nginx.gzip":                 "on\nroot /",
+				"org.xiomi.nqkd.nginx.gzip_types":           "text/css;",
+			},
+			want: []RouteDirective{},
+		},
+		{
+			name:   "the snippet label is not a directive",
+			labels: map[string]string{"org.xiomi.nqkd.nginx.snippet": "custom"},
+			want:   []RouteDirective{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ResolveNginxDirectives(test.labels, 80); !slices.Equal(got, test.want) {
+				t.Errorf("ResolveNginxDirectives() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveHeaders(t *testing.T) {
+	labels := map[string]string{
+		"org.xiomi.nqkd.header.X-Frame-Options":     "DENY",
+		"org.xiomi.nqkd.80.header.Referrer-Policy":  "no-referrer",
+		"org.xiomi.nqkd.header.X Bad":               "x",
+		"org.xiomi.nqkd.header.X-Quoted":            `a" always; add_header X "b`,
+		"org.xiomi.nqkd.header.X-Multiline":         "a\nb",
+		"org.xiomi.nqkd.8080.header.X-Another-Port": "x",
+	}
+	want := []RouteHeader{{Name: "Referrer-Policy", Value: "no-referrer"}, {Name: "X-Frame-Options", Value: "DENY"}}
+	if got := ResolveHeaders(labels, 80); !slices.Equal(got, want) {
+		t.Errorf("ResolveHeaders() = %v, want %v", got, want)
+	}
+}
+
+func TestResolveNginxSnippet(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"custom.conf": "gzip on;"})
+
+	tests := []struct {
+		name       string
+		snippet    string
+		snippetDir string
+		want       string
+	}{
+		{name: "snippet from the directory", snippet: "custom", snippetDir: dir, want: filepath.Join(dir, "custom.conf")},
+		{name: "conf extension is optional", snippet: "custom.conf", snippetDir: dir, want: filepath.Join(dir, "custom.conf")},
+		{name: "missing snippets are still included", snippet: "missing", snippetDir: dir, want: filepath.Join(dir, "missing.conf")},
+		{name: "no snippet directory", snippet: "custom"},
+		{name: "paths are rejected", snippet: "../../etc/nginx/nginx", snippetDir: dir},
+		{name: "absolute paths are rejected", snippet: "/etc/shadow", snippetDir: dir},
+		{name: "whitespace is rejected", snippet: "custom; include /etc/shadow", snippetDir: dir},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			labels := map[string]string{LabelGlobalNginxSnippet: test.snippet}
+			if got := ResolveNginxSnippet(labels, 80, test.snippetDir); got != test.want {
+				t.Errorf("ResolveNginxSnippet() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNginxDirectivesOutput(t *testing.T) {
+	route := testRoute("shop", "example.com", 8080, func(route *Route) {
+		route.Directives = []RouteDirective{{Name: "client_max_body_size", Value: "100m"}}
+		route.Headers = []RouteHeader{{Name: "X-Frame-Options", Value: "DENY"}}
+		route.Snippet = "/etc/nqkd/snippets/custom.conf"
+	})
+	got := renderNginx(t, BindingConfiguration{}, route)
+	expectContent(t, "GenerateFilesForNginxRoutes()", got, []string{
+		"        client_max_body_size 100m;\n",
+		"        add_header X-Frame-Options \"DENY\" always;\n",
+		"        include /etc/nqkd/snippets/custom.conf;\n",
+	}, nil)
+}
@@ -1,10 +1,12 @@
 package internal
 
 import (
+	"context"
 	"log/slog"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 )
 
 // Run is a wrapper around exec.Command which logs the requested command and arguments, and also copies the active
@@ -15,3 +17,13 @@ func Run(command string, arg ...string) *exec.Cmd {
 	cmd.Env = os.Environ()
 	return cmd
 }
+
+// RunContext is Run using exec.CommandContext, so the command is killed if the context is done before it exits. Its
+// output pipes are closed shortly after, so a script whose children are still running doesn't hold the caller up
+func RunContext(ctx context.Context, command string, arg ...string) *exec.Cmd {
+	slog.Debug("run :: " + command + " " + strings.Join(arg, " "))
+	cmd := exec.CommandContext(ctx, command, arg...)
+	cmd.Env = os.Environ()
+	cmd.WaitDelay = time.Second
+	return cmd
+}
@@ -1,10 +1,15 @@
 package internal
 
 import (
+	"encoding/json"
+	"errors"
 	"gopkg.in/fsnotify/fsnotify.v1"
 	"io/fs"
 	"log/slog"
+	"os"
 	"path/filepath"
+	"slices"
+	"sync"
 	"time"
 )
 
@@ -15,7 +20,7 @@ import (
 func WatchAndExecute(paths []string, executor func(), every *time.Duration) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		slog.Error("Failed to launch the watching system due to an error", err)
+		slog.Error("Failed to launch the watching system due to an error", "error", err)
 		return err
 	}
 
@@ -97,3 +102,80 @@ func LoadProjectsFromPaths(paths []string) ([]ProcessedDockerComposeFile, error)
 
 	return projects, nil
 }
+
+// projectList is the content of a file listing projects the daemon has put into some state, which bindings read to
+// route those projects differently (ie the maintenance file)
+type projectList struct {
+	// Projects are the sorted names of every project in the list
+	Projects []string `json:"projects"`
+}
+
+// readProjectList returns the sorted names of every project in the list file. A missing file is an empty list
+func readProjectList(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return make([]string, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list projectList
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	if list.Projects == nil {
+		list.Projects = make([]string, 0)
+	}
+	return list.Projects, nil
+}
+
+// projectListLock serialises updates to every list file, as the rpc server and the sleeper update them concurrently and
+// each update reads the file before replacing it
+var projectListLock sync.Mutex
+
+// setProjectListed adds the project to or removes it from the list file. The file is replaced with a rename so
+// bindings never read it half written. Returns whether the file changed
+func setProjectListed(path string, project string, listed bool) (bool, error) {
+	projectListLock.Lock()
+	defer projectListLock.Unlock()
+
+	projects, err := readProjectList(path)
+	if err != nil {
+		slog.Error("Failed to read the project list", "file", path, "error", err)
+		return false, err
+	}
+
+	index := slices.Index(projects, project)
+	if (index != -1) == listed {
+		return false, nil
+	}
+	if listed {
+		projects = append(projects, project)
+		slices.Sort(projects)
+	} else {
+		projects = slices.Delete(projects, index, index+1)
+	}
+
+	data, err := json.Marshal(projectList{Projects: projects})
+	if err != nil {
+		return false, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return false, err
+	}
+	err = os.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		slog.Error("Failed to write the project list", "file", path, "error", err)
+		return false, err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		slog.Error("Failed to replace the project list", "file", path, "error", err)
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSetProjectListedConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance.json")
+
+	var group sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		group.Add(1)
+		go func(project string) {
+			defer group.Done()
+			if _, err := setProjectListed(path, project, true); err != nil {
+				t.Errorf("setProjectListed(%v) error = %v", project, err)
+			}
+		}("project-" + strconv.Itoa(i))
+	}
+	group.Wait()
+
+	projects, err := readProjectList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projects) != 20 {
+		t.Errorf("readProjectList() = %v, want every project listed", projects)
+	}
+}
@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// HaproxyConfigFile is the name of the file the haproxy binding is written to
+const HaproxyConfigFile = "nqkd.haproxy.cfg"
+
+// haproxyBackend is a single backend, made up of every route sharing a frontend and domain
+type haproxyBackend struct {
+	Name      string
+	Domain    string
+	Balance   string
+	Upstreams []RouteUpstream
+	Servers   []string
+}
+
+// haproxyFrontend is a single frontend, made up of every route sharing a listen address and mode
+type haproxyFrontend struct {
+	Name         string
+	Listen       string
+	ListenPort   uint16
+	Mode         string
+	Tls          bool
+	Passthrough  bool
+	Http2        bool
+	DualStack    bool
+	Certificates []string
+	Backends     []*haproxyBackend
+}
+
+// haproxyBalance converts one of the Balance* constants into the equivalent haproxy balance algorithm
+func haproxyBalance(balance string) string {
+	switch balance {
+	case BalanceLeastConn:
+		return "leastconn"
+	case BalanceIpHash:
+		return "source"
+	default:
+		return "roundrobin"
+	}
+}
+
+// groupHaproxyFrontends merges every route into the frontends and backends they will be served from. HAProxy does not
+// proxy UDP so those routes are logged and skipped, as are tls routes without a certificate for haproxy to terminate
+// with and extra domains on a plain tcp frontend, which has nothing to route them by. Frontends and their backends are
+// sorted by name
+func groupHaproxyFrontends(routes []Route) []*haproxyFrontend {
+	frontends := make(map[string]*haproxyFrontend)
+	for _, route := range routes {
+		mode := "http"
+		if route.Protocol == ValueTypeUdp {
+			slog.Warn("Skipping route because haproxy does not support udp proxying", "project", route.Project, "container", route.Container, "port", route.ContainerPort)
+			continue
+		} else if !route.IsHttp() {
+			mode = "tcp"
+		}
+		if route.Asleep {
+			slog.Warn("Skipping route because waking asleep projects is only supported by the nginx binding", "project", route.Project, "container", route.Container, "port", route.ContainerPort)
+			continue
+		}
+		if route.HasAccessControl() {
+			slog.Warn("Skipping route because access control labels are only supported by the nginx binding", "project", route.Project, "container", route.Container, "port", route.ContainerPort)
+			continue
+		}
+		if route.Tls && route.Certificate == "" {
+			slog.Error("Skipping route because haproxy needs a certificate to terminate tls, set one with the ssl labels or --cert-dir", "project", route.Project, "container", route.Container, "port", route.ContainerPort, "domain", route.Domain)
+			continue
+		}
+		if route.IsHttp() && route.Path != "/" {
+			slog.Warn("Skipping route because path based routing is only supported by the nginx and traefik bindings", "project", route.Project, "container", route.Container, "port", route.ContainerPort, "path", route.Path)
+			continue
+		}
+
+		frontendName := CleanName("nqkd_" + mode + "_" + route.Listen())
+		frontend, ok := frontends[frontendName]
+		if !ok {
+			frontend = &haproxyFrontend{
+				Name:         frontendName,
+				Listen:       route.Listen(),
+				ListenPort:   route.ListenPort,
+				Mode:         mode,
+				Tls:          route.Tls,
+				Passthrough:  route.Passthrough,
+				DualStack:    route.DualStack,
+				Certificates: make([]string, 0),
+				Backends:     make([]*haproxyBackend, 0),
+			}
+			frontends[frontendName] = frontend
+		}
+		if route.Tls != frontend.Tls || route.Passthrough != frontend.Passthrough {
+			slog.Error("Skipping route because it disagrees with other routes on the same listen address about tls", "project", route.Project, "container", route.Container, "port", route.ContainerPort, "listen", route.Listen())
+			continue
+		}
+		frontend.Http2 = frontend.Http2 || route.Http2
+
+		backendName := CleanName(frontendName + "_" + route.Domain)
+		index := slices.IndexFunc(frontend.Backends, func(b *haproxyBackend) bool {
+			return b.Name == backendName
+		})
+		if index == -1 && mode == "tcp" && !route.Tls && !route.Passthrough && len(frontend.Backends) > 0 {
+			slog.Error("Skipping route because plain tcp has no domain to route by and another domain already uses the listen address", "project", route.Project, "container", route.Container, "port", route.ContainerPort, "listen", route.Listen(), "domain", route.Domain)
+			continue
+		}
+		if route.Tls && !slices.Contains(frontend.Certificates, route.Certificate) {
+			frontend.Certificates = append(frontend.Certificates, route.Certificate)
+		}
+		if index == -1 {
+			frontend.Backends = append(frontend.Backends, &haproxyBackend{Name: backendName, Domain: route.Domain, Balance: haproxyBalance(route.Balance)})
+			index = len(frontend.Backends) - 1
+		}
+		backend := frontend.Backends[index]
+		backend.Upstreams = append(backend.Upstreams, route.Upstream)
+		backend.Servers = append(backend.Servers, CleanName(route.Container+"_"+strconv.Itoa(int(route.ContainerPort))))
+	}
+
+	result := make([]*haproxyFrontend, 0, len(frontends))
+	for _, frontend := range frontends {
+		slices.SortFunc(frontend.Backends, func(a, b *haproxyBackend) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+		result = append(result, frontend)
+	}
+	slices.SortFunc(result, func(a, b *haproxyFrontend) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return result
+}
+
+// GenerateHaproxyConfiguration renders every route into frontend and backend sections. Http routes are routed by the
+// host header, or by SNI when the frontend terminates tls. Tcp routes use `mode tcp` and are routed by SNI when more
+// than one route shares a tls frontend, or always for tls passthrough where the SNI is read from the client hello.
+// Plain tcp frontends only ever have one backend, which is their default.
+// HAProxy loads the private key from the certificate file, or a file next to it with a .key suffix, so the key path on
+// the route is not used
+func GenerateHaproxyConfiguration(routes []Route) string {
+	var builder strings.Builder
+	builder.WriteString("# Generated by nqkd, changes will be overwritten\n")
+
+	for _, frontend := range groupHaproxyFrontends(routes) {
+		options := ""
+		if frontend.Tls {
+			options += " ssl"
+			for _, certificate := range frontend.Certificates {
+				options += " crt " + certificate
+			}
+			if frontend.Http2 {
+				options += " alpn h2,http/1.1"
+			}
+		}
+
+		builder.WriteString("\nfrontend " + frontend.Name + "\n")
+		builder.WriteString("    bind " + frontend.Listen + options + "\n")
+		if frontend.DualStack {
+			// v6only as the IPv4 addresses are already bound above
+			builder.WriteString("    bind " + net.JoinHostPort("::", strconv.Itoa(int(frontend.ListenPort))) + " v6only" + options + "\n")
+		}
+		builder.WriteString("    mode " + frontend.Mode + "\n")
+
+		if frontend.Passthrough {
+			builder.WriteString("    tcp-request inspect-delay 5s\n")
+			builder.WriteString("    tcp-request content accept if { req_ssl_hello_type 1 }\n")
+			for _, backend := range frontend.Backends {
+				if wildcard, found := strings.CutPrefix(backend.Domain, "*"); found {
+					builder.WriteString("    use_backend " + backend.Name + " if { req_ssl_sni -m end -i " + wildcard + " }\n")
+				} else {
+					builder.WriteString("    use_backend " + backend.Name + " if { req_ssl_sni -i " + backend.Domain + " }\n")
+				}
+			}
+		} else if frontend.Mode == "tcp" && (!frontend.Tls || len(frontend.Backends) == 1) {
+			builder.WriteString("    default_backend " + frontend.Backends[0].Name + "\n")
+		} else {
+			for _, backend := range frontend.Backends {
+				if frontend.Tls {
+					builder.WriteString("    use_backend " + backend.Name + " if { ssl_fc_sni -i " + backend.Domain + " }\n")
+				} else {
+					builder.WriteString("    use_backend " + backend.Name + " if { hdr(host),field(1,:) -i " + backend.Domain + " }\n")
+				}
+			}
+		}
+
+		for _, backend := range frontend.Backends {
+			builder.WriteString("\nbackend " + backend.Name + "\n")
+			builder.WriteString("    mode " + frontend.Mode + "\n")
+			builder.WriteString("    balance " + backend.Balance + "\n")
+			for i, upstream := range backend.Upstreams {
+				server := "    server " + backend.Servers[i] + " " + upstream.Address() + " check"
+				if upstream.IsTls() {
+					server += " ssl verify none"
+					if upstream.IsHttp2() {
+						server += " alpn h2"
+					}
+				} else if upstream.IsHttp2() {
+					server += " proto h2"
+				}
+				builder.WriteString(server + "\n")
+			}
+		}
+	}
+
+	return builder.String()
+}
+
+// ValidateHaproxy will execute the provided haproxy executable with the `-c` flag against the given config files which
+// should validate them as they would be loaded together. In the event the command fails, it will return false with the
+// error returned from the cmd.Run() command.
+func ValidateHaproxy(executable string, files ...string) (bool, error) {
+	var validationOutputBuffer bytes.Buffer
+	args := []string{"-c"}
+	for _, file := range files {
+		args = append(args, "-f", file)
+	}
+	validateCmd := Run(executable, args...)
+	validateCmd.Stdout = &validationOutputBuffer
+	validateCmd.Stderr = &validationOutputBuffer
+
+	err := validateCmd.Run()
+	if err != nil {
+		slog.Error("Failed to validate the config due to an error. This means the config may not have validated", "error", err, "output", validationOutputBuffer.String())
+		return false, err
+	}
+
+	return true, nil
+}
+
+// WriteHaproxyConfiguration writes the configuration to HaproxyConfigFile in dir if it differs from what is on disk.
+// The new configuration is first written next to the live file and, if an executable is given, validated alongside
+// the main config files with ValidateHaproxy. Only a valid configuration is swapped in with a rename, so an invalid
+// one never replaces the live file. An empty executable skips validation. Returns whether the live file was changed
+func WriteHaproxyConfiguration(content string, dir string, executable string, mainConfig []string) (bool, error) {
+	path := filepath.Join(dir, HaproxyConfigFile)
+	data, err := os.ReadFile(path)
+	if err == nil && string(data) == content {
+		slog.Debug("Skipping file because contents are the same", "file", path)
+		return false, nil
+	}
+
+	staged := path + ".staged"
+	err = os.WriteFile(staged, []byte(content), 0666)
+	if err != nil {
+		slog.Error("Failed to write staged haproxy configuration", "file", staged, "error", err)
+		return false, err
+	}
+
+	if executable != "" {
+		if ok, err := ValidateHaproxy(executable, append(slices.Clone(mainConfig), staged)...); !ok || err != nil {
+			if removeErr := os.Remove(staged); removeErr != nil {
+				slog.Error("Failed to remove invalid staged configuration", "file", staged, "error", removeErr)
+			}
+			if err == nil {
+				err = errors.New("generated haproxy configuration is invalid")
+			}
+			return false, err
+		}
+	}
+
+	err = os.Rename(staged, path)
+	if err != nil {
+		slog.Error("Failed to swap in the new haproxy configuration", "file", path, "error", err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RelaunchHaproxy will attempt to call out to /usr/sbin/service to reload the provided service name, which lets
+// haproxy pick up the new configuration without dropping connections. In the event the command fails, the error from
+// the cmd.Run() will be returned
+func RelaunchHaproxy(service string) error {
+	var reloadOutputBuffer bytes.Buffer
+	reloadCmd := Run("/usr/sbin/service", service, "reload")
+	reloadCmd.Stdout = &reloadOutputBuffer
+
+	err := reloadCmd.Run()
+	if err != nil {
+		slog.Error("Failed to reload haproxy due to an error!", "error", err, "stdout", reloadOutputBuffer.String())
+		return err
+	}
+
+	return nil
+}
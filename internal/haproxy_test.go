@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestGenerateHaproxyConfiguration(t *testing.T) {
+	passthrough := testRoute("project", "a.example.com", 8443, withProtocol(ValueTypeTcp), onPort(443))
+	passthrough.Passthrough = true
+
+	tests := []struct {
+		name    string
+		routes  []Route
+		want    []string
+		notWant []string
+	}{
+		{
+			name:   "http is routed by host",
+			routes: []Route{testRoute("project", "a.example.com", 8080), testRoute("project", "b.example.com", 8081)},
+			want:   []string{"mode http", "use_backend nqkd_http_0_0_0_0_80_a_example_com if { hdr(host),field(1,:) -i a.example.com }"},
+		},
+		{
+			name:    "tls is terminated and routed by sni",
+			routes:  []Route{testRoute("project", "a.example.com", 8080, onPort(443), withTls("/etc/ssl/a.pem")), testRoute("project", "b.example.com", 8080, onPort(443), withTls("/etc/ssl/b.pem"))},
+			want:    []string{"bind 0.0.0.0:443 ssl crt /etc/ssl/a.pem crt /etc/ssl/b.pem", "if { ssl_fc_sni -i b.example.com }"},
+			notWant: []string{"hdr(host)"},
+		},
+		{
+			name:    "tls without a certificate is skipped",
+			routes:  []Route{testRoute("project", "a.example.com", 8080, onPort(443), withTls(""))},
+			notWant: []string{"frontend", "ssl_fc_sni"},
+		},
+		{
+			name:    "plain tcp only serves the first domain",
+			routes:  []Route{testRoute("project", "a.example.com", 5432, withProtocol(ValueTypeTcp), onPort(5432)), testRoute("project", "b.example.com", 5433, withProtocol(ValueTypeTcp), onPort(5432))},
+			want:    []string{"mode tcp", "default_backend nqkd_tcp_0_0_0_0_5432_a_example_com"},
+			notWant: []string{"hdr(host)", "use_backend", "b_example_com"},
+		},
+		{
+			name:   "passthrough is routed by the client hello",
+			routes: []Route{passthrough},
+			want:   []string{"tcp-request inspect-delay 5s", "if { req_ssl_sni -i a.example.com }"},
+		},
+		{
+			name:    "udp is skipped",
+			routes:  []Route{testRoute("project", "a.example.com", 53, withProtocol(ValueTypeUdp), onPort(53))},
+			notWant: []string{"frontend"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expectContent(t, "GenerateHaproxyConfiguration()", GenerateHaproxyConfiguration(test.routes), test.want, test.notWant)
+		})
+	}
+}
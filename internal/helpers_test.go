@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+// testRoute is an http route of the web service in the project, serving domain on 0.0.0.0:80 and forwarding to the
+// upstream port on localhost. The options are applied in order to shape it for a test
+func testRoute(project string, domain string, upstream uint16, options ...func(route *Route)) Route {
+	route := Route{
+		Project:       project,
+		Service:       "web",
+		Container:     project + "-web-1",
+		ContainerPort: 80,
+		Protocol:      ValueTypeHttp,
+		ListenAddress: "0.0.0.0",
+		ListenPort:    80,
+		Domain:        domain,
+		Path:          "/",
+		Upstream:      RouteUpstream{Scheme: ValueTypeHttp, Host: "127.0.0.1", Port: upstream},
+	}
+	for _, option := range options {
+		option(&route)
+	}
+	return route
+}
+
+// onPort has the route listen on port
+func onPort(port uint16) func(route *Route) {
+	return func(route *Route) {
+		route.ListenPort = port
+	}
+}
+
+// withProtocol sets the type of the route and its upstream, plain tcp and udp routes have no path
+func withProtocol(protocol string) func(route *Route) {
+	return func(route *Route) {
+		route.Protocol = protocol
+		route.Upstream.Scheme = protocol
+		if !isHttpType(protocol) {
+			route.Path = ""
+		}
+	}
+}
+
+// withTls has the route terminate tls with the certificate, which is left to the proxy when empty
+func withTls(certificate string) func(route *Route) {
+	return func(route *Route) {
+		route.Tls = true
+		route.Certificate = certificate
+		if certificate != "" {
+			route.PrivateKey = certificate + ".key"
+		}
+	}
+}
+
+// withPath serves the route under the path prefix
+func withPath(path string) func(route *Route) {
+	return func(route *Route) {
+		route.Path = path
+	}
+}
+
+// expectContent checks that the output of the named function contains every string in want and none in notWant
+func expectContent(t *testing.T, name string, got string, want []string, notWant []string) {
+	t.Helper()
+	for _, want := range want {
+		if !strings.Contains(got, want) {
+			t.Errorf("%v is missing %q:\n%v", name, want, got)
+		}
+	}
+	for _, notWant := range notWant {
+		if strings.Contains(got, notWant) {
+			t.Errorf("%v should not contain %q:\n%v", name, notWant, got)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// LocalCaCertificateFile is the name of the root certificate in the local CA directory, this is what clients
+	// should trust
+	LocalCaCertificateFile = "root.crt"
+	// LocalCaKeyFile is the name of the root private key in the local CA directory
+	LocalCaKeyFile = "root.key"
+	// localCaIssuedDir is the directory under the local CA directory that leaf certificates are written to
+	localCaIssuedDir = "issued"
+
+	// localCaRootValidity is how long the root certificate is valid for
+	localCaRootValidity = 10 * 365 * 24 * time.Hour
+	// localCaLeafValidity is how long issued certificates are valid for, kept short as they are rotated automatically
+	localCaLeafValidity = 30 * 24 * time.Hour
+	// localCaLeafRenewBefore is how long before expiry issued certificates are rotated
+	localCaLeafRenewBefore = 10 * 24 * time.Hour
+)
+
+// LocalCertificateAuthority is a certificate authority managed by nqkd, used to issue certificates for domains which
+// are only reachable on the local network so they don't need (or can't get) a public certificate
+type LocalCertificateAuthority struct {
+	// Dir is the directory the root and every issued certificate is stored in
+	Dir         string
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// randomSerial returns a random 128 bit serial number for a new certificate
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// subjectKeyId derives the subject key identifier of a public key as the SHA-1 of its encoding
+func subjectKeyId(key *ecdsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(der)
+	return sum[:], nil
+}
+
+// createLocalCaRoot generates a new root key and self signed certificate and writes them to the directory
+func createLocalCaRoot(dir string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	keyId, err := subjectKeyId(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "nqkd local CA " + hostname, Organization: []string{"nqkd"}},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(localCaRootValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          keyId,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	err = writePrivateKey(filepath.Join(dir, LocalCaKeyFile), key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, LocalCaCertificateFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// LoadLocalCertificateAuthority loads the root certificate and key from the directory, creating the directory and a new
+// root if there isn't one yet
+func LoadLocalCertificateAuthority(dir string) (*LocalCertificateAuthority, error) {
+	err := os.MkdirAll(filepath.Join(dir, localCaIssuedDir), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	certificatePath := filepath.Join(dir, LocalCaCertificateFile)
+	if _, err := os.Stat(certificatePath); errors.Is(err, os.ErrNotExist) {
+		slog.Info("Creating a new local certificate authority", "dir", dir)
+		err = createLocalCaRoot(dir)
+		if err != nil {
+			slog.Error("Failed to create the local certificate authority", "dir", dir, "error", err)
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(certificatePath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded certificate found in " + certificatePath)
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, LocalCaKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key found in " + filepath.Join(dir, LocalCaKeyFile))
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalCertificateAuthority{Dir: dir, certificate: certificate, key: key}, nil
+}
+
+// RootCertificate returns the path to the root certificate which clients should be configured to trust
+func (l *LocalCertificateAuthority) RootCertificate() string {
+	return filepath.Join(l.Dir, LocalCaCertificateFile)
+}
+
+// CertificatePath returns where the certificate and private key issued for the domain are stored, or empty paths if the
+// domain isn't valid
+func (l *LocalCertificateAuthority) CertificatePath(domain string) (string, string) {
+	name, ok := acmeFileName(domain)
+	if !ok {
+		return "", ""
+	}
+	base := filepath.Join(l.Dir, localCaIssuedDir, name)
+	return base + ".crt", base + ".key"
+}
+
+// Issue creates a new key and certificate for the domain signed by the root, replacing any existing one
+func (l *LocalCertificateAuthority) Issue(domain string) (*CertificatePair, error) {
+	return l.issue(domain, localCaLeafValidity)
+}
+
+// issue creates a new key and certificate for the domain which is valid for the given duration
+func (l *LocalCertificateAuthority) issue(domain string, validity time.Duration) (*CertificatePair, error) {
+	if !ValidDomain(domain) {
+		return nil, fmt.Errorf("invalid domain %q", domain)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        pkix.Name{CommonName: domain},
+		DNSNames:       []string{domain},
+		NotBefore:      time.Now().Add(-1 * time.Hour),
+		NotAfter:       time.Now().Add(validity),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		AuthorityKeyId: l.certificate.SubjectKeyId,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, l.certificate, &key.PublicKey, l.key)
+	if err != nil {
+		return nil, err
+	}
+
+	certificatePath, keyPath := l.CertificatePath(domain)
+	err = writeCertificatePair(certificatePath, keyPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadCertificatePair(certificatePath, keyPath)
+}
+
+// issuedByRoot returns whether the certificate on disk was signed by the current root, so certificates from a root
+// which has since been replaced are reissued
+func (l *LocalCertificateAuthority) issuedByRoot(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(certificate.AuthorityKeyId, l.certificate.SubjectKeyId) && certificate.CheckSignatureFrom(l.certificate) == nil
+}
+
+// EnsureCertificates issues a certificate for every domain which doesn't have one, and rotates any which expire within
+// localCaLeafRenewBefore or were issued by a different root. Every failure is returned joined together. Returns
+// whether any certificate was written
+func (l *LocalCertificateAuthority) EnsureCertificates(domains []string) (bool, error) {
+	changed := false
+	failures := make([]error, 0)
+	now := time.Now()
+
+	for _, domain := range domains {
+		if !ValidDomain(domain) {
+			slog.Error("Skipping domain because it is not a valid hostname", "domain", domain)
+			failures = append(failures, fmt.Errorf("invalid domain %q", domain))
+			continue
+		}
+		certificatePath, keyPath := l.CertificatePath(domain)
+		existing, err := ReadCertificatePair(certificatePath, keyPath)
+		if err == nil && existing.NotAfter.Sub(now) > localCaLeafRenewBefore && l.issuedByRoot(certificatePath) {
+			continue
+		}
+
+		pair, err := l.Issue(domain)
+		if err != nil {
+			slog.Error("Failed to issue a certificate from the local certificate authority", "domain", domain, "error", err)
+			failures = append(failures, fmt.Errorf("%v: %w", domain, err))
+			continue
+		}
+
+		slog.Info("Issued a certificate from the local certificate authority", "domain", domain, "expires", pair.NotAfter)
+		changed = true
+	}
+
+	return changed, errors.Join(failures...)
+}
+
+// LocalCaDomains returns the sorted, unique domains of every route which uses the local certificate authority
+func LocalCaDomains(routes []Route) []string {
+	return tlsDomains(filterRoutes(routes, func(route Route) bool { return route.Internal }), true, func(string, string) bool { return true })
+}
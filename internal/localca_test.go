@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyLeaf checks the certificate issued for the domain chains to the root of the authority, wildcards are checked
+// against a name they cover
+func verifyLeaf(t *testing.T, authority *LocalCertificateAuthority, domain string) *x509.Certificate {
+	t.Helper()
+	certificatePath, _ := authority.CertificatePath(domain)
+	data, err := os.ReadFile(certificatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("no certificate in %v", certificatePath)
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.certificate)
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: strings.Replace(domain, "*", "a", 1), Roots: roots}); err != nil {
+		t.Errorf("certificate for %v doesn't chain to the root: %v", domain, err)
+	}
+	return leaf
+}
+
+func TestLoadLocalCertificateAuthority(t *testing.T) {
+	dir := t.TempDir()
+	authority, err := LoadLocalCertificateAuthority(dir)
+	if err != nil {
+		t.Fatalf("LoadLocalCertificateAuthority() error = %v", err)
+	}
+	if !authority.certificate.IsCA || authority.certificate.NotAfter.Before(time.Now().Add(localCaRootValidity-24*time.Hour)) {
+		t.Errorf("root = %+v, want a long lived CA certificate", authority.certificate.Subject)
+	}
+	if info, err := os.Stat(filepath.Join(dir, LocalCaKeyFile)); err != nil || info.Mode().Perm()&0077 != 0 {
+		t.Errorf("root key stat = %v, %v, want a key only the owner can read", info, err)
+	}
+
+	reloaded, err := LoadLocalCertificateAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.certificate.Equal(authority.certificate) {
+		t.Errorf("LoadLocalCertificateAuthority() created a new root instead of loading the existing one")
+	}
+}
+
+func TestLocalCaEnsureCertificates(t *testing.T) {
+	dir := t.TempDir()
+	authority, err := LoadLocalCertificateAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := authority.EnsureCertificates([]string{"nas.lan", "*.media.lan"})
+	if err != nil || !changed {
+		t.Fatalf("EnsureCertificates() = %v, %v, want the certificates issued", changed, err)
+	}
+	issued := verifyLeaf(t, authority, "nas.lan")
+	verifyLeaf(t, authority, "*.media.lan")
+
+	t.Run("current certificates are kept", func(t *testing.T) {
+		changed, err := authority.EnsureCertificates([]string{"nas.lan"})
+		if err != nil || changed {
+			t.Errorf("EnsureCertificates() = %v, %v, want nothing issued", changed, err)
+		}
+		if leaf := verifyLeaf(t, authority, "nas.lan"); !leaf.Equal(issued) {
+			t.Errorf("EnsureCertificates() replaced a certificate which isn't due for rotation")
+		}
+	})
+
+	t.Run("certificates are rotated before they expire", func(t *testing.T) {
+		if _, err := authority.issue("nas.lan", localCaLeafRenewBefore-24*time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		changed, err := authority.EnsureCertificates([]string{"nas.lan"})
+		if err != nil || !changed {
+			t.Fatalf("EnsureCertificates() = %v, %v, want the certificate rotated", changed, err)
+		}
+		if leaf := verifyLeaf(t, authority, "nas.lan"); leaf.NotAfter.Before(time.Now().Add(localCaLeafRenewBefore)) {
+			t.Errorf("rotated certificate expires at %v, want a full validity period", leaf.NotAfter)
+		}
+	})
+
+	t.Run("certificates are reissued when the root is replaced", func(t *testing.T) {
+		for _, name := range []string{LocalCaCertificateFile, LocalCaKeyFile} {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		replaced, err := LoadLocalCertificateAuthority(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certificatePath, _ := replaced.CertificatePath("nas.lan")
+		if replaced.issuedByRoot(certificatePath) {
+			t.Fatalf("issuedByRoot() = true for a certificate from the previous root")
+		}
+
+		changed, err := replaced.EnsureCertificates([]string{"nas.lan"})
+		if err != nil || !changed {
+			t.Fatalf("EnsureCertificates() = %v, %v, want the certificate reissued", changed, err)
+		}
+		verifyLeaf(t, replaced, "nas.lan")
+	})
+
+	t.Run("invalid domains fail", func(t *testing.T) {
+		if _, err := authority.EnsureCertificates([]string{"../root"}); err == nil {
+			t.Errorf("EnsureCertificates() error = nil, want the invalid domain reported")
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"log/slog"
+	"os"
+)
+
+// DefaultMaintenanceFile is where the daemon records which projects are in maintenance, and where bindings read it from
+const DefaultMaintenanceFile = "/var/lib/nqkd/maintenance.json"
+
+// MaintenancePageFile is the name of the default maintenance page written alongside the generated nginx configuration
+const MaintenancePageFile = "nqkd-maintenance.html"
+
+// ReadMaintenanceProjects returns the sorted names of every project in maintenance according to the file. A missing
+// file means no project is in maintenance
+func ReadMaintenanceProjects(path string) ([]string, error) {
+	return readProjectList(path)
+}
+
+// SetProjectMaintenance puts the project into or takes it out of maintenance in the file. Returns whether the file
+// changed
+func SetProjectMaintenance(path string, project string, enabled bool) (bool, error) {
+	return setProjectListed(path, project, enabled)
+}
+
+// ResolveMaintenancePage returns the path of the page named by the maintenance page label in the pages directory, or an
+// empty string to use the default page. Pages are only allowed from the directory so a label can't serve arbitrary files
+func ResolveMaintenancePage(labels map[string]string, port uint16, pagesDir string) string {
+	name := GetLabelForPort(labels, LabelGlobalMaintenancePage, LabelPortMaintenancePage, port)
+	if name == nil {
+		return ""
+	}
+	if pagesDir == "" {
+		slog.Error("Using the default maintenance page because no pages directory has been provided, use --maintenance-pages", "page", *name, "port", port)
+		return ""
+	}
+
+	path, err := safeFilePath(pagesDir, *name, "maintenance page")
+	if err != nil {
+		slog.Error("Using the default maintenance page", "page", *name, "port", port, "error", err)
+		return ""
+	}
+	if _, err := os.Stat(path); err != nil {
+		slog.Warn("The maintenance page does not exist, nginx will answer with its own error page until it is created", "file", path, "port", port)
+	}
+	return path
+}
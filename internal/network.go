@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// LabelManagedNetwork marks docker networks created by nqk, so they can be told apart from networks made by hand
+const LabelManagedNetwork = "org.xiomi.nqkd.network"
+
+// EnsureNetwork creates the named bridge network if it doesn't already exist. A network of the same name which nqk
+// didn't create is used as it is, so an existing network can be shared with nqk
+func EnsureNetwork(cli *client.Client, dctx context.Context, name string) error {
+	_, err := cli.NetworkInspect(dctx, name, types.NetworkInspectOptions{})
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		slog.Error("Failed to inspect the network", "network", name, "error", err)
+		return err
+	}
+
+	_, err = cli.NetworkCreate(dctx, name, types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         "bridge",
+		Labels:         map[string]string{LabelManagedNetwork: "true"},
+	})
+	if err != nil {
+		slog.Error("Failed to create the network", "network", name, "error", err)
+		return err
+	}
+
+	slog.Info("Created the network for proxying to containers", "network", name)
+	return nil
+}
+
+// routedContainer returns whether the labels of a container have any nqk label, only these containers are attached to
+// the network as the rest of the project (ie databases) has nothing for the proxy to reach
+func routedContainer(labels map[string]string) bool {
+	for label := range labels {
+		if strings.HasPrefix(label, LabelPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectContainer attaches the container to the network if it has any nqk labels and isn't already attached. The
+// labels are those of the container, as reported by the docker event or container list
+func ConnectContainer(cli *client.Client, dctx context.Context, network string, container string, labels map[string]string) error {
+	if !routedContainer(labels) {
+		return nil
+	}
+
+	inspect, err := cli.ContainerInspect(dctx, container)
+	if err != nil {
+		slog.Error("Failed to inspect container to attach it to the network", "container", container, "network", network, "error", err)
+		return err
+	}
+	if inspect.NetworkSettings != nil {
+		if _, attached := inspect.NetworkSettings.Networks[network]; attached {
+			return nil
+		}
+	}
+
+	err = cli.NetworkConnect(dctx, network, container, nil)
+	if err != nil {
+		slog.Error("Failed to attach container to the network", "container", container, "network", network, "error", err)
+		return err
+	}
+
+	slog.Info("Attached container to the network", "container", container, "network", network)
+	return nil
+}
+
+// ConnectProjectContainers attaches every running container in the project with any nqk labels to the network, see
+// ConnectContainer. Every container is attempted and the last error is returned
+func ConnectProjectContainers(cli *client.Client, dctx context.Context, network string, project string) error {
+	list, err := cli.ContainerList(dctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(
+			filters.KeyValuePair{
+				Key:   "label",
+				Value: LabelComposeProject + "=" + project,
+			}),
+	})
+	if err != nil {
+		slog.Error("Failed to list containers to attach them to the network", "project", project, "network", network, "error", err)
+		return err
+	}
+
+	var result error
+	for _, container := range list {
+		if err := ConnectContainer(cli, dctx, network, container.ID, container.Labels); err != nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// NetworkGateway returns the IPv4 gateway of the network, which is the address the host can be reached at from
+// containers attached to it
+func NetworkGateway(cli *client.Client, dctx context.Context, name string) (string, error) {
+	inspect, err := cli.NetworkInspect(dctx, name, types.NetworkInspectOptions{})
+	if err != nil {
+		slog.Error("Failed to inspect the network", "network", name, "error", err)
+		return "", err
+	}
+
+	for _, config := range inspect.IPAM.Config {
+		if ip := net.ParseIP(config.Gateway); ip != nil && ip.To4() != nil {
+			return config.Gateway, nil
+		}
+	}
+	return "", errors.New("network " + name + " has no IPv4 gateway")
+}
+
+// NetworkSubnets returns the subnets of the docker network with the given name, which containers on it have their
+// addresses in
+func NetworkSubnets(cli *client.Client, dctx context.Context, name string) ([]string, error) {
+	inspect, err := cli.NetworkInspect(dctx, name, types.NetworkInspectOptions{})
+	if err != nil {
+		slog.Error("Failed to inspect the network", "network", name, "error", err)
+		return nil, err
+	}
+
+	subnets := make([]string, 0, len(inspect.IPAM.Config))
+	for _, config := range inspect.IPAM.Config {
+		if config.Subnet != "" {
+			subnets = append(subnets, config.Subnet)
+		}
+	}
+	return subnets, nil
+}
+
+// WakerAddressOnNetwork returns the address of the waker as seen from containers on a network with the gateway. The
+// waker usually listens on loopback, which a proxy in a container can't reach, so a loopback host is replaced with the
+// gateway and any other address is returned as it is
+func WakerAddressOnNetwork(address string, gateway string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return address, nil
+	}
+	return net.JoinHostPort(gateway, port), nil
+}
+
+// resolveUpstreamAddress returns where traffic for the port is sent: its published host port, or its address on the
+// network if the container is attached to one. Returns false if the port should be skipped because it can't be reached,
+// or because it isn't published and has no type or domain label of its own while on the network. Asleep containers
+// are stopped so have no address, but their routes are sent to the waker rather than upstream
+func resolveUpstreamAddress(port BindingPortMapping, labels portLabels, networkAddress string, asleep bool, config BindingConfiguration) (RouteUpstream, bool) {
+	if networkAddress == "" {
+		if port.HostPort == 0 && !asleep {
+			slog.Debug("Skipping port because it is not published on the host", "network", config.Network, "port", port, "container", labels.container)
+			return RouteUpstream{}, false
+		}
+		return RouteUpstream{Host: port.Binding, Port: port.HostPort}, true
+	}
+
+	// images expose admin, metrics and database ports too, so unpublished ports are only routed when asked for
+	if port.HostPort == 0 && labels.get("", LabelPortType) == nil && labels.get("", LabelPortDomain) == nil {
+		slog.Debug("Skipping port because it is not published and has no type or domain label of its own", "network", config.Network, "port", port, "container", labels.container)
+		return RouteUpstream{}, false
+	}
+	return RouteUpstream{Host: networkAddress, Port: port.ContainerPort}, true
+}
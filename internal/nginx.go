@@ -2,7 +2,15 @@ package internal
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // ValidateNginx will execute the provided nginx executable with the `-t` flag which should validate the config
@@ -12,10 +20,11 @@ func ValidateNginx(executable string) (bool, error) {
 	var validationOutputBuffer bytes.Buffer
 	validateCmd := Run(executable, "-t")
 	validateCmd.Stdout = &validationOutputBuffer
+	validateCmd.Stderr = &validationOutputBuffer
 
 	err := validateCmd.Run()
 	if err != nil {
-		slog.Error("Failed to validate the config due to an error. This means the config may not have validated", "error", err, "stdout", validationOutputBuffer.String())
+		slog.Error("Failed to validate the config due to an error. This means the config may not have validated", "error", err, "output", validationOutputBuffer.String())
 		return false, err
 	}
 
@@ -39,3 +48,410 @@ func RelaunchNginx(service string) error {
 
 	return nil
 }
+
+const (
+	// NginxReloadService restarts nginx through /usr/sbin/service, this drops in-flight connections so it isn't the
+	// default
+	NginxReloadService = "service"
+	// NginxReloadSignal reloads nginx with `nginx -s reload`
+	NginxReloadSignal = "nginx"
+	// NginxReloadSystemctl reloads nginx with `systemctl reload`
+	NginxReloadSystemctl = "systemctl"
+	// NginxReloadPid reloads nginx by sending SIGHUP to the master process recorded in a pid file
+	NginxReloadPid = "pid"
+	// NginxReloadDocker reloads nginx running in a container with `docker kill -s HUP`
+	NginxReloadDocker = "docker"
+)
+
+// NginxReloadConfiguration describes how nginx should be validated and told to pick up a new configuration
+type NginxReloadConfiguration struct {
+	// Strategy is how nginx is reloaded, one of the NginxReload* constants
+	Strategy string
+	// Executable is the nginx executable used for validation and the NginxReloadSignal strategy. If empty, and nginx
+	// is not running in docker, nginx is neither validated nor reloaded
+	Executable string
+	// Service is the name of the service for the NginxReloadService and NginxReloadSystemctl strategies
+	Service string
+	// PidFile is the file containing the pid of the nginx master process, used to confirm reloads and restarts
+	PidFile string
+	// Container is the name of the container running nginx for the NginxReloadDocker strategy
+	Container string
+	// Timeout is how long to wait for nginx to start new workers before the reload is considered rejected
+	Timeout time.Duration
+	// MainConfig is the main nginx config file. A copy of it pointing at the staged files is validated before they are
+	// swapped in, if it is empty or doesn't refer to the output directory the files are validated once swapped in
+	MainConfig string
+}
+
+// CanReload returns whether there is enough configuration to validate and reload nginx
+func (n NginxReloadConfiguration) CanReload() bool {
+	return n.Executable != "" || n.Strategy == NginxReloadDocker
+}
+
+// ValidateNginxConfiguration validates the config on disk with ValidateNginx, or for nginx running in docker by running
+// `nginx -t` inside the container
+func ValidateNginxConfiguration(config NginxReloadConfiguration) (bool, error) {
+	if config.Strategy != NginxReloadDocker {
+		return ValidateNginx(config.Executable)
+	}
+
+	out, err := Run("docker", "exec", config.Container, "nginx", "-t").CombinedOutput()
+	if err != nil {
+		slog.Error("Failed to validate the config due to an error. This means the config may not have validated", "error", err, "output", string(out))
+		return false, err
+	}
+
+	return true, nil
+}
+
+// nginxValidationSuffix is added to the main nginx config file to name the copy of it used to validate staged files
+const nginxValidationSuffix = ".nqkd-validate"
+
+// relocateFiles returns the files with every reference to a path in dir pointing at the same path in target instead
+func relocateFiles(files map[string]string, dir string, target string) map[string]string {
+	result := make(map[string]string, len(files))
+	for name, content := range files {
+		result[name] = strings.ReplaceAll(content, dir+"/", target+"/")
+	}
+	return result
+}
+
+// ValidateStagedNginx validates the staged files before they are swapped in by running `nginx -t -c` against a copy
+// of the main config, written next to it so relative includes still resolve, in which every reference to the output
+// directory points at the staged directory instead. The staged files are rewritten the same way while validating and
+// put back afterwards. Returns false without an error if the staged files can't be validated this way (nginx runs in
+// docker, or the main config can't be read, doesn't refer to the output directory or its directory isn't writable), in
+// which case the files have to be validated once swapped in
+func ValidateStagedNginx(files map[string]string, staged *StagedFileSet, config NginxReloadConfiguration) (bool, error) {
+	if config.Strategy == NginxReloadDocker || config.MainConfig == "" || config.Executable == "" {
+		return false, nil
+	}
+	dir, target := staged.Dir, staged.Staged
+	main, err := os.ReadFile(config.MainConfig)
+	if err != nil {
+		slog.Warn("Failed to read the main nginx config, the generated files will be validated once swapped in", "config", config.MainConfig, "error", err)
+		return false, nil
+	}
+	if !strings.Contains(string(main), dir+"/") {
+		slog.Warn("The main nginx config doesn't include the output directory directly, the generated files will be validated once swapped in", "config", config.MainConfig, "dir", dir)
+		return false, nil
+	}
+
+	copied := config.MainConfig + nginxValidationSuffix
+	err = os.WriteFile(copied, []byte(strings.ReplaceAll(string(main), dir+"/", target+"/")), 0644)
+	if err != nil {
+		slog.Warn("Failed to write the nginx config used for validation, the generated files will be validated once swapped in", "config", copied, "error", err)
+		return false, nil
+	}
+	defer os.Remove(copied)
+
+	err = staged.Write(relocateFiles(files, dir, target))
+	if err != nil {
+		return false, err
+	}
+
+	var output bytes.Buffer
+	validateCmd := Run(config.Executable, "-t", "-c", copied)
+	validateCmd.Stdout = &output
+	validateCmd.Stderr = &output
+	validateErr := validateCmd.Run()
+
+	err = staged.Write(files)
+	if err != nil {
+		return false, err
+	}
+	if validateErr != nil {
+		slog.Error("The staged nginx config is invalid", "error", validateErr, "output", output.String())
+		return false, validateErr
+	}
+
+	return true, nil
+}
+
+// readPidFile returns the pid recorded in the given pid file
+func readPidFile(pidFile string) (int, error) {
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// nginxMasterPid finds the pid of the nginx master process for the strategy. For systemctl this is the MainPID of the
+// service, otherwise it is read from the pid file. Not used for docker
+func nginxMasterPid(config NginxReloadConfiguration) (int, error) {
+	if config.Strategy == NginxReloadSystemctl {
+		out, err := Run("systemctl", "show", "-p", "MainPID", "--value", config.Service).Output()
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(strings.TrimSpace(string(out)))
+	}
+
+	return readPidFile(config.PidFile)
+}
+
+// nginxWorkers returns the pids of every nginx worker process, mapped to whether the worker is shutting down. For
+// docker these are read from `docker top`, otherwise they are the children of the master process found through /proc
+func nginxWorkers(config NginxReloadConfiguration, master int) (map[string]bool, error) {
+	if config.Strategy == NginxReloadDocker {
+		out, err := Run("docker", "top", config.Container, "-eo", "pid,args").Output()
+		if err != nil {
+			return nil, err
+		}
+		return parseTopWorkers(string(out)), nil
+	}
+
+	return procWorkers("/proc", master)
+}
+
+// parseTopWorkers returns the nginx workers listed in the output of `docker top -eo pid,args`, mapped to whether the
+// worker is shutting down
+func parseTopWorkers(out string) map[string]bool {
+	workers := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && strings.Contains(line, "worker process") {
+			workers[fields[0]] = strings.Contains(line, "shutting down")
+		}
+	}
+	return workers
+}
+
+// procWorkers returns the nginx workers which are children of the master process in the proc filesystem mounted at
+// proc, mapped to whether the worker is shutting down
+func procWorkers(proc string, master int) (map[string]bool, error) {
+	workers := make(map[string]bool)
+
+	entries, err := os.ReadDir(proc)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+
+		stat, err := os.ReadFile(filepath.Join(proc, entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// the command in the stat file is wrapped in brackets and may contain spaces, the parent pid is the second
+		// field after it
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) < 2 || fields[1] != strconv.Itoa(master) {
+			continue
+		}
+
+		cmdline, err := os.ReadFile(filepath.Join(proc, entry.Name(), "cmdline"))
+		if err == nil && strings.Contains(string(cmdline), "worker process") {
+			workers[entry.Name()] = strings.Contains(string(cmdline), "shutting down")
+		}
+	}
+
+	return workers, nil
+}
+
+// reloadAccepted returns whether the workers show nginx accepted a new configuration since before was listed. Nginx
+// starts a new generation of workers and gracefully shuts down every previous one when it accepts a configuration,
+// and leaves the previous ones running when it rejects it, so a worker respawned after a crash isn't mistaken for a
+// reload
+func reloadAccepted(before map[string]bool, after map[string]bool) bool {
+	started := false
+	for worker, shuttingDown := range after {
+		if shuttingDown {
+			continue
+		}
+		if _, existed := before[worker]; !existed {
+			started = true
+		} else if !before[worker] {
+			// a worker from the previous generation is still serving
+			return false
+		}
+	}
+	return started
+}
+
+// confirmRestart waits for the nginx master recorded in the pid file to be replaced by a running process with workers
+// after a restart. The previous master pid may be 0 if it wasn't known
+func confirmRestart(config NginxReloadConfiguration, previous int) error {
+	deadline := time.Now().Add(config.Timeout)
+	for time.Now().Before(deadline) {
+		master, err := readPidFile(config.PidFile)
+		if err == nil && master != previous && syscall.Kill(master, 0) == nil {
+			workers, err := nginxWorkers(config, master)
+			if err == nil && len(workers) > 0 {
+				slog.Info("Nginx restarted with the new configuration", "master", master)
+				return nil
+			}
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	return errors.New("nginx did not come back up after restarting")
+}
+
+// nginxReloadCommand returns the command which reloads nginx for the strategy, or nil for NginxReloadPid which signals
+// the master process directly
+func nginxReloadCommand(config NginxReloadConfiguration) ([]string, error) {
+	switch config.Strategy {
+	case NginxReloadSignal:
+		if config.Executable == "" {
+			return nil, errors.New("the signal reload strategy needs the nginx executable")
+		}
+		return []string{config.Executable, "-s", "reload"}, nil
+	case NginxReloadSystemctl:
+		return []string{"systemctl", "reload", config.Service}, nil
+	case NginxReloadDocker:
+		return []string{"docker", "kill", "-s", "HUP", config.Container}, nil
+	case NginxReloadPid:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown nginx reload strategy %v", config.Strategy)
+	}
+}
+
+// awaitReload polls the workers listed by workers until reloadAccepted confirms a new generation replaced before, and
+// returns false if that doesn't happen within the timeout
+func awaitReload(before map[string]bool, timeout time.Duration, workers func() (map[string]bool, error)) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		after, err := workers()
+		if err == nil && reloadAccepted(before, after) {
+			slog.Info("Nginx accepted the new configuration", "workers", len(after))
+			return true
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return false
+}
+
+// ReloadNginx tells nginx to pick up the configuration on disk using the configured strategy. Reloads are confirmed by
+// waiting for nginx to replace its workers (see reloadAccepted), and NginxReloadService restarts by waiting for a new
+// master process with workers in the pid file. If nginx isn't confirmed within the timeout an error is returned
+func ReloadNginx(config NginxReloadConfiguration) error {
+	if config.Strategy == "" {
+		config.Strategy = NginxReloadSignal
+	}
+	if config.Strategy == NginxReloadService {
+		previous, err := readPidFile(config.PidFile)
+		if err != nil {
+			slog.Debug("Failed to read the nginx pid file before restarting", "file", config.PidFile, "error", err)
+		}
+		err = RelaunchNginx(config.Service)
+		if err != nil {
+			return err
+		}
+		return confirmRestart(config, previous)
+	}
+
+	master := 0
+	if config.Strategy != NginxReloadDocker {
+		pid, err := nginxMasterPid(config)
+		if err != nil {
+			slog.Error("Failed to find the nginx master process", "strategy", config.Strategy, "error", err)
+			return err
+		}
+		master = pid
+	}
+
+	before, err := nginxWorkers(config, master)
+	if err != nil {
+		slog.Warn("Failed to list nginx workers, the reload can't be confirmed", "error", err)
+	}
+
+	command, err := nginxReloadCommand(config)
+	if err != nil {
+		return err
+	}
+	if command != nil {
+		out, cmdErr := Run(command[0], command[1:]...).CombinedOutput()
+		if cmdErr != nil {
+			slog.Error("Failed to reload nginx due to an error!", "error", cmdErr, "output", string(out))
+		}
+		err = cmdErr
+	} else {
+		slog.Debug("Sending SIGHUP to nginx", "pid", master)
+		err = syscall.Kill(master, syscall.SIGHUP)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(before) == 0 {
+		slog.Warn("No nginx workers were found before reloading, the reload can't be confirmed")
+		return nil
+	}
+
+	if awaitReload(before, config.Timeout, func() (map[string]bool, error) { return nginxWorkers(config, master) }) {
+		return nil
+	}
+
+	return errors.New("nginx did not replace its workers after reloading, it likely rejected the configuration")
+}
+
+// ApplyNginxFileSet transactionally applies the generated files to the nginx output directory. The files are staged in
+// a sibling directory with StageFileSet and, if nginx can be reloaded (see CanReload), validated there with
+// ValidateStagedNginx before the directory is swapped in. Nginx is then reloaded with ReloadNginx. Files which can't
+// be validated before the swap are validated once swapped in with ValidateNginxConfiguration instead. If validation or
+// the reload fails the previous directory is restored (and nginx reloaded onto it if the reload was what failed) and
+// the failure is returned, so a broken config never stays on disk. Returns whether the live directory was changed
+func ApplyNginxFileSet(files map[string]string, dir string, reload NginxReloadConfiguration) (bool, error) {
+	staged, err := StageFileSet(files, dir)
+	if err != nil {
+		slog.Error("Failed to stage the nginx configuration, no files were changed", "error", err)
+		return false, err
+	}
+
+	if !staged.Changed {
+		return false, nil
+	}
+
+	if !reload.CanReload() {
+		slog.Info("Can't validate or handle automatic restarts because no executable has been provided")
+		if err := staged.Swap(); err != nil {
+			return false, err
+		}
+		return true, staged.Commit()
+	}
+
+	validated, err := ValidateStagedNginx(files, staged, reload)
+	if err != nil {
+		slog.Error("The generated config is invalid, keeping the previous config", "error", err)
+		staged.Discard()
+		return false, err
+	}
+
+	err = staged.Swap()
+	if err != nil {
+		return false, err
+	}
+
+	if !validated {
+		if ok, err := ValidateNginxConfiguration(reload); !ok || err != nil {
+			slog.Error("The generated config is invalid, restoring the previous config", "ok", ok, "error", err)
+			if rollbackErr := staged.Rollback(); rollbackErr != nil {
+				return true, rollbackErr
+			}
+			if err == nil {
+				err = errors.New("generated nginx configuration is invalid")
+			}
+			return false, err
+		}
+	}
+
+	err = ReloadNginx(reload)
+	if err != nil {
+		slog.Error("The config was valid but nginx failed to reload, restoring the previous config", "error", err)
+		if rollbackErr := staged.Rollback(); rollbackErr != nil {
+			return true, rollbackErr
+		}
+		if relaunchErr := ReloadNginx(reload); relaunchErr != nil {
+			slog.Error("Failed to relaunch nginx on the previous config!", "error", relaunchErr)
+		}
+		return false, err
+	}
+
+	return true, staged.Commit()
+}
@@ -0,0 +1,335 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadAccepted(t *testing.T) {
+	tests := []struct {
+		name   string
+		before map[string]bool
+		after  map[string]bool
+		want   bool
+	}{
+		{
+			name:   "new generation with the old one shutting down",
+			before: map[string]bool{"10": false, "11": false},
+			after:  map[string]bool{"10": true, "11": true, "20": false, "21": false},
+			want:   true,
+		},
+		{
+			name:   "new generation once the old one has exited",
+			before: map[string]bool{"10": false, "11": false},
+			after:  map[string]bool{"20": false, "21": false},
+			want:   true,
+		},
+		{
+			name:   "rejected configuration keeps the old workers",
+			before: map[string]bool{"10": false, "11": false},
+			after:  map[string]bool{"10": false, "11": false},
+			want:   false,
+		},
+		{
+			name:   "worker respawned after a crash",
+			before: map[string]bool{"10": false, "11": false},
+			after:  map[string]bool{"10": false, "20": false},
+			want:   false,
+		},
+		{
+			name:   "workers still shutting down from an earlier reload",
+			before: map[string]bool{"5": true, "10": false},
+			after:  map[string]bool{"5": true, "10": true, "20": false},
+			want:   true,
+		},
+		{
+			name:   "old workers shutting down but no new ones yet",
+			before: map[string]bool{"10": false},
+			after:  map[string]bool{"10": true},
+			want:   false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := reloadAccepted(test.before, test.after); got != test.want {
+				t.Errorf("reloadAccepted() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNginxReloadStrategy(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        NginxReloadConfiguration
+		wantCommand   []string
+		wantCanReload bool
+		wantErr       bool
+	}{
+		{
+			name:          "signal",
+			config:        NginxReloadConfiguration{Strategy: NginxReloadSignal, Executable: "nginx"},
+			wantCommand:   []string{"nginx", "-s", "reload"},
+			wantCanReload: true,
+		},
+		{
+			name:    "signal without an executable",
+			config:  NginxReloadConfiguration{Strategy: NginxReloadSignal},
+			wantErr: true,
+		},
+		{
+			name:          "systemctl",
+			config:        NginxReloadConfiguration{Strategy: NginxReloadSystemctl, Executable: "nginx", Service: "nginx"},
+			wantCommand:   []string{"systemctl", "reload", "nginx"},
+			wantCanReload: true,
+		},
+		{
+			name:          "docker without an executable",
+			config:        NginxReloadConfiguration{Strategy: NginxReloadDocker, Container: "proxy"},
+			wantCommand:   []string{"docker", "kill", "-s", "HUP", "proxy"},
+			wantCanReload: true,
+		},
+		{
+			name:          "pid signals the master directly",
+			config:        NginxReloadConfiguration{Strategy: NginxReloadPid, Executable: "nginx"},
+			wantCanReload: true,
+		},
+		{
+			name:    "unknown",
+			config:  NginxReloadConfiguration{Strategy: "kill"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.config.CanReload(); got != test.wantCanReload {
+				t.Errorf("CanReload() = %v, want %v", got, test.wantCanReload)
+			}
+			command, err := nginxReloadCommand(test.config)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("nginxReloadCommand() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !slices.Equal(command, test.wantCommand) {
+				t.Errorf("nginxReloadCommand() = %v, want %v", command, test.wantCommand)
+			}
+		})
+	}
+}
+
+func TestNginxWorkers(t *testing.T) {
+	t.Run("docker top", func(t *testing.T) {
+		out := "PID                 COMMAND\n" +
+			"100                 nginx: master process nginx -g daemon off;\n" +
+			"101                 nginx: worker process\n" +
+			"102                 nginx: worker process is shutting down\n"
+		got := parseTopWorkers(out)
+		if len(got) != 2 || got["101"] || !got["102"] {
+			t.Errorf("parseTopWorkers() = %v, want 101 serving and 102 shutting down", got)
+		}
+	})
+
+	t.Run("proc", func(t *testing.T) {
+		proc := t.TempDir()
+		process := func(pid string, parent string, cmdline string) {
+			writeTree(t, filepath.Join(proc, pid), map[string]string{
+				"stat":    fmt.Sprintf("%v (nginx: a b) S %v 1 1", pid, parent),
+				"cmdline": cmdline,
+			})
+		}
+		process("100", "1", "nginx: master process")
+		process("101", "100", "nginx: worker process")
+		process("102", "100", "nginx: worker process is shutting down")
+		process("200", "1", "nginx: worker process")
+		writeTree(t, filepath.Join(proc, "self"), map[string]string{"stat": "1 (x) S 100"})
+
+		got, err := procWorkers(proc, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 2 || got["101"] || !got["102"] {
+			t.Errorf("procWorkers() = %v, want only the children of the master", got)
+		}
+	})
+}
+
+func TestAwaitReload(t *testing.T) {
+	before := map[string]bool{"101": false}
+	tests := []struct {
+		name        string
+		generations []map[string]bool
+		want        bool
+	}{
+		{
+			name:        "new generation after a few polls",
+			generations: []map[string]bool{before, {"101": true, "201": false}, {"201": false}},
+			want:        true,
+		},
+		{
+			name:        "old generation keeps serving",
+			generations: []map[string]bool{before},
+		},
+		{
+			name:        "crashed worker respawned",
+			generations: []map[string]bool{{"101": false, "102": false}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			polls := 0
+			workers := func() (map[string]bool, error) {
+				generation := test.generations[min(polls, len(test.generations)-1)]
+				polls++
+				return generation, nil
+			}
+			if got := awaitReload(before, time.Second, workers); got != test.want {
+				t.Errorf("awaitReload() = %v after %v polls, want %v", got, polls, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateStagedNginx(t *testing.T) {
+	tests := []struct {
+		name    string
+		main    string
+		exit    int
+		want    bool
+		wantErr bool
+	}{
+		{name: "valid staged config", main: "http { include %v/nqkd-http.include; }\n", want: true},
+		{name: "invalid staged config", main: "http { include %v/nqkd-http.include; }\n", exit: 1, wantErr: true},
+		{name: "output directory not included directly", main: "include /etc/nginx/conf.d/*.conf;\n%v"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "nqkd")
+			writeTree(t, dir, map[string]string{"http.d/a.conf": "old"})
+			files := map[string]string{
+				"nqkd-http.include": "include " + dir + "/http.d/*.conf;\n",
+				"http.d/a.conf":     "new",
+			}
+			staged, err := StageFileSet(files, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer staged.Discard()
+
+			// the fake nginx records the config it was asked to test and the staged include it loads
+			main := filepath.Join(root, "nginx.conf")
+			log := filepath.Join(root, "validated")
+			executable := filepath.Join(root, "nginx")
+			script := fmt.Sprintf("#!/bin/sh\ncat \"$3\" %v/nqkd-http.include > %v\nexit %v\n", staged.Staged, log, test.exit)
+			writeTree(t, root, map[string]string{"nginx": script, "nginx.conf": fmt.Sprintf(test.main, dir)})
+			if err := os.Chmod(executable, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ValidateStagedNginx(files, staged, NginxReloadConfiguration{Strategy: NginxReloadSignal, Executable: executable, MainConfig: main})
+			if got != test.want || (err != nil) != test.wantErr {
+				t.Fatalf("ValidateStagedNginx() = %v, %v, want %v with error %v", got, err, test.want, test.wantErr)
+			}
+			if !test.want && !test.wantErr {
+				return
+			}
+
+			validated, err := os.ReadFile(log)
+			if err != nil {
+				t.Fatalf("nginx was not run: %v", err)
+			}
+			if strings.Contains(string(validated), dir+"/") || strings.Count(string(validated), staged.Staged+"/") != 2 {
+				t.Errorf("validated config = %q, want every reference to the output directory pointing at the staged one", validated)
+			}
+			stagedFiles := readTree(t, staged.Staged)
+			delete(stagedFiles, ManifestFile)
+			if !equalTree(stagedFiles, files) {
+				t.Errorf("staged files = %v, want them put back to %v", stagedFiles, files)
+			}
+			if live := readTree(t, dir)["http.d/a.conf"]; live != "old" {
+				t.Errorf("live file = %q, want it untouched by validation", live)
+			}
+			if _, err := os.Stat(main + nginxValidationSuffix); err == nil {
+				t.Errorf("left behind the config used for validation")
+			}
+		})
+	}
+}
+
+func TestNginxProtocolsOutput(t *testing.T) {
+	secure := func(domain string, options ...func(route *Route)) Route {
+		options = append([]func(route *Route){onPort(443), withTls("/etc/ssl/" + domain + ".crt")}, options...)
+		return testRoute(domain, domain, 8080, options...)
+	}
+	http2 := func(route *Route) { route.Http2 = true }
+	quic := func(route *Route) { route.Quic = true }
+
+	tests := []struct {
+		name    string
+		routes  []Route
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "grpc",
+			routes:  []Route{testRoute("shop", "example.com", 8080, withProtocol(ValueTypeGrpc), http2)},
+			want:    []string{"http2 on;", "grpc_pass grpc://nqkd_shop_web_80;", "grpc_set_header Host $host;"},
+			notWant: []string{"proxy_pass", "proxy_set_header Upgrade"},
+		},
+		{
+			name:   "grpcs",
+			routes: []Route{testRoute("shop", "example.com", 8080, withProtocol(ValueTypeGrpcs), http2)},
+			want:   []string{"grpc_pass grpcs://nqkd_shop_web_80;"},
+		},
+		{
+			name:    "h2c",
+			routes:  []Route{testRoute("shop", "example.com", 8080, withProtocol(ValueTypeH2c))},
+			want:    []string{"grpc_pass grpc://nqkd_shop_web_80;"},
+			notWant: []string{"http2 on;", "proxy_pass"},
+		},
+		{
+			name:    "http keeps websocket upgrades",
+			routes:  []Route{testRoute("shop", "example.com", 8080)},
+			want:    []string{"proxy_pass http://nqkd_shop_web_80;", "proxy_set_header Upgrade $http_upgrade;"},
+			notWant: []string{"http2 on;", "grpc_pass", "quic"},
+		},
+		{
+			name:   "http2 on tls",
+			routes: []Route{secure("example.com", http2)},
+			want:   []string{"listen 0.0.0.0:443 ssl;\n    http2 on;"},
+		},
+		{
+			name:   "quic",
+			routes: []Route{secure("example.com", quic)},
+			want:   []string{"listen 0.0.0.0:443 quic reuseport;", "add_header Alt-Svc 'h3=\":443\"; ma=86400' always;"},
+		},
+		{
+			name:   "quic on both stacks",
+			routes: []Route{secure("example.com", quic, func(route *Route) { route.DualStack = true })},
+			want:   []string{"listen [::]:443 ssl;", "listen [::]:443 quic reuseport;"},
+		},
+		{
+			name:   "quic reuseport is only set once per listener",
+			routes: []Route{secure("a.example.com", quic), secure("b.example.com", quic)},
+			want:   []string{"listen 0.0.0.0:443 quic reuseport;", "listen 0.0.0.0:443 quic;"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := renderNginx(t, BindingConfiguration{}, test.routes...)
+			expectContent(t, "GenerateFilesForNginxRoutes()", got, test.want, test.notWant)
+			if count := strings.Count(got, "listen 0.0.0.0:443 quic reuseport"); count > 1 {
+				t.Errorf("quic reuseport is set %v times, nginx only allows it once per address", count)
+			}
+		})
+	}
+}
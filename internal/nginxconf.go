@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// NginxHttpDir is the subdirectory of the nginx output directory containing files for the http block
+	NginxHttpDir = "http.d"
+	// NginxStreamDir is the subdirectory of the nginx output directory containing files for the stream block
+	NginxStreamDir = "stream.d"
+)
+
+// nginxStatement is a directive or block opening in an nginx config file
+type nginxStatement struct {
+	// Words are the directive name followed by its arguments, with quotes removed
+	Words []string
+	// Block is "{" if the statement opens a block, "}" if it closes one and ";" for a plain directive
+	Block string
+	// Line is the line of the file the statement ends on
+	Line int
+}
+
+// parseNginxStatements splits an nginx config file into its statements. This only understands enough of the syntax to
+// follow blocks and includes, comments and quoted arguments are handled but variables and escapes are passed through
+func parseNginxStatements(content string) ([]nginxStatement, error) {
+	statements := make([]nginxStatement, 0)
+	words := make([]string, 0)
+	line := 1
+
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '\n':
+			line++
+		case c == ' ' || c == '\t' || c == '\r':
+		case c == '#':
+			for i < len(content) && content[i] != '\n' {
+				i++
+			}
+			i--
+		case c == ';' || c == '{' || c == '}':
+			if c == '}' && len(words) > 0 {
+				return nil, fmt.Errorf("line %v: unexpected } before ;", line)
+			}
+			statements = append(statements, nginxStatement{Words: words, Block: string(c), Line: line})
+			words = make([]string, 0)
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(content) && content[end] != c {
+				if content[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(content) {
+				return nil, fmt.Errorf("line %v: unterminated quote", line)
+			}
+			words = append(words, content[i+1:end])
+			line += strings.Count(content[i:end], "\n")
+			i = end
+		default:
+			end := i
+			for end < len(content) && !strings.ContainsRune(" \t\r\n;{}#\"'", rune(content[end])) {
+				end++
+			}
+			words = append(words, content[i:end])
+			i = end - 1
+		}
+	}
+
+	if len(words) > 0 {
+		return nil, fmt.Errorf("line %v: unexpected end of file before ;", line)
+	}
+	return statements, nil
+}
+
+// nginxIncludeCheck is the state of CheckNginxIncludes as it follows includes through the config
+type nginxIncludeCheck struct {
+	prefix   string
+	http     string
+	stream   string
+	visited  map[string]bool
+	found    map[string]bool
+	problems []error
+}
+
+// walk checks every statement in the file, following includes into their files with the block they were included from
+func (c *nginxIncludeCheck) walk(file string, blocks []string) {
+	if c.visited[file] {
+		return
+	}
+	c.visited[file] = true
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		c.problems = append(c.problems, fmt.Errorf("could not read %v: %w", file, err))
+		return
+	}
+	statements, err := parseNginxStatements(string(data))
+	if err != nil {
+		c.problems = append(c.problems, fmt.Errorf("could not parse %v: %w", file, err))
+		return
+	}
+
+	stack := append(make([]string, 0, len(blocks)), blocks...)
+	for _, statement := range statements {
+		context := "main"
+		if len(stack) > 0 {
+			context = stack[len(stack)-1]
+		}
+
+		switch statement.Block {
+		case "{":
+			name := ""
+			if len(statement.Words) > 0 {
+				name = statement.Words[0]
+			}
+			if (name == "http" || name == "stream") && context != "main" {
+				c.problems = append(c.problems, fmt.Errorf("%v:%v: the %v block is inside %v, it must be at the top level", file, statement.Line, name, context))
+			}
+			stack = append(stack, name)
+		case "}":
+			if len(stack) > len(blocks) {
+				stack = stack[:len(stack)-1]
+			}
+		case ";":
+			if len(statement.Words) != 2 || statement.Words[0] != "include" {
+				continue
+			}
+			pattern := statement.Words[1]
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(c.prefix, pattern)
+			}
+
+			for _, target := range []struct{ dir, block string }{{c.http, "http"}, {c.stream, "stream"}} {
+				if matched, _ := filepath.Match(pattern, filepath.Join(target.dir, "nqkd.conf")); !matched {
+					continue
+				}
+				if context == target.block {
+					c.found[target.block] = true
+				} else {
+					c.problems = append(c.problems, fmt.Errorf("%v:%v: %v is included from the %v context, it must be included from the %v block", file, statement.Line, target.dir, context, target.block))
+				}
+			}
+
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				c.problems = append(c.problems, fmt.Errorf("%v:%v: invalid include %v: %w", file, statement.Line, pattern, err))
+				continue
+			}
+			for _, match := range matches {
+				if filepath.Dir(match) == c.http || filepath.Dir(match) == c.stream {
+					continue
+				}
+				c.walk(match, stack)
+			}
+		}
+	}
+}
+
+// CheckNginxIncludes follows the main nginx config file and everything it includes to check that the files generated
+// into dir are loaded from the right context, which is NginxHttpDir from inside the http block and NginxStreamDir from
+// inside the stream block (either directly, or through the generated `nqkd-http.include` and `nqkd-stream.include`).
+// Relative includes are resolved against the directory of the main config file, as nginx does by default. Returns
+// every problem found joined together, or nil if the generated files are included correctly
+func CheckNginxIncludes(mainConfig string, dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	check := &nginxIncludeCheck{
+		prefix:   filepath.Dir(mainConfig),
+		http:     filepath.Join(dir, NginxHttpDir),
+		stream:   filepath.Join(dir, NginxStreamDir),
+		visited:  make(map[string]bool),
+		found:    make(map[string]bool),
+		problems: make([]error, 0),
+	}
+	check.walk(mainConfig, make([]string, 0))
+
+	if !check.found["http"] {
+		check.problems = append(check.problems, fmt.Errorf("%v is never included from the http block, add `include %v;` inside it", check.http, filepath.Join(dir, "nqkd-http.include")))
+	}
+	if !check.found["stream"] {
+		check.problems = append(check.problems, fmt.Errorf("%v is never included from a stream block, add `include %v;` at the top level", check.stream, filepath.Join(dir, "nqkd-stream.include")))
+	}
+
+	return errors.Join(check.problems...)
+}
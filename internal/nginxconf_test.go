@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckNginxIncludes(t *testing.T) {
+	tests := []struct {
+		name string
+		// main is nginx.conf, %[1]v is the output directory
+		main string
+		// confD are extra files in conf.d next to nginx.conf
+		confD    map[string]string
+		problems []string
+	}{
+		{
+			name: "generated includes",
+			main: "events {}\nhttp {\n    include %[1]v/nqkd-http.include;\n}\ninclude %[1]v/nqkd-stream.include;\n",
+		},
+		{
+			name: "directories included directly",
+			main: "http { include %[1]v/http.d/*.conf; }\nstream { include %[1]v/stream.d/*.conf; }\n",
+		},
+		{
+			name:  "included through a relative conf.d include",
+			main:  "http { include conf.d/*.conf; }\ninclude %[1]v/nqkd-stream.include;\n",
+			confD: map[string]string{"nqkd.conf": "include %[1]v/http.d/*.conf;\n"},
+		},
+		{
+			name:     "missing http include",
+			main:     "http { include conf.d/*.conf; }\ninclude %[1]v/nqkd-stream.include;\n",
+			problems: []string{"http.d is never included from the http block"},
+		},
+		{
+			name:     "missing stream include",
+			main:     "http { include %[1]v/nqkd-http.include; }\n",
+			problems: []string{"stream.d is never included from a stream block"},
+		},
+		{
+			name: "includes from the wrong context",
+			main: "include %[1]v/http.d/*.conf;\nhttp { include %[1]v/nqkd-stream.include; }\n",
+			problems: []string{
+				"http.d is included from the main context, it must be included from the http block",
+				"the stream block is inside http, it must be at the top level",
+				"http.d is never included from the http block",
+			},
+		},
+		{
+			name:     "unparseable config",
+			main:     "http { include \"%[1]v/nqkd-http.include; }\n",
+			problems: []string{"unterminated quote"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			out := filepath.Join(root, "nqkd")
+			files, err := GenerateFilesForNginxRoutes(nil, BindingConfiguration{OutputDir: out})
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTree(t, out, files)
+			for _, dir := range []string{NginxHttpDir, NginxStreamDir} {
+				if err := os.MkdirAll(filepath.Join(out, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			conf := filepath.Join(root, "nginx")
+			for name, content := range test.confD {
+				writeTree(t, filepath.Join(conf, "conf.d"), map[string]string{name: fmt.Sprintf(content, out)})
+			}
+			writeTree(t, conf, map[string]string{"nginx.conf": fmt.Sprintf(test.main, out)})
+
+			err = CheckNginxIncludes(filepath.Join(conf, "nginx.conf"), out)
+			if len(test.problems) == 0 && err != nil {
+				t.Fatalf("CheckNginxIncludes() error = %v, want none", err)
+			}
+			if len(test.problems) > 0 && err == nil {
+				t.Fatalf("CheckNginxIncludes() error = nil, want %v", test.problems)
+			}
+			for _, problem := range test.problems {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("CheckNginxIncludes() error = %v, want it to report %q", err, problem)
+				}
+			}
+		})
+	}
+}
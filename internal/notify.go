@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// NotificationConfiguration controls where notifications raised by the daemon are delivered. Notifications are always
+// logged, these are additional targets
+type NotificationConfiguration struct {
+	// Webhook is a URL which will receive a JSON POST of the Notification if non-empty
+	Webhook string
+	// Command is an executable which will be run for each notification if non-empty. The notification is passed
+	// through the environment as NQKD_PROJECT, NQKD_SERVICE and NQKD_MESSAGE
+	Command string
+}
+
+// Notification is a single message raised by the daemon about a project which may need attention from an operator
+type Notification struct {
+	// Project is the name of the nqk project the notification relates to
+	Project string `json:"project"`
+	// Service is the compose service within the project, this may be empty if the notification is for a whole project
+	Service string `json:"service"`
+	// Message is a human-readable description of what happened
+	Message string `json:"message"`
+	// Time is when the notification was raised
+	Time time.Time `json:"time"`
+}
+
+// SendNotification will log the notification and then deliver it to each target configured. Every target is attempted
+// even if an earlier one fails, the last error encountered is returned
+func SendNotification(config NotificationConfiguration, notification Notification) error {
+	slog.Warn("Notification", "project", notification.Project, "service", notification.Service, "message", notification.Message)
+
+	var lastErr error
+	if config.Webhook != "" {
+		body, err := json.Marshal(notification)
+		if err != nil {
+			return err
+		}
+
+		client := http.Client{Timeout: 10 * time.Second}
+		response, err := client.Post(config.Webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Error("Failed to deliver notification to webhook", "webhook", config.Webhook, "error", err)
+			lastErr = err
+		} else {
+			_ = response.Body.Close()
+			if response.StatusCode >= 300 {
+				lastErr = fmt.Errorf("webhook responded with status %v", response.Status)
+				slog.Error("Webhook rejected the notification", "webhook", config.Webhook, "status", response.Status)
+			}
+		}
+	}
+
+	if config.Command != "" {
+		cmd := Run(config.Command)
+		cmd.Env = append(
+			cmd.Env,
+			"NQKD_PROJECT="+notification.Project,
+			"NQKD_SERVICE="+notification.Service,
+			"NQKD_MESSAGE="+notification.Message,
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			slog.Error("Failed to run notification command", "command", config.Command, "error", err, "output", cleanNewLineTabFromString(string(out)))
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
@@ -1,6 +1,7 @@
 package nrpc
 
 import (
+	"errors"
 	"golang.org/x/exp/maps"
 	"log/slog"
 	"net"
@@ -13,8 +14,9 @@ import (
 )
 
 type NqkRpcService struct {
-	record        internal.StateRecord
-	actionChannel chan internal.DaemonCommand
+	record          internal.StateRecord
+	actionChannel   chan internal.DaemonCommand
+	maintenanceFile string
 }
 
 func ref[T interface{}](v T) *T {
@@ -40,12 +42,17 @@ type GetAllStatusArgs struct{}
 type GetAllStatusResult []internal.ActiveProjectState
 
 func getAllStatusImpl(context NqkRpcService) []internal.ActiveProjectState {
-	//context.record.Lock.Lock()
+	context.record.Lock.Lock()
+	defer context.record.Lock.Unlock()
 	values := maps.Values(context.record.Projects)
-	//context.record.Lock.Unlock()
 	v := make([]internal.ActiveProjectState, len(values))
 	for i := 0; i < len(values); i++ {
 		v[i] = *values[i]
+		// the services are copied too as they are still updated by the daemon after the lock is released
+		v[i].Services = make(map[string]*internal.ServiceCrashState, len(values[i].Services))
+		for name, service := range values[i].Services {
+			v[i].Services[name] = ref(*service)
+		}
 	}
 	return v
 }
@@ -65,6 +72,43 @@ func GetAllStatus(rpc *rpc.Client) (GetAllStatusResult, error) {
 	return reply, nil
 }
 
+// func SetMaintenance(project string, enabled bool) bool
+
+type SetMaintenanceArgs struct {
+	Project string
+	Enabled bool
+}
+
+type SetMaintenanceResult bool
+
+func (t *NqkRpcService) SetMaintenance(args *SetMaintenanceArgs, result *SetMaintenanceResult) error {
+	t.record.Lock.Lock()
+	_, ok := t.record.Projects[args.Project]
+	t.record.Lock.Unlock()
+	if !ok {
+		return errors.New("project " + args.Project + " is not managed by nqk")
+	}
+
+	changed, err := internal.SetProjectMaintenance(t.maintenanceFile, args.Project, args.Enabled)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Set project maintenance", "project", args.Project, "enabled", args.Enabled, "changed", changed)
+	*result = SetMaintenanceResult(changed)
+	return nil
+}
+
+func SetMaintenance(rpc *rpc.Client, project string, enabled bool) (bool, error) {
+	var reply SetMaintenanceResult
+	err := rpc.Call("NqkRpcService.SetMaintenance", &SetMaintenanceArgs{Project: project, Enabled: enabled}, &reply)
+	if err != nil {
+		return false, err
+	}
+
+	return bool(reply), nil
+}
+
 //-------------
 
 func Bind(service NqkRpcService) error {
@@ -76,10 +120,11 @@ func Bind(service NqkRpcService) error {
 	return nil
 }
 
-func Launch(record internal.StateRecord, channel chan internal.DaemonCommand) error {
+func Launch(record internal.StateRecord, channel chan internal.DaemonCommand, maintenanceFile string) error {
 	err := Bind(NqkRpcService{
-		record:        record,
-		actionChannel: channel,
+		record:          record,
+		actionChannel:   channel,
+		maintenanceFile: maintenanceFile,
 	})
 	if err != nil {
 		return err
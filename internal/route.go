@@ -0,0 +1,479 @@
+package internal
+
+import (
+	"log/slog"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// durationRegex matches the durations accepted by labels, a whole number with an optional unit (ie 30s or 5m)
+var durationRegex = regexp.MustCompile(`^[0-9]+(ms|s|m|h|d)?$`)
+
+// pathRegex matches the paths http routes can be served under. Paths are written into proxy configuration as they are,
+// so anything which could close the location or start a new directive is rejected
+var pathRegex = regexp.MustCompile(`^/[A-Za-z0-9._~/%-]*$`)
+
+// RouteUpstream is the target traffic for a route should be forwarded to
+type RouteUpstream struct {
+	// Scheme is the protocol used to talk to the upstream, this is the port type (ie http/https/grpc/grpcs/h2c for http
+	// routes and tcp/udp otherwise)
+	Scheme string `json:"scheme"`
+	// Host is the address the upstream can be reached on
+	Host string `json:"host"`
+	// Port is the port the upstream is listening on at Host
+	Port uint16 `json:"port"`
+}
+
+// Address returns the host and port of the upstream joined in the form host:port, with IPv6 hosts in brackets
+func (u RouteUpstream) Address() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(int(u.Port)))
+}
+
+// IsHttp2 returns whether the upstream speaks HTTP/2 rather than HTTP/1.1, which is true for the gRPC and h2c types
+func (u RouteUpstream) IsHttp2() bool {
+	return u.Scheme == ValueTypeGrpc || u.Scheme == ValueTypeGrpcs || u.Scheme == ValueTypeH2c
+}
+
+// IsTls returns whether the upstream expects tls
+func (u RouteUpstream) IsTls() bool {
+	return u.Scheme == ValueTypeHttps || u.Scheme == ValueTypeGrpcs
+}
+
+// UrlScheme returns the scheme of a url which reaches the upstream for proxies which only know http, https and h2c
+func (u RouteUpstream) UrlScheme() string {
+	switch {
+	case u.IsTls():
+		return ValueTypeHttps
+	case u.IsHttp2():
+		return ValueTypeH2c
+	default:
+		return ValueTypeHttp
+	}
+}
+
+// RouteAlias is an extra domain a route answers on which permanently redirects to the route's domain
+type RouteAlias struct {
+	// Domain is the alias domain
+	Domain string `json:"domain"`
+	// Certificate is the path to the certificate for Domain, used when the route has Tls enabled
+	Certificate string `json:"certificate,omitempty"`
+	// PrivateKey is the path to the private key for Certificate
+	PrivateKey string `json:"private_key,omitempty"`
+}
+
+// Route is a single exposed port on a container after every label has been resolved against its defaults. Routes are
+// the intermediate model that every binding output format is rendered from, so no output needs to understand labels
+type Route struct {
+	// Project is the name of the nqk project the container belongs to
+	Project string `json:"project"`
+	// Service is the compose service the container was created for
+	Service string `json:"service"`
+	// Container is the name of the container on the host
+	Container string `json:"container"`
+	// ContainerPort is the port exposed by the container which this route is for
+	ContainerPort uint16 `json:"container_port"`
+	// Protocol is the resolved port type, one of the ValueType* constants
+	Protocol string `json:"protocol"`
+	// ListenAddress is the address the proxy should bind to on the host
+	ListenAddress string `json:"listen_address"`
+	// ListenPort is the port the proxy should bind to on the host
+	ListenPort uint16 `json:"listen_port"`
+	// Domain is the domain the route should be served on
+	Domain string `json:"domain"`
+	// Tls is whether the proxy should terminate TLS for this route
+	Tls bool `json:"tls"`
+	// Certificate is the path to the certificate to use when Tls is enabled
+	Certificate string `json:"certificate,omitempty"`
+	// PrivateKey is the path to the private key for Certificate
+	PrivateKey string `json:"private_key,omitempty"`
+	// Path is the path prefix http routes are served under, this is / unless set by a label and empty for other routes
+	Path string `json:"path,omitempty"`
+	// StripPath is whether Path should be removed from the request before it is forwarded. When set Path always ends
+	// with a /
+	StripPath bool `json:"strip_path,omitempty"`
+	// Aliases are the domains which redirect to Domain
+	Aliases []RouteAlias `json:"aliases,omitempty"`
+	// Redirect is whether plain http requests on port 80 for Domain should be redirected to this tls route
+	Redirect bool `json:"redirect,omitempty"`
+	// Hsts is the max-age of the Strict-Transport-Security header sent by tls routes, 0 if it shouldn't be sent
+	Hsts int `json:"hsts,omitempty"`
+	// Balance is how requests are spread between the replicas of the service, one of the Balance* constants. Empty
+	// means the default
+	Balance string `json:"balance,omitempty"`
+	// MaxFails is the number of failed attempts after which this replica is considered unavailable, nil if not set
+	MaxFails *int `json:"max_fails,omitempty"`
+	// FailTimeout is how long this replica is considered unavailable after MaxFails failed attempts, empty if not set
+	FailTimeout string `json:"fail_timeout,omitempty"`
+	// Allow are the addresses and CIDRs allowed to connect, if any are set every other address is denied
+	Allow []string `json:"allow,omitempty"`
+	// Deny are the addresses and CIDRs denied from connecting, these take priority over Allow
+	Deny []string `json:"deny,omitempty"`
+	// BasicAuth is the path to the htpasswd file requests must authenticate against, empty if not protected
+	BasicAuth string `json:"basic_auth,omitempty"`
+	// ForwardAuth is the service requests are checked against before being forwarded, nil if not protected
+	ForwardAuth *RouteForwardAuth `json:"forward_auth,omitempty"`
+	// Directives are the allowlisted nginx directives set by label, sorted by name
+	Directives []RouteDirective `json:"directives,omitempty"`
+	// Headers are added to every response, sorted by name
+	Headers []RouteHeader `json:"headers,omitempty"`
+	// Snippet is the path of an nginx snippet from the snippet directory included in the route, empty if there is none
+	Snippet string `json:"snippet,omitempty"`
+	// Http2 is whether the proxy should accept HTTP/2 from clients, this is always true for the gRPC types
+	Http2 bool `json:"http2,omitempty"`
+	// Quic is whether the proxy should also listen for HTTP/3 over QUIC, only set on tls routes
+	Quic bool `json:"quic,omitempty"`
+	// Maintenance is whether the project is in maintenance, in which case the maintenance page is served instead of
+	// forwarding requests
+	Maintenance bool `json:"maintenance,omitempty"`
+	// MaintenancePage is the page served in maintenance and when the upstream can't be reached, empty for the default
+	MaintenancePage string `json:"maintenance_page,omitempty"`
+	// Asleep is whether the project was stopped for being idle, in which case requests are sent to the waker which
+	// starts it again
+	Asleep bool `json:"asleep,omitempty"`
+	// Passthrough is whether this tcp route is routed by SNI without terminating tls, so routes for different domains
+	// can share a listen address and port. Tls is always false for these routes as the container handles it
+	Passthrough bool `json:"passthrough,omitempty"`
+	// Internal is whether the certificate for this route is issued by the local certificate authority
+	Internal bool `json:"internal,omitempty"`
+	// DualStack is whether the proxy should also bind to every IPv6 address on ListenPort, only set for routes bound
+	// to every IPv4 address when IPv6 is enabled
+	DualStack bool `json:"dual_stack,omitempty"`
+	// Upstream is where traffic for this route should be forwarded
+	Upstream RouteUpstream `json:"upstream"`
+}
+
+// Listen returns the address and port the proxy should bind to in the form address:port, with IPv6 addresses in
+// brackets
+func (r Route) Listen() string {
+	return net.JoinHostPort(r.ListenAddress, strconv.Itoa(int(r.ListenPort)))
+}
+
+// RedirectUrl returns the url prefix alias and port 80 redirects should send requests to, requests should append the
+// request uri
+func (r Route) RedirectUrl() string {
+	if !r.Tls {
+		if r.ListenPort == 80 {
+			return "http://" + r.Domain
+		}
+		return "http://" + r.Domain + ":" + strconv.Itoa(int(r.ListenPort))
+	}
+	if r.ListenPort == 443 {
+		return "https://" + r.Domain
+	}
+	return "https://" + r.Domain + ":" + strconv.Itoa(int(r.ListenPort))
+}
+
+// IsHttp returns whether the route carries HTTP traffic rather than plain TCP or UDP, which includes gRPC and h2c
+func (r Route) IsHttp() bool {
+	return isHttpType(r.Protocol)
+}
+
+// Features returns the names of the optional http features set on the route, in a fixed order, so generators which
+// can't serve some of them can warn about the ones they drop
+func (r Route) Features() []string {
+	features := make([]string, 0)
+	set := []struct {
+		name    string
+		enabled bool
+	}{
+		{"maintenance", r.Maintenance},
+		{"aliases", len(r.Aliases) > 0},
+		{"redirect", r.Redirect},
+		{"hsts", r.Hsts > 0},
+		{"strip", r.StripPath},
+		{"directives", len(r.Directives) > 0},
+		{"snippet", r.Snippet != ""},
+		{"headers", len(r.Headers) > 0},
+		{"http2", r.Http2},
+		{"quic", r.Quic},
+	}
+	for _, feature := range set {
+		if feature.enabled {
+			features = append(features, feature.name)
+		}
+	}
+	return features
+}
+
+// isHttpType returns whether the port type is one of the http types
+func isHttpType(portType string) bool {
+	return portType == ValueTypeHttp || portType == ValueTypeHttps || portType == ValueTypeGrpc || portType == ValueTypeGrpcs || portType == ValueTypeH2c
+}
+
+// portLabels reads the labels of a container for one of its ports, carrying the port and container so problems with
+// the labels can be logged against them
+type portLabels struct {
+	labels    map[string]string
+	port      uint16
+	container string
+}
+
+// get returns the port label, falling back to the global label (if there is one), or nil if neither is set
+func (p portLabels) get(globalLabel string, portLabel string) *string {
+	return GetLabelForPort(p.labels, globalLabel, portLabel, p.port)
+}
+
+// value returns the port label, falling back to the global label and then fallback
+func (p portLabels) value(globalLabel string, portLabel string, fallback string) string {
+	return StringOrElse(p.get(globalLabel, portLabel), fallback)
+}
+
+// enabled returns whether the port label, falling back to the global label and then fallback, is true
+func (p portLabels) enabled(globalLabel string, portLabel string, fallback bool) bool {
+	return p.value(globalLabel, portLabel, strconv.FormatBool(fallback)) == "true"
+}
+
+// ResolveContainerRoutes will resolve every port on the container into a Route. This is based off the set of labels
+// defined in constants.go, prefixed with Label*. This handles skipping hidden ports, ssl, bind addresses, domain mapping
+// and HTTP vs TCP vs UDP traffic, with each concern parsed by its own resolve* helper. Ports which cannot be routed are
+// logged and skipped
+func ResolveContainerRoutes(project string, container BindingContainer, config BindingConfiguration) ([]Route, error) {
+	routes := make([]Route, 0)
+	asleep := slices.Contains(config.Asleep, project)
+	networkAddress := ""
+	if config.Network != "" {
+		networkAddress = container.NetworkAddress(config.Network)
+		if networkAddress == "" && !asleep {
+			slog.Warn("The container is not attached to the network, only its published ports can be routed", "network", config.Network, "container", container.Name)
+		}
+	}
+
+	for _, port := range container.Ports {
+		labels := portLabels{labels: container.Labels, port: port.ContainerPort, container: container.Name}
+		if labels.enabled("", LabelPortHide, false) {
+			slog.Debug("Skipping port because it is marked as hidden", "port", port, "container", container.Name)
+			continue
+		}
+
+		// docker publishes ports on both 0.0.0.0 and :: by default, these are the same port so only one route is needed
+		if publishedOnIpv4(container.Ports, port) {
+			slog.Debug("Skipping IPv6 binding because the port is also published on IPv4", "binding", port.Binding, "port", port, "container", container.Name)
+			continue
+		}
+
+		upstream, ok := resolveUpstreamAddress(port, labels, networkAddress, asleep, config)
+		if !ok {
+			continue
+		}
+
+		portType := labels.value(LabelGlobalType, LabelPortType, port.Type)
+		if (portType == ValueTypeTcp && port.Type == ValueTypeUdp) || (portType == ValueTypeUdp && port.Type == ValueTypeTcp) || (isHttpType(portType) && port.Type == ValueTypeUdp) {
+			slog.Error("Cannot create mapping for port as it is currently defined! Inconsistency in defined port and docker port identity, defaulting to docker identity!", "defined", portType, "docker", port.Type, "port", port.ContainerPort)
+			portType = port.Type
+		}
+
+		// passthrough routes leave tls to the container, the proxy only reads the SNI to pick where to send them
+		passthrough := portType == ValueTypeTcp && labels.enabled(LabelGlobalSslPassthrough, LabelPortSslPassthrough, false)
+		useSsl := labels.enabled(LabelGlobalSsl, LabelPortSsl, true) && !passthrough
+		domain := labels.value(LabelGlobalDomain, LabelPortDomain, config.DefaultDomain)
+		if domain != "" && !ValidDomain(domain) {
+			slog.Error("Skipping port because the domain is not a valid hostname", "domain", domain, "port", port.ContainerPort, "container", container.Name)
+			continue
+		}
+
+		route := Route{
+			Project:       project,
+			Service:       container.Service,
+			Container:     container.Name,
+			ContainerPort: port.ContainerPort,
+			Protocol:      portType,
+			ListenPort:    port.ContainerPort,
+			Domain:        domain,
+			Tls:           useSsl,
+			Passthrough:   passthrough,
+			Upstream:      upstream,
+			Asleep:        asleep,
+		}
+		route.Upstream.Scheme = portType
+		resolveListenAddress(&route, labels, config)
+		resolveTls(&route, labels, config)
+		resolveUpstreamOptions(&route, labels)
+		resolveAccessLists(&route, labels)
+
+		if route.Asleep && !isHttpType(portType) {
+			slog.Warn("Skipping port because its project is asleep and only http requests can wake it", "type", portType, "port", port.ContainerPort, "container", container.Name)
+			continue
+		}
+
+		if isHttpType(portType) {
+			if !resolveAuth(&route, labels, config) || !resolveHttpListen(&route, labels) {
+				continue
+			}
+			resolveHttpOptions(&route, labels, config)
+			resolveRedirects(&route, labels, config)
+			slog.Debug("Port configuration", "type", portType, "ssl", useSsl, "bind", route.ListenAddress, "domain", domain, "listen", route.ListenPort, "port", port.ContainerPort, "binding", port.Binding)
+		} else if portType == ValueTypeTcp || portType == ValueTypeUdp {
+			if passthrough && !resolveSniListen(&route, labels) {
+				continue
+			}
+			slog.Debug("Port configuration", "type", portType, "ssl", useSsl, "passthrough", passthrough, "bind", route.ListenAddress, "domain", domain, "port", route.ListenPort, "port", port.ContainerPort, "binding", port.Binding)
+		} else {
+			slog.Warn("Failed to create binding because the protocol was not recognised", "protocol", portType)
+			continue
+		}
+
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+// resolveListenAddress sets the address the route listens on from the bind label. IPv6 addresses can be given with or
+// without brackets, they are added back wherever they are needed
+func resolveListenAddress(route *Route, labels portLabels, config BindingConfiguration) {
+	route.ListenAddress = strings.TrimSuffix(strings.TrimPrefix(labels.value(LabelGlobalBind, LabelPortBind, "0.0.0.0"), "["), "]")
+	route.DualStack = config.Ipv6 && route.ListenAddress == "0.0.0.0"
+}
+
+// resolveHttpListen sets the port and path an http route is served on. The port is 443 or 80 depending on tls unless
+// the nonstandard label is set. Returns false if the port should be skipped because the override or path isn't valid
+func resolveHttpListen(route *Route, labels portLabels) bool {
+	var portString string
+	if labels.enabled(LabelGlobalNonstandardHttp, LabelPortNonstandardHttp, false) {
+		portString = labels.value(LabelGlobalPortOverride, LabelPortPortOverride, strconv.Itoa(int(labels.port)))
+	} else if route.Tls {
+		portString = "443"
+	} else {
+		portString = "80"
+	}
+
+	listenPort, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		slog.Error("Skipping port because the port override is not a valid port", "override", portString, "port", labels.port, "container", labels.container)
+		return false
+	}
+	route.ListenPort = uint16(listenPort)
+
+	route.Path = labels.value(LabelGlobalPath, LabelPortPath, "/")
+	if !strings.HasPrefix(route.Path, "/") {
+		route.Path = "/" + route.Path
+	}
+	if !pathRegex.MatchString(route.Path) {
+		slog.Error("Skipping port because the path may only contain letters, digits, /, %, -, ., _ and ~", "path", route.Path, "port", labels.port, "container", labels.container)
+		return false
+	}
+	route.StripPath = route.Path != "/" && labels.enabled(LabelGlobalPathStrip, LabelPortPathStrip, false)
+	if route.StripPath && route.Upstream.IsHttp2() {
+		slog.Warn("Not stripping the path because HTTP/2 upstreams are proxied without rewriting the request", "path", route.Path, "type", route.Protocol, "port", labels.port, "container", labels.container)
+		route.StripPath = false
+	}
+	if route.StripPath && !strings.HasSuffix(route.Path, "/") {
+		route.Path += "/"
+	}
+	return true
+}
+
+// resolveHttpOptions sets the nginx directives, headers and snippet of an http route, along with maintenance and the
+// protocols it is served over
+func resolveHttpOptions(route *Route, labels portLabels, config BindingConfiguration) {
+	route.Directives = ResolveNginxDirectives(labels.labels, labels.port)
+	route.Headers = ResolveHeaders(labels.labels, labels.port)
+	route.Snippet = ResolveNginxSnippet(labels.labels, labels.port, config.SnippetDir)
+	route.Maintenance = slices.Contains(config.Maintenance, route.Project)
+	route.MaintenancePage = ResolveMaintenancePage(labels.labels, labels.port, config.MaintenancePages)
+
+	// gRPC clients only speak HTTP/2 so the listener always has to accept it
+	route.Http2 = route.Protocol == ValueTypeGrpc || route.Protocol == ValueTypeGrpcs || labels.enabled(LabelGlobalHttp2, LabelPortHttp2, false)
+	if labels.enabled(LabelGlobalQuic, LabelPortQuic, false) {
+		if route.Tls {
+			route.Quic = true
+		} else {
+			slog.Warn("Ignoring quic label because HTTP/3 requires ssl", "port", labels.port, "container", labels.container)
+		}
+	}
+}
+
+// resolveRedirects sets the alias domains of an http route, which redirect to its domain, and for tls routes whether
+// plain http is redirected and the max-age of the hsts header
+func resolveRedirects(route *Route, labels portLabels, config BindingConfiguration) {
+	for _, alias := range strings.Split(labels.value(LabelGlobalDomainAliases, LabelPortDomainAliases, ""), ",") {
+		alias = strings.TrimSpace(alias)
+		if alias == "" || alias == route.Domain {
+			continue
+		}
+		if !ValidDomain(alias) {
+			slog.Error("Ignoring domain alias because it is not a valid hostname", "alias", alias, "port", labels.port, "container", labels.container)
+			continue
+		}
+		routeAlias := RouteAlias{Domain: alias}
+		if route.Tls {
+			routeAlias.Certificate, routeAlias.PrivateKey = routeCertificate(*route, alias, labels, config)
+		}
+		route.Aliases = append(route.Aliases, routeAlias)
+	}
+
+	if !route.Tls {
+		return
+	}
+	route.Redirect = labels.enabled(LabelGlobalHttpRedirect, LabelPortHttpRedirect, route.ListenPort == 443)
+
+	hsts := labels.value(LabelGlobalHsts, LabelPortHsts, "false")
+	if hsts == "true" {
+		route.Hsts = 31536000
+	} else if hsts != "false" {
+		maxAge, err := strconv.Atoi(hsts)
+		if err != nil || maxAge < 0 {
+			slog.Error("Ignoring hsts label because it is not true, false or a max-age in seconds", "hsts", hsts, "port", labels.port, "container", labels.container)
+		} else {
+			route.Hsts = maxAge
+		}
+	}
+}
+
+// publishedOnIpv4 returns whether the port is bound to an IPv6 address and the same container port is also published
+// on an IPv4 address with the same host port
+func publishedOnIpv4(ports []BindingPortMapping, port BindingPortMapping) bool {
+	if ip := net.ParseIP(port.Binding); ip == nil || ip.To4() != nil {
+		return false
+	}
+	return slices.ContainsFunc(ports, func(other BindingPortMapping) bool {
+		ip := net.ParseIP(other.Binding)
+		return ip != nil && ip.To4() != nil && other.ContainerPort == port.ContainerPort && other.HostPort == port.HostPort && other.Type == port.Type
+	})
+}
+
+// ResolveRoutes will resolve every container in every project into the set of routes it exposes using
+// ResolveContainerRoutes, and then resolve forward auth targets against the full set of routes. Routes are sorted by
+// project, container and then port so the result is stable between runs
+func ResolveRoutes(binding BindingResult, config BindingConfiguration) ([]Route, error) {
+	routes := make([]Route, 0)
+	for _, project := range binding.Projects {
+		for _, container := range project.Containers {
+			containerRoutes, err := ResolveContainerRoutes(project.Project, container, config)
+			if err != nil {
+				slog.Error("Failed to resolve routes for container due to an error", "project", project.Project, "container", container.Name, "error", err)
+				return nil, err
+			}
+
+			routes = append(routes, containerRoutes...)
+		}
+	}
+
+	for i := range routes {
+		// the waker only serves a loading page, and the forward auth service could be asleep alongside the route
+		if routes[i].Asleep {
+			routes[i].ForwardAuth = nil
+		}
+		if routes[i].ForwardAuth != nil {
+			resolveForwardAuth(&routes[i], routes)
+		}
+	}
+
+	slices.SortFunc(routes, func(a, b Route) int {
+		if v := strings.Compare(a.Project, b.Project); v != 0 {
+			return v
+		}
+		if v := strings.Compare(a.Container, b.Container); v != 0 {
+			return v
+		}
+		if v := int(a.ContainerPort) - int(b.ContainerPort); v != 0 {
+			return v
+		}
+		return strings.Compare(a.Upstream.Host, b.Upstream.Host)
+	})
+
+	return routes, nil
+}
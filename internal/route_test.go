@@ -0,0 +1,344 @@
+package internal
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// routeContainer is a container publishing a single http port with the labels
+func routeContainer(labels map[string]string) BindingContainer {
+	return BindingContainer{
+		Name:    "project-web-1",
+		Service: "web",
+		Labels:  labels,
+		Ports:   []BindingPortMapping{{ContainerPort: 80, HostPort: 8080, Binding: "127.0.0.1", Type: ValueTypeTcp}},
+	}
+}
+
+func TestResolveContainerRoutesValidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		wantPath    string
+		wantAliases []string
+		wantSkipped bool
+	}{
+		{
+			name:     "path without a leading slash",
+			labels:   map[string]string{"org.xiomi.nqkd.80.path": "api/v1"},
+			wantPath: "/api/v1",
+		},
+		{
+			name:     "path with escapes and unreserved characters",
+			labels:   map[string]string{"org.xiomi.nqkd.80.path": "/a%20b/c-d_e.f~g/"},
+			wantPath: "/a%20b/c-d_e.f~g/",
+		},
+		{
+			name:        "path breaking out of the location",
+			labels:      map[string]string{"org.xiomi.nqkd.80.path": "/ {\n    return 200;\n  }\n  location /x"},
+			wantSkipped: true,
+		},
+		{
+			name:        "path with a space",
+			labels:      map[string]string{"org.xiomi.nqkd.80.path": "/a b"},
+			wantSkipped: true,
+		},
+		{
+			name:        "path with a regex modifier",
+			labels:      map[string]string{"org.xiomi.nqkd.80.path": "~ .*"},
+			wantSkipped: true,
+		},
+		{
+			name:     "forward auth path",
+			labels:   map[string]string{"org.xiomi.nqkd.80.auth.forward": "auth/web:80", "org.xiomi.nqkd.80.auth.forward.path": "/verify"},
+			wantPath: "/",
+		},
+		{
+			name:        "forward auth path injecting into proxy_pass",
+			labels:      map[string]string{"org.xiomi.nqkd.80.auth.forward": "auth/web:80", "org.xiomi.nqkd.80.auth.forward.path": "/verify;\n    proxy_pass http://evil"},
+			wantSkipped: true,
+		},
+		{
+			name:        "domain which traverses directories",
+			labels:      map[string]string{"org.xiomi.nqkd.80.domain": "../../../etc/x"},
+			wantSkipped: true,
+		},
+		{
+			name:        "invalid aliases are dropped",
+			labels:      map[string]string{"org.xiomi.nqkd.80.domain.aliases": "www.example.com, ../x, a;b"},
+			wantPath:    "/",
+			wantAliases: []string{"www.example.com"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			labels := map[string]string{
+				"org.xiomi.nqkd.80.type":   ValueTypeHttp,
+				"org.xiomi.nqkd.80.ssl":    "false",
+				"org.xiomi.nqkd.80.domain": "example.com",
+			}
+			for key, value := range test.labels {
+				labels[key] = value
+			}
+
+			routes, err := ResolveContainerRoutes("project", routeContainer(labels), BindingConfiguration{})
+			if err != nil {
+				t.Fatalf("ResolveContainerRoutes() error = %v", err)
+			}
+			if test.wantSkipped {
+				if len(routes) != 0 {
+					t.Errorf("ResolveContainerRoutes() = %v, want the port skipped", routes)
+				}
+				return
+			}
+			if len(routes) != 1 {
+				t.Fatalf("ResolveContainerRoutes() returned %v routes, want 1", len(routes))
+			}
+			if routes[0].Path != test.wantPath {
+				t.Errorf("path = %q, want %q", routes[0].Path, test.wantPath)
+			}
+			aliases := make([]string, 0)
+			for _, alias := range routes[0].Aliases {
+				aliases = append(aliases, alias.Domain)
+			}
+			if len(test.wantAliases) > 0 && !slices.Equal(aliases, test.wantAliases) {
+				t.Errorf("aliases = %v, want %v", aliases, test.wantAliases)
+			}
+		})
+	}
+}
+
+func TestResolveContainerRoutesNetwork(t *testing.T) {
+	container := BindingContainer{
+		Name:     "project-app-1",
+		Service:  "app",
+		Networks: []BindingNetwork{{Name: "nqk", IPAddress: "172.20.0.5"}},
+		Labels: map[string]string{
+			"org.xiomi.nqkd.domain":      "example.com",
+			"org.xiomi.nqkd.8080.type":   ValueTypeHttp,
+			"org.xiomi.nqkd.8080.ssl":    "false",
+			"org.xiomi.nqkd.9000.domain": "admin.example.com",
+			"org.xiomi.nqkd.9000.ssl":    "false",
+		},
+		Ports: []BindingPortMapping{
+			// published, so already reachable and routed without a label of its own
+			{ContainerPort: 443, HostPort: 8443, Binding: "0.0.0.0", Type: ValueTypeTcp},
+			// unpublished but labelled with a type or domain
+			{ContainerPort: 8080, Type: ValueTypeTcp},
+			{ContainerPort: 9000, Type: ValueTypeTcp},
+			// unpublished and only covered by the global labels, ie metrics and database ports
+			{ContainerPort: 9090, Type: ValueTypeTcp},
+			{ContainerPort: 5432, Type: ValueTypeTcp},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		network string
+		want    []string
+	}{
+		{
+			name:    "network mode routes published and labelled ports",
+			network: "nqk",
+			want:    []string{"443 172.20.0.5:443", "8080 172.20.0.5:8080", "9000 172.20.0.5:9000"},
+		},
+		{
+			name:    "without a network only published ports are routed",
+			network: "",
+			want:    []string{"443 0.0.0.0:8443"},
+		},
+		{
+			name:    "container not on the network falls back to published ports",
+			network: "other",
+			want:    []string{"443 0.0.0.0:8443"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			routes, err := ResolveContainerRoutes("project", container, BindingConfiguration{Network: test.network})
+			if err != nil {
+				t.Fatalf("ResolveContainerRoutes() error = %v", err)
+			}
+			got := make([]string, 0)
+			for _, route := range routes {
+				got = append(got, strconv.Itoa(int(route.ContainerPort))+" "+route.Upstream.Address())
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("ResolveContainerRoutes() routed %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWakerAddressOnNetwork(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		wantErr bool
+	}{
+		{address: "127.0.0.1:7380", want: "172.20.0.1:7380"},
+		{address: "localhost:7380", want: "172.20.0.1:7380"},
+		{address: "[::1]:7380", want: "172.20.0.1:7380"},
+		{address: "10.0.0.2:7380", want: "10.0.0.2:7380"},
+		{address: "waker.internal:7380", want: "waker.internal:7380"},
+		{address: "7380", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := WakerAddressOnNetwork(test.address, "172.20.0.1")
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("WakerAddressOnNetwork(%q) = %q, %v, want %q", test.address, got, err, test.want)
+		}
+	}
+}
+
+func TestResolveHttpOptionsProtocols(t *testing.T) {
+	tests := []struct {
+		name      string
+		protocol  string
+		tls       bool
+		labels    map[string]string
+		wantHttp2 bool
+		wantQuic  bool
+	}{
+		{name: "http defaults to HTTP/1.1", protocol: ValueTypeHttp},
+		{name: "grpc always accepts HTTP/2", protocol: ValueTypeGrpc, wantHttp2: true},
+		{name: "grpcs always accepts HTTP/2", protocol: ValueTypeGrpcs, tls: true, wantHttp2: true},
+		{name: "h2c upstreams don't change the listener", protocol: ValueTypeH2c},
+		{name: "http2 label", protocol: ValueTypeHttp, labels: map[string]string{"org.xiomi.nqkd.80.http2": "true"}, wantHttp2: true},
+		{name: "quic on tls", protocol: ValueTypeHttps, tls: true, labels: map[string]string{LabelGlobalQuic: "true"}, wantQuic: true},
+		{name: "quic without tls is ignored", protocol: ValueTypeHttp, labels: map[string]string{LabelGlobalQuic: "true"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route := testRoute("shop", "example.com", 8080, withProtocol(test.protocol))
+			route.Tls = test.tls
+			resolveHttpOptions(&route, portLabels{labels: test.labels, port: 80, container: route.Container}, BindingConfiguration{})
+			if route.Http2 != test.wantHttp2 || route.Quic != test.wantQuic {
+				t.Errorf("http2 = %v, quic = %v, want %v and %v", route.Http2, route.Quic, test.wantHttp2, test.wantQuic)
+			}
+		})
+	}
+}
+
+func TestPublishedOnIpv4(t *testing.T) {
+	ports := []BindingPortMapping{
+		{ContainerPort: 80, HostPort: 8080, Binding: "0.0.0.0", Type: ValueTypeTcp},
+		{ContainerPort: 80, HostPort: 8080, Binding: "::", Type: ValueTypeTcp},
+		{ContainerPort: 53, HostPort: 5353, Binding: "::", Type: ValueTypeUdp},
+		{ContainerPort: 53, HostPort: 5353, Binding: "0.0.0.0", Type: ValueTypeTcp},
+		{ContainerPort: 443, HostPort: 8443, Binding: "::", Type: ValueTypeTcp},
+		{ContainerPort: 443, HostPort: 9443, Binding: "0.0.0.0", Type: ValueTypeTcp},
+		{ContainerPort: 9000, Type: ValueTypeTcp},
+	}
+	want := []bool{false, true, false, false, false, false, false}
+
+	for i, port := range ports {
+		if got := publishedOnIpv4(ports, port); got != want[i] {
+			t.Errorf("publishedOnIpv4(%+v) = %v, want %v", port, got, want[i])
+		}
+	}
+}
+
+func TestResolveContainerRoutesIpv6(t *testing.T) {
+	tests := []struct {
+		name         string
+		labels       map[string]string
+		ports        []BindingPortMapping
+		ipv6         bool
+		want         []string
+		wantDual     bool
+		wantUpstream string
+	}{
+		{
+			name:         "default bind is dual stack with --ipv6",
+			ipv6:         true,
+			want:         []string{"0.0.0.0"},
+			wantDual:     true,
+			wantUpstream: "0.0.0.0:8080",
+		},
+		{
+			name:         "default bind without --ipv6",
+			want:         []string{"0.0.0.0"},
+			wantUpstream: "0.0.0.0:8080",
+		},
+		{
+			name:         "explicit ipv4 bind is not dual stack",
+			labels:       map[string]string{"org.xiomi.nqkd.80.bind": "127.0.0.1"},
+			ipv6:         true,
+			want:         []string{"127.0.0.1"},
+			wantUpstream: "0.0.0.0:8080",
+		},
+		{
+			name:         "brackets are stripped from the bind label",
+			labels:       map[string]string{"org.xiomi.nqkd.80.bind": "[::1]"},
+			ipv6:         true,
+			want:         []string{"::1"},
+			wantUpstream: "0.0.0.0:8080",
+		},
+		{
+			name:         "bind label without brackets",
+			labels:       map[string]string{"org.xiomi.nqkd.bind": "2001:db8::1"},
+			want:         []string{"2001:db8::1"},
+			wantUpstream: "0.0.0.0:8080",
+		},
+		{
+			name: "port published on both stacks is routed once",
+			ports: []BindingPortMapping{
+				{ContainerPort: 80, HostPort: 8080, Binding: "0.0.0.0", Type: ValueTypeTcp},
+				{ContainerPort: 80, HostPort: 8080, Binding: "::", Type: ValueTypeTcp},
+			},
+			ipv6:         true,
+			want:         []string{"0.0.0.0"},
+			wantDual:     true,
+			wantUpstream: "0.0.0.0:8080",
+		},
+		{
+			name:         "port only published on ipv6 is kept",
+			ports:        []BindingPortMapping{{ContainerPort: 80, HostPort: 8080, Binding: "::", Type: ValueTypeTcp}},
+			want:         []string{"0.0.0.0"},
+			wantUpstream: "[::]:8080",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			labels := map[string]string{
+				"org.xiomi.nqkd.80.type":   ValueTypeHttp,
+				"org.xiomi.nqkd.80.ssl":    "false",
+				"org.xiomi.nqkd.80.domain": "example.com",
+			}
+			for key, value := range test.labels {
+				labels[key] = value
+			}
+			container := routeContainer(labels)
+			container.Ports[0].Binding = "0.0.0.0"
+			if test.ports != nil {
+				container.Ports = test.ports
+			}
+
+			routes, err := ResolveContainerRoutes("project", container, BindingConfiguration{Ipv6: test.ipv6})
+			if err != nil {
+				t.Fatalf("ResolveContainerRoutes() error = %v", err)
+			}
+			got := make([]string, 0)
+			for _, route := range routes {
+				got = append(got, route.ListenAddress)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Fatalf("ResolveContainerRoutes() listens on %v, want %v", got, test.want)
+			}
+			if routes[0].DualStack != test.wantDual {
+				t.Errorf("DualStack = %v, want %v", routes[0].DualStack, test.wantDual)
+			}
+			if upstream := routes[0].Upstream.Address(); upstream != test.wantUpstream {
+				t.Errorf("upstream = %v, want %v", upstream, test.wantUpstream)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// HttpServer is every http route sharing a listen address, port and domain. Proxies serve each one as a single virtual
+// host, with each route matched by its path, so routes from any project can share a domain
+type HttpServer struct {
+	// ListenAddress is the address the proxy should bind to on the host
+	ListenAddress string `json:"listen_address"`
+	// ListenPort is the port the proxy should bind to on the host
+	ListenPort uint16 `json:"listen_port"`
+	// Domain is the domain the server answers on
+	Domain string `json:"domain"`
+	// Tls is whether the proxy should terminate TLS for this server
+	Tls bool `json:"tls"`
+	// Certificate is the path to the certificate to use when Tls is enabled, taken from the first route with one
+	Certificate string `json:"certificate,omitempty"`
+	// PrivateKey is the path to the private key for Certificate
+	PrivateKey string `json:"private_key,omitempty"`
+	// Aliases are every alias of every route in the server
+	Aliases []RouteAlias `json:"aliases,omitempty"`
+	// Redirect is whether any route in the server wants plain http on port 80 redirected to it
+	Redirect bool `json:"redirect,omitempty"`
+	// Hsts is the largest hsts max-age of any route in the server
+	Hsts int `json:"hsts,omitempty"`
+	// Http2 is whether any route in the server wants HTTP/2 accepted from clients
+	Http2 bool `json:"http2,omitempty"`
+	// Quic is whether any route in the server wants HTTP/3 over QUIC, only set for tls servers
+	Quic bool `json:"quic,omitempty"`
+	// DualStack is whether the proxy should also bind to every IPv6 address, see Route.DualStack
+	DualStack bool `json:"dual_stack,omitempty"`
+	// QuicReuseport is set on the first quic server of each listen address and port, as nginx only allows reuseport
+	// once per address
+	QuicReuseport bool `json:"quic_reuseport,omitempty"`
+	// Routes are the routes served, sorted by path. Only the replicas of one service share a path, see GroupUpstreams
+	Routes []Route `json:"routes"`
+}
+
+// Listen returns the address and port the proxy should bind to in the form address:port, with IPv6 addresses in
+// brackets
+func (s HttpServer) Listen() string {
+	return s.ListenOn(s.ListenPort)
+}
+
+// ListenOn returns the listen address of the server with another port, ie for the port 80 redirect server
+func (s HttpServer) ListenOn(port uint16) string {
+	return net.JoinHostPort(s.ListenAddress, strconv.Itoa(int(port)))
+}
+
+// RedirectUrl returns the url prefix aliases and port 80 should redirect to, see Route.RedirectUrl
+func (s HttpServer) RedirectUrl() string {
+	return Route{Domain: s.Domain, Tls: s.Tls, ListenPort: s.ListenPort}.RedirectUrl()
+}
+
+// describeRoute identifies a route in errors about it
+func describeRoute(route Route) string {
+	return route.Project + "/" + route.Container + ":" + strconv.Itoa(int(route.ContainerPort))
+}
+
+// GroupHttpServers merges every http route into the servers they will be served from. A route which claims a path
+// already claimed in its server by another service (rather than another replica of the same service), or which
+// disagrees with the server about tls, is left out and reported in the returned error, which joins every conflict.
+// The servers without the conflicting routes are always returned, sorted by domain, listen address and port
+func GroupHttpServers(routes []Route) ([]HttpServer, error) {
+	servers := make([]HttpServer, 0)
+	conflicts := make([]error, 0)
+
+	for _, route := range routes {
+		if !route.IsHttp() {
+			continue
+		}
+
+		index := slices.IndexFunc(servers, func(s HttpServer) bool {
+			return s.ListenAddress == route.ListenAddress && s.ListenPort == route.ListenPort && s.Domain == route.Domain
+		})
+		if index == -1 {
+			servers = append(servers, HttpServer{
+				ListenAddress: route.ListenAddress,
+				ListenPort:    route.ListenPort,
+				Domain:        route.Domain,
+				Tls:           route.Tls,
+				DualStack:     route.DualStack,
+				Routes:        make([]Route, 0),
+			})
+			index = len(servers) - 1
+		}
+		server := &servers[index]
+
+		if server.Tls != route.Tls {
+			conflicts = append(conflicts, fmt.Errorf("%v disagrees with other routes on %v %v about tls", describeRoute(route), server.Domain, server.Listen()))
+			continue
+		}
+		if existing := slices.IndexFunc(server.Routes, func(r Route) bool { return r.Path == route.Path && UpstreamName(r) != UpstreamName(route) }); existing != -1 {
+			conflicts = append(conflicts, fmt.Errorf("path %v on %v %v is claimed by both %v and %v", route.Path, server.Domain, server.Listen(), describeRoute(server.Routes[existing]), describeRoute(route)))
+			continue
+		}
+
+		server.Routes = append(server.Routes, route)
+		if server.Certificate == "" && route.Certificate != "" {
+			server.Certificate, server.PrivateKey = route.Certificate, route.PrivateKey
+		}
+		for _, alias := range route.Aliases {
+			if !slices.ContainsFunc(server.Aliases, func(a RouteAlias) bool { return a.Domain == alias.Domain }) {
+				server.Aliases = append(server.Aliases, alias)
+			}
+		}
+		server.Redirect = server.Redirect || route.Redirect
+		server.Hsts = max(server.Hsts, route.Hsts)
+		server.Http2 = server.Http2 || route.Http2
+		server.Quic = server.Quic || (route.Quic && server.Tls)
+	}
+
+	for i := range servers {
+		slices.SortStableFunc(servers[i].Routes, func(a, b Route) int {
+			return strings.Compare(a.Path, b.Path)
+		})
+	}
+	slices.SortFunc(servers, func(a, b HttpServer) int {
+		if v := strings.Compare(a.Domain, b.Domain); v != 0 {
+			return v
+		}
+		if v := strings.Compare(a.ListenAddress, b.ListenAddress); v != 0 {
+			return v
+		}
+		return int(a.ListenPort) - int(b.ListenPort)
+	})
+
+	reuseport := make(map[string]bool)
+	for i := range servers {
+		if servers[i].Quic && !reuseport[servers[i].Listen()] {
+			reuseport[servers[i].Listen()] = true
+			servers[i].QuicReuseport = true
+		}
+	}
+
+	for _, conflict := range conflicts {
+		slog.Error("Leaving out conflicting http route", "error", conflict)
+	}
+	return servers, errors.Join(conflicts...)
+}
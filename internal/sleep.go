@@ -0,0 +1,416 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAsleepFile is where the daemon records which projects are asleep, and where bindings read it from
+const DefaultAsleepFile = "/var/lib/nqkd/asleep.json"
+
+// HeaderWakeProject is the header the proxy names the asleep project in when it sends a request to the waker
+const HeaderWakeProject = "X-Nqkd-Project"
+
+// wakingPage is served by the waker while a project starts, refreshing until the proxy routes to the project again
+const wakingPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <meta http-equiv="refresh" content="3">
+    <title>Starting up</title>
+    <style>
+        body { font-family: sans-serif; margin: 0; min-height: 100vh; display: flex; align-items: center; justify-content: center; color: #333; background: #f5f5f5; }
+        main { text-align: center; padding: 2em; }
+    </style>
+</head>
+<body>
+<main>
+    <h1>Starting up</h1>
+    <p>This service was asleep and is starting, this page will refresh once it is ready.</p>
+</main>
+</body>
+</html>
+`
+
+// ReadAsleepProjects returns the sorted names of every project asleep according to the file. A missing file means no
+// project is asleep
+func ReadAsleepProjects(path string) ([]string, error) {
+	return readProjectList(path)
+}
+
+// SleepConfiguration controls when idle projects are put to sleep and how they are woken
+type SleepConfiguration struct {
+	// File is where asleep projects are recorded for the bindings to read
+	File string
+	// WakeTimeout is how long a woken project has to become healthy before requests are routed to it regardless
+	WakeTimeout time.Duration
+	// DryRun logs projects which would be put to sleep or woken without stopping or starting them
+	DryRun bool
+	// WakerAllow are the addresses and CIDRs the waker accepts requests from, which should only be the proxy as
+	// anything which can reach the waker can start any asleep project. Requests from anywhere else are refused
+	WakerAllow []string
+}
+
+// Sleeper puts projects with an idle timeout label to sleep once their containers have gone without network traffic
+// for that long, and serves the waker which starts them again on the first request. Projects are stopped rather than
+// removed so they start quickly. The proxy keeps routing to the waker until every container is running and healthy
+type Sleeper struct {
+	config     SleepConfiguration
+	record     *StateRecord
+	lock       *sync.Mutex
+	cli        *client.Client
+	allowed    []*net.IPNet
+	asleep     map[string]bool
+	waking     map[string]bool
+	lastActive map[string]time.Time
+	traffic    map[string]uint64
+	// binding, measure, start and stop talk to docker, these are GetProjectBinding, projectTraffic, ApplyCompose and
+	// StopComposeProject
+	binding func(project ProcessedDockerComposeFile, includeStopped bool) (*BindingProject, error)
+	measure func(binding *BindingProject) (uint64, error)
+	start   func(project ProcessedDockerComposeFile) error
+	stop    func(project ProcessedDockerComposeFile) error
+}
+
+// parseAllowedNetworks parses addresses and CIDRs into networks, a plain address is a network of only that address
+func parseAllowedNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid waker allow entry %q, it must be an address or a CIDR", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// NewSleeper creates a sleeper for the projects in the record, loading the projects which are already asleep from the
+// file. The lock must be the one held while the record is updated
+func NewSleeper(config SleepConfiguration, record *StateRecord, lock *sync.Mutex) (*Sleeper, error) {
+	allowed, err := parseAllowedNetworks(config.WakerAllow)
+	if err != nil {
+		slog.Error("Failed to parse the addresses the waker accepts requests from", "error", err)
+		return nil, err
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		slog.Error("Failed to create the docker client!", "error", err)
+		return nil, err
+	}
+
+	projects, err := ReadAsleepProjects(config.File)
+	if err != nil {
+		slog.Error("Failed to read which projects are asleep", "file", config.File, "error", err)
+		return nil, err
+	}
+
+	sleeper := &Sleeper{
+		config:     config,
+		record:     record,
+		lock:       lock,
+		cli:        cli,
+		allowed:    allowed,
+		asleep:     make(map[string]bool),
+		waking:     make(map[string]bool),
+		lastActive: make(map[string]time.Time),
+		traffic:    make(map[string]uint64),
+		start:      ApplyCompose,
+		stop:       StopComposeProject,
+	}
+	sleeper.binding = func(project ProcessedDockerComposeFile, includeStopped bool) (*BindingProject, error) {
+		return GetProjectBinding(cli, context.Background(), project, includeStopped)
+	}
+	sleeper.measure = sleeper.projectTraffic
+	for _, project := range projects {
+		sleeper.asleep[project] = true
+	}
+	return sleeper, nil
+}
+
+// Sleeping returns whether the project is asleep and not being woken, while this is true the project should not be
+// applied and its containers stopping is expected. The caller should hold the lock
+func (s *Sleeper) Sleeping(project string) bool {
+	return s.asleep[project] && !s.waking[project]
+}
+
+// idleTimeout returns the shortest idle timeout label on any container in the project, or 0 if there is none
+func idleTimeout(binding *BindingProject) time.Duration {
+	var timeout time.Duration
+	for _, container := range binding.Containers {
+		label, ok := container.Labels[LabelIdleTimeout]
+		if !ok {
+			continue
+		}
+		value, err := time.ParseDuration(label)
+		if err != nil || value <= 0 {
+			slog.Error("Ignoring idle timeout label because it is not a duration like 30m", "timeout", label, "project", binding.Project, "container", container.Name)
+			continue
+		}
+		if timeout == 0 || value < timeout {
+			timeout = value
+		}
+	}
+	return timeout
+}
+
+// projectTraffic returns the total bytes sent and received over the network by every container in the project
+func (s *Sleeper) projectTraffic(binding *BindingProject) (uint64, error) {
+	var total uint64
+	for _, container := range binding.Containers {
+		response, err := s.cli.ContainerStatsOneShot(context.Background(), container.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		var stats types.StatsJSON
+		err = json.NewDecoder(response.Body).Decode(&stats)
+		if closeErr := response.Body.Close(); closeErr != nil {
+			slog.Error("Failed to close the container stats", "container", container.Name, "error", closeErr)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		for _, network := range stats.Networks {
+			total += network.RxBytes + network.TxBytes
+		}
+	}
+	return total, nil
+}
+
+// sleepCandidate is a project Check measures the traffic of, copied out of the record so docker can be queried
+// without holding the lock
+type sleepCandidate struct {
+	name    string
+	project ProcessedDockerComposeFile
+}
+
+// eligible returns whether the project can be put to sleep: it is awake, applied and none of its services were
+// stopped on purpose. The caller should hold the lock
+func (s *Sleeper) eligible(name string) bool {
+	state, ok := s.record.Projects[name]
+	return ok && !s.asleep[name] && !s.waking[name] && state.State == ProjectOk && !state.HasStoppedServices()
+}
+
+// Check puts every project to sleep whose containers have not sent or received anything over the network for their
+// idle timeout. A change in traffic between checks counts as activity at the time of the check, so projects sleep up
+// to one check interval after their timeout. The project is recorded as asleep before it is stopped, so requests go to
+// the waker rather than failing. Check takes the lock itself, and only holds it while reading and updating state so
+// docker is never queried with it held
+func (s *Sleeper) Check(now time.Time) {
+	s.lock.Lock()
+	candidates := make([]sleepCandidate, 0)
+	for name, state := range s.record.Projects {
+		if s.eligible(name) {
+			candidates = append(candidates, sleepCandidate{name: name, project: state.Project})
+		}
+	}
+	s.lock.Unlock()
+
+	for _, candidate := range candidates {
+		s.checkProject(candidate, now)
+	}
+}
+
+// checkProject measures the traffic of a single project and puts it to sleep if it has been idle for its timeout
+func (s *Sleeper) checkProject(candidate sleepCandidate, now time.Time) {
+	name := candidate.name
+	binding, err := s.binding(candidate.project, false)
+	if err != nil {
+		slog.Error("Failed to check whether the project is idle", "project", name, "error", err)
+		return
+	}
+	timeout := idleTimeout(binding)
+	var traffic uint64
+	if timeout > 0 && len(binding.Containers) > 0 {
+		traffic, err = s.measure(binding)
+		if err != nil {
+			slog.Error("Failed to read the network traffic of the project", "project", name, "error", err)
+			return
+		}
+	}
+
+	s.lock.Lock()
+	// the project may have been woken, redeployed or removed while docker was queried
+	if !s.eligible(name) {
+		s.lock.Unlock()
+		return
+	}
+	if timeout == 0 || len(binding.Containers) == 0 {
+		delete(s.lastActive, name)
+		delete(s.traffic, name)
+		s.lock.Unlock()
+		return
+	}
+	if last, ok := s.lastActive[name]; !ok || traffic != s.traffic[name] {
+		s.lastActive[name] = now
+		s.traffic[name] = traffic
+		s.lock.Unlock()
+		return
+	} else if now.Sub(last) < timeout {
+		s.lock.Unlock()
+		return
+	}
+
+	if s.config.DryRun {
+		slog.Info("Not putting idle project to sleep because this is a dry run!", "project", name, "timeout", timeout)
+		s.lock.Unlock()
+		return
+	}
+
+	slog.Info("Putting idle project to sleep", "project", name, "timeout", timeout)
+	if _, err := setProjectListed(s.config.File, name, true); err != nil {
+		slog.Error("Failed to record the project as asleep, leaving it running", "project", name, "error", err)
+		s.lock.Unlock()
+		return
+	}
+	s.asleep[name] = true
+	delete(s.lastActive, name)
+	delete(s.traffic, name)
+	s.lock.Unlock()
+
+	if err := s.stop(candidate.project); err != nil {
+		slog.Error("Failed to stop the idle project, it will be started again on the next request", "project", name, "error", err)
+	}
+}
+
+// ready returns whether every container in the project is running and, if it has a health check, healthy
+func (s *Sleeper) ready(project ProcessedDockerComposeFile) bool {
+	binding, err := s.binding(project, true)
+	if err != nil {
+		slog.Error("Failed to check whether the woken project is ready", "project", project.Name, "error", err)
+		return false
+	}
+	if len(binding.Containers) == 0 {
+		return false
+	}
+
+	for _, container := range binding.Containers {
+		if container.State != "running" || (container.Health != "healthy" && container.Health != "none") {
+			return false
+		}
+	}
+	return true
+}
+
+// wake starts the project and waits for it to become ready, up to the wake timeout, before recording it as awake so
+// the proxy routes requests to it again. If starting fails the project is left asleep to be retried on the next request.
+// The lock is only held to read and record state, never while docker compose runs
+func (s *Sleeper) wake(name string) {
+	s.lock.Lock()
+	state, ok := s.record.Projects[name]
+	if !ok {
+		delete(s.waking, name)
+		s.lock.Unlock()
+		return
+	}
+	project := state.Project
+	s.lock.Unlock()
+
+	var err error
+	if s.config.DryRun {
+		slog.Info("Not starting the asleep project because this is a dry run!", "project", name)
+	} else {
+		slog.Info("Waking asleep project", "project", name)
+		err = s.start(project)
+	}
+	if err != nil {
+		slog.Error("Failed to start the asleep project, it will be retried on the next request", "project", name, "error", err)
+		s.lock.Lock()
+		delete(s.waking, name)
+		s.lock.Unlock()
+		return
+	}
+
+	deadline := time.Now().Add(s.config.WakeTimeout)
+	for !s.ready(project) {
+		if time.Now().After(deadline) {
+			slog.Error("The woken project did not become ready in time, routing requests to it regardless", "project", name, "timeout", s.config.WakeTimeout)
+			break
+		}
+		time.Sleep(2 * time.Second)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.waking, name)
+	if _, err := setProjectListed(s.config.File, name, false); err != nil {
+		slog.Error("Failed to record the project as awake, it will be retried on the next request", "project", name, "error", err)
+		return
+	}
+	delete(s.asleep, name)
+	s.lastActive[name] = time.Now()
+	slog.Info("Woke asleep project", "project", name)
+}
+
+// allowedRemote returns whether the remote address of a request is in one of the networks the waker accepts
+func (s *Sleeper) allowedRemote(remote string) bool {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP is the waker, which the proxy sends requests for asleep projects to with the project named in the
+// HeaderWakeProject header. Requests from addresses outside SleepConfiguration.WakerAllow are refused. The first
+// request starts the project and every request is answered with a page which refreshes until the project is ready
+func (s *Sleeper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.allowedRemote(r.RemoteAddr) {
+		slog.Warn("Refusing waker request from an address which isn't allowed, see --waker-allow", "remote", r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	name := r.Header.Get(HeaderWakeProject)
+
+	s.lock.Lock()
+	_, managed := s.record.Projects[name]
+	if managed && s.Sleeping(name) {
+		s.waking[name] = true
+		go s.wake(name)
+	}
+	s.lock.Unlock()
+
+	if !managed {
+		http.Error(w, "project is not managed by nqk", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "3")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if _, err := w.Write([]byte(wakingPage)); err != nil {
+		slog.Debug("Failed to write the waking page", "project", name, "error", err)
+	}
+}
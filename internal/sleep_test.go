@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDocker answers the docker calls of a test sleeper for the shop project
+type fakeDocker struct {
+	lock    sync.Mutex
+	running bool
+	traffic uint64
+	started int
+	stopped int
+	// lockHeld records whether the sleeper lock was held when docker compose ran
+	lockHeld bool
+}
+
+// testSleeper is a sleeper for the shop project whose docker calls are answered by the returned fake, the only
+// container of the project has a 10m idle timeout label
+func testSleeper(t *testing.T, allow ...string) (*Sleeper, *fakeDocker, *sync.Mutex) {
+	t.Helper()
+	record := crashRecord()
+	lock := &sync.Mutex{}
+	allowed, err := parseAllowedNetworks(allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docker := &fakeDocker{running: true}
+	sleeper := &Sleeper{
+		config:     SleepConfiguration{File: filepath.Join(t.TempDir(), "asleep.json"), WakeTimeout: time.Second},
+		record:     record,
+		lock:       lock,
+		allowed:    allowed,
+		asleep:     make(map[string]bool),
+		waking:     make(map[string]bool),
+		lastActive: make(map[string]time.Time),
+		traffic:    make(map[string]uint64),
+	}
+	sleeper.binding = func(project ProcessedDockerComposeFile, includeStopped bool) (*BindingProject, error) {
+		docker.lock.Lock()
+		defer docker.lock.Unlock()
+		state := "exited"
+		if docker.running {
+			state = "running"
+		}
+		container := BindingContainer{Name: "shop-web-1", State: state, Health: "none", Labels: map[string]string{LabelIdleTimeout: "10m"}}
+		return &BindingProject{Project: project.Name, Containers: map[string]BindingContainer{container.Name: container}}, nil
+	}
+	sleeper.measure = func(binding *BindingProject) (uint64, error) {
+		docker.lock.Lock()
+		defer docker.lock.Unlock()
+		return docker.traffic, nil
+	}
+	compose := func(running bool, count *int) func(ProcessedDockerComposeFile) error {
+		return func(ProcessedDockerComposeFile) error {
+			if lock.TryLock() {
+				lock.Unlock()
+			} else {
+				docker.lockHeld = true
+			}
+			docker.lock.Lock()
+			defer docker.lock.Unlock()
+			docker.running = running
+			*count++
+			return nil
+		}
+	}
+	sleeper.start = compose(true, &docker.started)
+	sleeper.stop = compose(false, &docker.stopped)
+	return sleeper, docker, lock
+}
+
+func TestIdleTimeout(t *testing.T) {
+	binding := &BindingProject{Project: "shop", Containers: map[string]BindingContainer{
+		"shop-web-1":    {Name: "shop-web-1", Labels: map[string]string{LabelIdleTimeout: "30m"}},
+		"shop-worker-1": {Name: "shop-worker-1", Labels: map[string]string{LabelIdleTimeout: "10m"}},
+		"shop-db-1":     {Name: "shop-db-1", Labels: map[string]string{LabelIdleTimeout: "soon"}},
+		"shop-cache-1":  {Name: "shop-cache-1", Labels: map[string]string{}},
+	}}
+	if got := idleTimeout(binding); got != 10*time.Minute {
+		t.Errorf("idleTimeout() = %v, want the shortest valid label", got)
+	}
+	if got := idleTimeout(&BindingProject{}); got != 0 {
+		t.Errorf("idleTimeout() = %v, want 0 without labels", got)
+	}
+}
+
+func TestSleeperCheck(t *testing.T) {
+	sleeper, docker, lock := testSleeper(t)
+	start := time.Now()
+
+	sleeper.Check(start)
+	docker.traffic = 100
+	sleeper.Check(start.Add(5 * time.Minute))
+	sleeper.Check(start.Add(14 * time.Minute))
+	if docker.stopped != 0 || sleeper.Sleeping("shop") {
+		t.Fatalf("project was put to sleep %v after its last traffic, want it kept awake for the timeout", 9*time.Minute)
+	}
+
+	if !lock.TryLock() {
+		t.Fatalf("Check() returned with the lock held")
+	}
+	lock.Unlock()
+
+	sleeper.Check(start.Add(16 * time.Minute))
+	if docker.stopped != 1 || !sleeper.Sleeping("shop") {
+		t.Fatalf("stopped %v times and sleeping = %v, want the idle project put to sleep", docker.stopped, sleeper.Sleeping("shop"))
+	}
+	if docker.lockHeld {
+		t.Errorf("the project was stopped with the lock held")
+	}
+	if asleep, err := ReadAsleepProjects(sleeper.config.File); err != nil || !slices.Equal(asleep, []string{"shop"}) {
+		t.Errorf("ReadAsleepProjects() = %v, %v, want shop recorded as asleep", asleep, err)
+	}
+
+	sleeper.Check(start.Add(30 * time.Minute))
+	if docker.stopped != 1 {
+		t.Errorf("stopped %v times, want asleep projects left alone", docker.stopped)
+	}
+}
+
+func TestSleeperCheckSkipsStoppedServices(t *testing.T) {
+	sleeper, docker, _ := testSleeper(t)
+	sleeper.record.Projects["shop"].Services = map[string]*ServiceCrashState{"web": {Stopped: true}}
+	start := time.Now()
+
+	sleeper.Check(start)
+	sleeper.Check(start.Add(time.Hour))
+	if docker.stopped != 0 {
+		t.Errorf("stopped %v times, want projects with stopped services left alone", docker.stopped)
+	}
+}
+
+func TestSleeperWaker(t *testing.T) {
+	tests := []struct {
+		name       string
+		remote     string
+		project    string
+		wantStatus int
+		wantWake   bool
+	}{
+		{name: "allowed address wakes the project", remote: "127.0.0.1:50000", project: "shop", wantStatus: http.StatusServiceUnavailable, wantWake: true},
+		{name: "allowed network", remote: "172.18.0.5:50000", project: "shop", wantStatus: http.StatusServiceUnavailable, wantWake: true},
+		{name: "ipv6 loopback", remote: "[::1]:50000", project: "shop", wantStatus: http.StatusServiceUnavailable, wantWake: true},
+		{name: "other addresses are refused", remote: "203.0.113.9:50000", project: "shop", wantStatus: http.StatusForbidden},
+		{name: "unmanaged projects", remote: "127.0.0.1:50000", project: "blog", wantStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sleeper, docker, lock := testSleeper(t, "127.0.0.0/8", "::1", "172.18.0.0/16")
+			docker.running = false
+			sleeper.asleep["shop"] = true
+			if _, err := setProjectListed(sleeper.config.File, "shop", true); err != nil {
+				t.Fatal(err)
+			}
+
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.RemoteAddr = test.remote
+			request.Header.Set(HeaderWakeProject, test.project)
+			response := httptest.NewRecorder()
+			sleeper.ServeHTTP(response, request)
+			if response.Code != test.wantStatus {
+				t.Fatalf("ServeHTTP() status = %v, want %v", response.Code, test.wantStatus)
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for test.wantWake && time.Now().Before(deadline) {
+				lock.Lock()
+				sleeping := sleeper.asleep["shop"]
+				lock.Unlock()
+				if !sleeping {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if woke := !sleeper.asleep["shop"]; woke != test.wantWake || (docker.started == 1) != test.wantWake {
+				t.Errorf("woke = %v after %v starts, want %v", woke, docker.started, test.wantWake)
+			}
+			if docker.lockHeld {
+				t.Errorf("the project was started with the lock held")
+			}
+		})
+	}
+}
+
+func TestSleeperWakeFailure(t *testing.T) {
+	sleeper, _, lock := testSleeper(t, "127.0.0.1")
+	sleeper.start = func(ProcessedDockerComposeFile) error { return errors.New("compose failed") }
+	sleeper.asleep["shop"] = true
+	sleeper.waking["shop"] = true
+
+	sleeper.wake("shop")
+	lock.Lock()
+	defer lock.Unlock()
+	if !sleeper.Sleeping("shop") {
+		t.Errorf("Sleeping() = false, want the project left asleep to be retried")
+	}
+}
+
+func TestParseAllowedNetworks(t *testing.T) {
+	if _, err := parseAllowedNetworks([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}); err != nil {
+		t.Errorf("parseAllowedNetworks() error = %v", err)
+	}
+	if _, err := parseAllowedNetworks([]string{"localhost"}); err == nil {
+		t.Errorf("parseAllowedNetworks() accepted a hostname")
+	}
+}
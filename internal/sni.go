@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SniListener is every tls passthrough route sharing a listen address and port. Proxies read the SNI of each connection
+// to pick the route whose domain it names, without terminating tls, so services for any number of domains can share
+// one port
+type SniListener struct {
+	// ListenAddress is the address the proxy should bind to on the host
+	ListenAddress string `json:"listen_address"`
+	// ListenPort is the port the proxy should bind to on the host
+	ListenPort uint16 `json:"listen_port"`
+	// DualStack is whether the proxy should also bind to every IPv6 address, see Route.DualStack
+	DualStack bool `json:"dual_stack,omitempty"`
+	// Routes are the routes served, sorted by domain. Only the replicas of one service share a domain
+	Routes []Route `json:"routes"`
+}
+
+// Listen returns the address and port the proxy should bind to in the form address:port, with IPv6 addresses in
+// brackets
+func (s SniListener) Listen() string {
+	return net.JoinHostPort(s.ListenAddress, strconv.Itoa(int(s.ListenPort)))
+}
+
+// Name identifies the listener, this is safe to use as an identifier (ie an nginx variable)
+func (s SniListener) Name() string {
+	return CleanName("nqkd_sni_" + s.Listen())
+}
+
+// GroupSniListeners merges every passthrough route into the listeners they will be served from. A route which claims a
+// domain already claimed on its listener by another service, or which listens on the same address and port as an http
+// route or a tcp route which isn't passthrough, is left out and reported in the returned error, which joins every
+// conflict. Routes with access control labels are left out and logged, as the listener is shared and can't apply them
+// to one domain. The listeners without the conflicting routes are always returned, sorted by listen address and port
+func GroupSniListeners(routes []Route) ([]SniListener, error) {
+	listeners := make([]SniListener, 0)
+	conflicts := make([]error, 0)
+
+	for _, route := range routes {
+		if !route.Passthrough {
+			continue
+		}
+		if route.HasAccessControl() {
+			slog.Error("Leaving out tls passthrough route because access control labels can't be applied to a shared listener", "project", route.Project, "container", route.Container, "port", route.ContainerPort)
+			continue
+		}
+		if plain := slices.IndexFunc(routes, func(r Route) bool {
+			return (r.IsHttp() || r.Protocol == ValueTypeTcp && !r.Passthrough) && r.Listen() == route.Listen()
+		}); plain != -1 {
+			conflicts = append(conflicts, fmt.Errorf("%v listens for tls passthrough on %v which is already used by %v", describeRoute(route), route.Listen(), describeRoute(routes[plain])))
+			continue
+		}
+
+		index := slices.IndexFunc(listeners, func(l SniListener) bool {
+			return l.ListenAddress == route.ListenAddress && l.ListenPort == route.ListenPort
+		})
+		if index == -1 {
+			listeners = append(listeners, SniListener{
+				ListenAddress: route.ListenAddress,
+				ListenPort:    route.ListenPort,
+				DualStack:     route.DualStack,
+				Routes:        make([]Route, 0),
+			})
+			index = len(listeners) - 1
+		}
+		listener := &listeners[index]
+
+		if existing := slices.IndexFunc(listener.Routes, func(r Route) bool { return r.Domain == route.Domain && UpstreamName(r) != UpstreamName(route) }); existing != -1 {
+			conflicts = append(conflicts, fmt.Errorf("domain %v on %v is claimed by both %v and %v", route.Domain, listener.Listen(), describeRoute(listener.Routes[existing]), describeRoute(route)))
+			continue
+		}
+		listener.Routes = append(listener.Routes, route)
+	}
+
+	for i := range listeners {
+		slices.SortStableFunc(listeners[i].Routes, func(a, b Route) int {
+			return strings.Compare(a.Domain, b.Domain)
+		})
+	}
+	slices.SortFunc(listeners, func(a, b SniListener) int {
+		if v := strings.Compare(a.ListenAddress, b.ListenAddress); v != 0 {
+			return v
+		}
+		return int(a.ListenPort) - int(b.ListenPort)
+	})
+
+	for _, conflict := range conflicts {
+		slog.Error("Leaving out conflicting tls passthrough route", "error", conflict)
+	}
+	return listeners, errors.Join(conflicts...)
+}
+
+// resolveSniListen sets the port a tls passthrough route listens on, which is its container port unless overridden.
+// Returns false if the port should be skipped because the route has no domain to match the SNI against, or the
+// override isn't a valid port
+func resolveSniListen(route *Route, labels portLabels) bool {
+	if route.Domain == "" {
+		slog.Error("Skipping port because tls passthrough routes by SNI and needs a domain", "port", labels.port, "container", labels.container)
+		return false
+	}
+
+	portString := labels.value(LabelGlobalPortOverride, LabelPortPortOverride, strconv.Itoa(int(labels.port)))
+	listenPort, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		slog.Error("Skipping port because the port override is not a valid port", "override", portString, "port", labels.port, "container", labels.container)
+		return false
+	}
+	route.ListenPort = uint16(listenPort)
+	return true
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// passthroughRoute is a tls passthrough route of the project for the domain on port 443
+func passthroughRoute(project string, domain string, upstream uint16, options ...func(route *Route)) Route {
+	options = append([]func(route *Route){withProtocol(ValueTypeTcp), onPort(443), func(route *Route) { route.Passthrough = true }}, options...)
+	return testRoute(project, domain, upstream, options...)
+}
+
+func TestGroupSniListeners(t *testing.T) {
+	replica := passthroughRoute("db", "db.example.com", 5433)
+	replica.Container = "db-web-2"
+
+	tests := []struct {
+		name          string
+		routes        []Route
+		wantListeners map[string][]string
+		wantConflicts int
+	}{
+		{
+			name:          "domains share a listener sorted by domain",
+			routes:        []Route{passthroughRoute("mqtt", "mqtt.example.com", 8883), passthroughRoute("db", "db.example.com", 5432)},
+			wantListeners: map[string][]string{"0.0.0.0:443": {"db db.example.com", "mqtt mqtt.example.com"}},
+		},
+		{
+			name:          "listeners are split by port",
+			routes:        []Route{passthroughRoute("db", "db.example.com", 5432), passthroughRoute("mqtt", "mqtt.example.com", 8883, onPort(8883))},
+			wantListeners: map[string][]string{"0.0.0.0:443": {"db db.example.com"}, "0.0.0.0:8883": {"mqtt mqtt.example.com"}},
+		},
+		{
+			name:          "replicas share a domain",
+			routes:        []Route{passthroughRoute("db", "db.example.com", 5432), replica},
+			wantListeners: map[string][]string{"0.0.0.0:443": {"db db.example.com", "db db.example.com"}},
+		},
+		{
+			name:          "second service claiming a domain is left out",
+			routes:        []Route{passthroughRoute("db", "db.example.com", 5432), passthroughRoute("other", "db.example.com", 5433)},
+			wantListeners: map[string][]string{"0.0.0.0:443": {"db db.example.com"}},
+			wantConflicts: 1,
+		},
+		{
+			name:          "http on the same port is a conflict",
+			routes:        []Route{testRoute("web", "example.com", 8080, onPort(443), withTls("")), passthroughRoute("db", "db.example.com", 5432)},
+			wantListeners: map[string][]string{},
+			wantConflicts: 1,
+		},
+		{
+			name:          "plain tcp on the same port is a conflict",
+			routes:        []Route{testRoute("proxy", "", 3128, withProtocol(ValueTypeTcp), onPort(443)), passthroughRoute("db", "db.example.com", 5432), passthroughRoute("mqtt", "mqtt.example.com", 8883)},
+			wantListeners: map[string][]string{},
+			wantConflicts: 2,
+		},
+		{
+			name: "access control is left out without a conflict",
+			routes: []Route{passthroughRoute("db", "db.example.com", 5432, func(route *Route) { route.Allow = []string{"10.0.0.0/8"} }),
+				passthroughRoute("mqtt", "mqtt.example.com", 8883)},
+			wantListeners: map[string][]string{"0.0.0.0:443": {"mqtt mqtt.example.com"}},
+		},
+		{
+			name:          "plain tcp routes are ignored",
+			routes:        []Route{testRoute("proxy", "", 3128, withProtocol(ValueTypeTcp), onPort(3128))},
+			wantListeners: map[string][]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listeners, err := GroupSniListeners(test.routes)
+			conflicts := 0
+			if err != nil {
+				conflicts = len(strings.Split(err.Error(), "\n"))
+			}
+			if conflicts != test.wantConflicts {
+				t.Errorf("GroupSniListeners() reported %v conflicts, want %v: %v", conflicts, test.wantConflicts, err)
+			}
+
+			got := make(map[string][]string)
+			for _, listener := range listeners {
+				for _, route := range listener.Routes {
+					got[listener.Listen()] = append(got[listener.Listen()], route.Project+" "+route.Domain)
+				}
+			}
+			if len(got) != len(test.wantListeners) {
+				t.Errorf("GroupSniListeners() = %v, want %v", got, test.wantListeners)
+			}
+			for listen, want := range test.wantListeners {
+				if !slices.Equal(got[listen], want) {
+					t.Errorf("listener %v has routes %v, want %v", listen, got[listen], want)
+				}
+			}
+		})
+	}
+}
+
+func TestNginxSniOutput(t *testing.T) {
+	got := renderNginx(t, BindingConfiguration{}, passthroughRoute("db", "db.example.com", 5432), passthroughRoute("mqtt", "mqtt.example.com", 8883))
+	expectContent(t, "GenerateFilesForNginxRoutes()", got, []string{
+		"map $ssl_preread_server_name $nqkd_sni_0_0_0_0_443 {\n    hostnames;\n    db.example.com nqkd_db_web_80;\n    mqtt.example.com nqkd_mqtt_web_80;\n}",
+		"listen 0.0.0.0:443;\n    ssl_preread on;\n    proxy_pass $nqkd_sni_0_0_0_0_443;",
+		"upstream nqkd_db_web_80 {\n    server 127.0.0.1:5432;",
+	}, []string{"ssl_certificate"})
+}
@@ -1,6 +1,9 @@
 package internal
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 type ProjectState int
 
@@ -40,23 +43,61 @@ type ActiveProjectState struct {
 	State ProjectState
 	// LastUpdated represents the last time the daemon processed this entry
 	LastUpdated time.Time
+	// Services contains the crash tracking state of each compose service in the project which has reported restarts
+	// or OOMs, keyed by the service name. Services which have never misbehaved will not be present
+	Services map[string]*ServiceCrashState
+}
+
+// ServiceCrashState tracks how a single compose service has been behaving according to the docker event stream
+type ServiceCrashState struct {
+	// Restarts is the number of unexpected exits or restarts seen within the current crash window
+	Restarts int
+	// Ooms is the number of times the service was killed for running out of memory within the current crash window
+	Ooms int
+	// CrashLooping marks that the service passed the restart threshold within the crash window
+	CrashLooping bool
+	// Stopped marks that the daemon stopped this service because it was crash looping. Projects with stopped services
+	// are not re-applied until their configuration changes on disk
+	Stopped bool
+	// LastEvent is the time of the most recent restart or OOM event for this service
+	LastEvent time.Time
+}
+
+// HasStoppedServices returns whether any service in the project was stopped by the daemon for crash looping
+func (a *ActiveProjectState) HasStoppedServices() bool {
+	for _, service := range a.Services {
+		if service.Stopped {
+			return true
+		}
+	}
+
+	return false
 }
 
 // StateRecord contains a mapping of all project names to their most recently observed state
 type StateRecord struct {
 	Projects map[string]*ActiveProjectState
+	// Lock must be held to read or update Projects, or any state within them, as the daemon updates them from events
+	Lock *sync.Mutex
 }
 
 // Update will update the given project to the provided state, handling if this is the first time the project has been
-// seen (in which case it will be inserted), and also automatically setting the LastUpdated time on the state
+// seen (in which case it will be inserted), and also automatically setting the LastUpdated time on the state. If the
+// content of the project has changed since it was last seen, any crash tracking for its services is reset as the new
+// configuration may have fixed the problem
 func (s *StateRecord) Update(project ProcessedDockerComposeFile, state ProjectState) {
 	if _, ok := s.Projects[project.Name]; !ok {
 		s.Projects[project.Name] = &ActiveProjectState{
 			Project:     project,
 			State:       state,
 			LastUpdated: time.Now(),
+			Services:    map[string]*ServiceCrashState{},
 		}
 	} else {
+		if s.Projects[project.Name].Project.Content != project.Content {
+			s.Projects[project.Name].Services = map[string]*ServiceCrashState{}
+		}
+		s.Projects[project.Name].Project = project
 		s.Projects[project.Name].State = state
 		s.Projects[project.Name].LastUpdated = time.Now()
 	}
@@ -72,3 +113,21 @@ func (s *StateRecord) UpdateByName(name string, state ProjectState) {
 		s.Projects[name].LastUpdated = time.Now()
 	}
 }
+
+// Service returns the crash tracking state for the given service in the given project, creating it if this is the
+// first time the service has been seen. Returns nil if the project is not managed by nqk
+func (s *StateRecord) Service(project string, service string) *ServiceCrashState {
+	state, ok := s.Projects[project]
+	if !ok {
+		return nil
+	}
+
+	if state.Services == nil {
+		state.Services = map[string]*ServiceCrashState{}
+	}
+	if _, ok := state.Services[service]; !ok {
+		state.Services[service] = &ServiceCrashState{}
+	}
+
+	return state.Services[service]
+}
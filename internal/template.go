@@ -0,0 +1,331 @@
+package internal
+
+import (
+	"embed"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	// TemplateSuffix is the suffix of every file in a template set which is rendered
+	TemplateSuffix = ".tmpl"
+	// TemplateProjectSuffix marks a template which is rendered once per project, to a file named <project>.<name>
+	TemplateProjectSuffix = ".project" + TemplateSuffix
+	// TemplateRouteSuffix marks a template which is rendered once per route, to a file named
+	// <project>.<container>.<port>.<name>
+	TemplateRouteSuffix = ".route" + TemplateSuffix
+	// TemplateServerSuffix marks a template which is rendered once per http server (see GroupHttpServers), to a file
+	// named <domain>.<listen address>.<port>.<name>
+	TemplateServerSuffix = ".server" + TemplateSuffix
+	// TemplatePartialPrefix marks a template which is not rendered itself, but whose definitions are available to every
+	// other template in the set
+	TemplatePartialPrefix = "_"
+)
+
+//go:embed all:templates
+var embeddedTemplates embed.FS
+
+// DefaultNginxTemplates is the template set used to generate the nginx binding
+var DefaultNginxTemplates = mustSub(embeddedTemplates, "templates/nginx")
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// TemplateData is the value templates are executed against
+type TemplateData struct {
+	// Routes are the routes in scope for this render. For a plain template this is every route, for a project template
+	// it is the routes of Project, for a server template it is the routes of Server and for a route template it is just
+	// Route
+	Routes []Route
+	// Project is the project being rendered, this is empty for plain templates
+	Project string
+	// Route is the route being rendered, this is nil unless this is a route template
+	Route *Route
+	// Server is the http server being rendered, this is nil unless this is a server template
+	Server *HttpServer
+	// Projects is the sorted name of every project with routes
+	Projects []string
+	// Servers is every http server, see GroupHttpServers
+	Servers []HttpServer
+	// Config is the binding configuration the routes were resolved with
+	Config BindingConfiguration
+}
+
+// filterRoutes returns the routes for which keep returns true
+func filterRoutes(routes []Route, keep func(route Route) bool) []Route {
+	result := make([]Route, 0)
+	for _, route := range routes {
+		if keep(route) {
+			result = append(result, route)
+		}
+	}
+	return result
+}
+
+// TemplateFunctions are the helper functions available to every template, on top of the text/template builtins
+var TemplateFunctions = template.FuncMap{
+	"http": func(routes []Route) []Route {
+		return filterRoutes(routes, Route.IsHttp)
+	},
+	"tcp": func(routes []Route) []Route {
+		return filterRoutes(routes, func(route Route) bool { return route.Protocol == ValueTypeTcp })
+	},
+	"udp": func(routes []Route) []Route {
+		return filterRoutes(routes, func(route Route) bool { return route.Protocol == ValueTypeUdp })
+	},
+	"tls": func(routes []Route) []Route {
+		return filterRoutes(routes, func(route Route) bool { return route.Tls })
+	},
+	"project": func(name string, routes []Route) []Route {
+		return filterRoutes(routes, func(route Route) bool { return route.Project == name })
+	},
+	"upstreams": GroupUpstreams,
+	// RenderTemplateSet leaves out conflicting routes before rendering, so a conflict here means the template passed in
+	// routes of its own and fails the render
+	"sni": GroupSniListeners,
+	"domains": func(routes []Route) []string {
+		result := make([]string, 0)
+		for _, route := range routes {
+			if !slices.Contains(result, route.Domain) {
+				result = append(result, route.Domain)
+			}
+		}
+		slices.Sort(result)
+		return result
+	},
+	"default": func(fallback string, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+	"indent": func(spaces int, value string) string {
+		padding := strings.Repeat(" ", spaces)
+		return padding + strings.ReplaceAll(value, "\n", "\n"+padding)
+	},
+	"join":      func(separator string, values []string) string { return strings.Join(values, separator) },
+	"split":     func(separator string, value string) []string { return strings.Split(value, separator) },
+	"lower":     strings.ToLower,
+	"upper":     strings.ToUpper,
+	"trim":      strings.TrimSpace,
+	"replace":   func(old string, new string, value string) string { return strings.ReplaceAll(value, old, new) },
+	"hasPrefix": func(prefix string, value string) bool { return strings.HasPrefix(value, prefix) },
+	"hasSuffix": func(suffix string, value string) bool { return strings.HasSuffix(value, suffix) },
+	"quote":     strconv.Quote,
+	"clean":     CleanName,
+}
+
+// routeFilePrefix is the prefix given to files generated by route templates
+func routeFilePrefix(route Route) string {
+	return route.Project + "." + route.Container + "." + strconv.Itoa(int(route.ContainerPort))
+}
+
+// serverRouteKey identifies a route within the http servers or sni listeners, used to leave routes out once
+// GroupHttpServers or GroupSniListeners has rejected them
+func serverRouteKey(route Route) string {
+	return describeRoute(route) + " " + route.Domain + " " + route.Listen() + " " + route.Path
+}
+
+// serverFilePrefix is the prefix given to files generated by server templates, or false if the domain of the server is
+// not a valid hostname and so can't be used in a file name
+func serverFilePrefix(server HttpServer) (string, bool) {
+	domain := server.Domain
+	if domain == "" {
+		domain = "_"
+	} else if !ValidDomain(domain) {
+		return "", false
+	}
+	return domain + "." + CleanName(server.ListenAddress) + "." + strconv.Itoa(int(server.ListenPort)), true
+}
+
+// renderableRoute returns whether the domain, aliases, path and forward auth path of the route are safe to write into
+// file names and configuration. Routes resolved from labels are already checked, this covers any built some other way
+func renderableRoute(route Route) bool {
+	if route.Domain != "" && !ValidDomain(route.Domain) {
+		return false
+	}
+	for _, alias := range route.Aliases {
+		if !ValidDomain(alias.Domain) {
+			return false
+		}
+	}
+	if route.ForwardAuth != nil && !pathRegex.MatchString(route.ForwardAuth.Path) {
+		return false
+	}
+	return !route.IsHttp() || pathRegex.MatchString(route.Path)
+}
+
+// RenderTemplateSet renders every template in fsys against the routes. Templates are found anywhere in fsys by their
+// suffix, see TemplateSuffix, TemplateProjectSuffix, TemplateServerSuffix and TemplateRouteSuffix for how each is
+// fanned out, and are written to the same subdirectory of the output. Any template prefixed with
+// TemplatePartialPrefix is only made available to the others, wherever it is. Output
+// which is empty once whitespace is removed is not included in the result. Http and tls passthrough routes which
+// conflict (see GroupHttpServers and GroupSniListeners) are logged and left out of every template, so one bad project
+// never blocks the others, as are routes whose domain or path is not valid (see renderableRoute). The result is
+// compatible with WriteFileSetWithDiff
+func RenderTemplateSet(fsys fs.FS, routes []Route, config BindingConfiguration) (map[string]string, error) {
+	partials := make([]string, 0)
+	rendered := make([]string, 0)
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), TemplateSuffix) {
+			return nil
+		}
+
+		if strings.HasPrefix(entry.Name(), TemplatePartialPrefix) {
+			partials = append(partials, name)
+		} else {
+			rendered = append(rendered, name)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to read the template set", "error", err)
+		return nil, err
+	}
+
+	routes = filterRoutes(routes, func(route Route) bool {
+		if !renderableRoute(route) {
+			slog.Error("Leaving out route because its domain or path is not valid", "route", describeRoute(route), "domain", route.Domain, "path", route.Path)
+			return false
+		}
+		return true
+	})
+
+	servers, err := GroupHttpServers(routes)
+	if err != nil {
+		kept := make(map[string]bool)
+		for _, server := range servers {
+			for _, route := range server.Routes {
+				kept[serverRouteKey(route)] = true
+			}
+		}
+		routes = filterRoutes(routes, func(route Route) bool {
+			return !route.IsHttp() || kept[serverRouteKey(route)]
+		})
+	}
+
+	listeners, err := GroupSniListeners(routes)
+	if err != nil {
+		kept := make(map[string]bool)
+		for _, listener := range listeners {
+			for _, route := range listener.Routes {
+				kept[serverRouteKey(route)] = true
+			}
+		}
+		routes = filterRoutes(routes, func(route Route) bool {
+			return !route.Passthrough || kept[serverRouteKey(route)]
+		})
+	}
+
+	projects := make([]string, 0)
+	byProject := make(map[string][]Route)
+	for _, route := range routes {
+		if _, ok := byProject[route.Project]; !ok {
+			projects = append(projects, route.Project)
+		}
+		byProject[route.Project] = append(byProject[route.Project], route)
+	}
+	slices.Sort(projects)
+
+	result := make(map[string]string)
+	render := func(tmpl *template.Template, filename string, data TemplateData) error {
+		var builder strings.Builder
+		if err := tmpl.Execute(&builder, data); err != nil {
+			slog.Error("Failed to render template", "template", tmpl.Name(), "file", filename, "error", err)
+			return err
+		}
+
+		if len(strings.TrimSpace(builder.String())) > 0 {
+			result[filename] = builder.String()
+		}
+		return nil
+	}
+
+	for _, file := range rendered {
+		// templates in a subdirectory render into the same subdirectory of the output
+		dir, name := path.Split(file)
+		tmpl, err := template.New(name).Funcs(TemplateFunctions).ParseFS(fsys, append([]string{file}, partials...)...)
+		if err != nil {
+			slog.Error("Failed to parse template", "template", file, "error", err)
+			return nil, err
+		}
+
+		switch {
+		case strings.HasSuffix(name, TemplateRouteSuffix):
+			base := strings.TrimSuffix(name, TemplateRouteSuffix)
+			for i := range routes {
+				route := routes[i]
+				err = render(tmpl, dir+routeFilePrefix(route)+"."+base, TemplateData{
+					Routes:   []Route{route},
+					Project:  route.Project,
+					Route:    &route,
+					Projects: projects,
+					Servers:  servers,
+					Config:   config,
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		case strings.HasSuffix(name, TemplateProjectSuffix):
+			base := strings.TrimSuffix(name, TemplateProjectSuffix)
+			for _, project := range projects {
+				err = render(tmpl, dir+project+"."+base, TemplateData{
+					Routes:   byProject[project],
+					Project:  project,
+					Projects: projects,
+					Servers:  servers,
+					Config:   config,
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		case strings.HasSuffix(name, TemplateServerSuffix):
+			base := strings.TrimSuffix(name, TemplateServerSuffix)
+			for i := range servers {
+				server := servers[i]
+				prefix, ok := serverFilePrefix(server)
+				if !ok {
+					slog.Error("Skipping server because its domain is not a valid hostname", "domain", server.Domain, "listen", server.Listen())
+					continue
+				}
+				err = render(tmpl, dir+prefix+"."+base, TemplateData{
+					Routes:   server.Routes,
+					Server:   &server,
+					Projects: projects,
+					Servers:  servers,
+					Config:   config,
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		default:
+			err = render(tmpl, dir+strings.TrimSuffix(name, TemplateSuffix), TemplateData{
+				Routes:   routes,
+				Projects: projects,
+				Servers:  servers,
+				Config:   config,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"golang.org/x/exp/maps"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRenderTemplateSetLeavesOutConflicts(t *testing.T) {
+	templates := fstest.MapFS{
+		"site.server.tmpl":  {Data: []byte("{{ range .Routes }}{{ .Project }} {{ .Path }}\n{{ end }}")},
+		"list.project.tmpl": {Data: []byte("{{ range .Routes }}{{ .Domain }}\n{{ end }}")},
+		"sni.tmpl":          {Data: []byte("{{ range sni .Routes }}{{ range .Routes }}{{ .Project }}\n{{ end }}{{ end }}")},
+	}
+
+	passthrough := func(project string) Route {
+		route := testRoute(project, "tls.example.com", 8443, withProtocol(ValueTypeTcp), onPort(443))
+		route.Passthrough = true
+		return route
+	}
+	routes := []Route{
+		testRoute("first", "example.com", 8080),
+		testRoute("second", "example.com", 8081),
+		testRoute("third", "example.org", 8082),
+		passthrough("first"),
+		passthrough("second"),
+	}
+
+	files, err := RenderTemplateSet(templates, routes, BindingConfiguration{})
+	if err != nil {
+		t.Fatalf("RenderTemplateSet() error = %v, conflicts should only be logged", err)
+	}
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{file: "example.com.0_0_0_0.80.site", want: "first /\n"},
+		{file: "example.org.0_0_0_0.80.site", want: "third /\n"},
+		{file: "first.list", want: "example.com\ntls.example.com\n"},
+		{file: "third.list", want: "example.org\n"},
+		{file: "sni", want: "first\n"},
+	}
+	for _, test := range tests {
+		if got := files[test.file]; got != test.want {
+			t.Errorf("file %v = %q, want %q", test.file, got, test.want)
+		}
+	}
+	if _, ok := files["second.list"]; ok {
+		t.Errorf("second.list = %q, want every conflicting route of the project left out", files["second.list"])
+	}
+	for name, content := range files {
+		if strings.Contains(content, "second /") {
+			t.Errorf("file %v contains the conflicting route: %q", name, content)
+		}
+	}
+}
+
+func TestGroupHttpServersConflicts(t *testing.T) {
+	replica := testRoute("first", "example.com", 8090)
+	replica.Container = "first-web-2"
+
+	tests := []struct {
+		name          string
+		routes        []Route
+		wantServers   map[string][]string
+		wantConflicts int
+	}{
+		{
+			name:        "different paths share a server",
+			routes:      []Route{testRoute("first", "example.com", 8080), testRoute("second", "example.com", 8081, withPath("/api/"))},
+			wantServers: map[string][]string{"example.com": {"first /", "second /api/"}},
+		},
+		{
+			name:        "replicas of a service share a path",
+			routes:      []Route{testRoute("first", "example.com", 8080), replica},
+			wantServers: map[string][]string{"example.com": {"first /", "first /"}},
+		},
+		{
+			name:          "second service claiming a path is left out",
+			routes:        []Route{testRoute("first", "example.com", 8080), testRoute("second", "example.com", 8081), testRoute("third", "example.org", 8082)},
+			wantServers:   map[string][]string{"example.com": {"first /"}, "example.org": {"third /"}},
+			wantConflicts: 1,
+		},
+		{
+			name:          "route disagreeing about tls is left out",
+			routes:        []Route{testRoute("first", "example.com", 8080, withTls("")), testRoute("second", "example.com", 8081, withPath("/api/"))},
+			wantServers:   map[string][]string{"example.com": {"first /"}},
+			wantConflicts: 1,
+		},
+		{
+			name:          "every conflict is reported",
+			routes:        []Route{testRoute("first", "example.com", 8080), testRoute("second", "example.com", 8081), testRoute("third", "example.com", 8082, withPath("/api/"), withTls(""))},
+			wantServers:   map[string][]string{"example.com": {"first /"}},
+			wantConflicts: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			servers, err := GroupHttpServers(test.routes)
+			conflicts := 0
+			if err != nil {
+				conflicts = len(strings.Split(err.Error(), "\n"))
+			}
+			if conflicts != test.wantConflicts {
+				t.Errorf("GroupHttpServers() reported %v conflicts, want %v: %v", conflicts, test.wantConflicts, err)
+			}
+
+			got := make(map[string][]string)
+			for _, server := range servers {
+				for _, route := range server.Routes {
+					got[server.Domain] = append(got[server.Domain], route.Project+" "+route.Path)
+				}
+			}
+			if len(got) != len(test.wantServers) {
+				t.Errorf("GroupHttpServers() = %v, want %v", got, test.wantServers)
+			}
+			for domain, want := range test.wantServers {
+				if !slices.Equal(got[domain], want) {
+					t.Errorf("server %v has routes %v, want %v", domain, got[domain], want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderTemplateSetLeavesOutInvalidRoutes(t *testing.T) {
+	templates := fstest.MapFS{
+		"site.server.tmpl": {Data: []byte("{{ range .Routes }}location {{ .Path }} {}\n{{ end }}")},
+	}
+	aliased := testRoute("fourth", "example.net", 8083)
+	aliased.Aliases = []RouteAlias{{Domain: "x; include /etc/shadow"}}
+	routes := []Route{
+		testRoute("first", "example.com", 8080),
+		testRoute("second", "example.com", 8081, withPath("/x {} location /")),
+		testRoute("third", "../../etc/x", 8082),
+		aliased,
+	}
+
+	files, err := RenderTemplateSet(templates, routes, BindingConfiguration{})
+	if err != nil {
+		t.Fatalf("RenderTemplateSet() error = %v, invalid routes should only be logged", err)
+	}
+	if len(files) != 1 || files["example.com.0_0_0_0.80.site"] != "location / {}\n" {
+		t.Errorf("RenderTemplateSet() = %q, want only the valid route", files)
+	}
+}
+
+// renderNginx generates the nginx files for the routes and joins them in name order, for asserting on fragments
+func renderNginx(t *testing.T, config BindingConfiguration, routes ...Route) string {
+	t.Helper()
+	files, err := GenerateFilesForNginxRoutes(routes, config)
+	if err != nil {
+		t.Fatalf("GenerateFilesForNginxRoutes() error = %v", err)
+	}
+	names := maps.Keys(files)
+	slices.Sort(names)
+	var builder strings.Builder
+	for _, name := range names {
+		builder.WriteString(files[name])
+	}
+	return builder.String()
+}
+
+func TestNginxRedirects(t *testing.T) {
+	secure := func(options ...func(route *Route)) Route {
+		options = append([]func(route *Route){onPort(443), withTls("/etc/ssl/example.com.crt")}, options...)
+		return testRoute("shop", "example.com", 8080, options...)
+	}
+	redirect := func(route *Route) { route.Redirect = true }
+	hsts := func(route *Route) { route.Hsts = 31536000 }
+	alias := func(certificate string) func(route *Route) {
+		return func(route *Route) {
+			route.Aliases = []RouteAlias{{Domain: "www.example.com", Certificate: certificate, PrivateKey: certificate + ".key"}}
+		}
+	}
+
+	tests := []struct {
+		name    string
+		route   Route
+		config  BindingConfiguration
+		want    []string
+		notWant []string
+	}{
+		{
+			name:  "tls redirects plain http",
+			route: secure(redirect),
+			want:  []string{"listen 0.0.0.0:80;", "server_name example.com;", "return 301 https://example.com$request_uri;"},
+		},
+		{
+			name:    "tls without a redirect has no plain http server",
+			route:   secure(),
+			notWant: []string{"listen 0.0.0.0:80;", "return 301"},
+		},
+		{
+			name:    "tls without a redirect still answers challenges",
+			route:   secure(),
+			config:  BindingConfiguration{AcmeWebroot: "/var/www/acme"},
+			want:    []string{"listen 0.0.0.0:80;", "location /.well-known/acme-challenge/", "return 404;"},
+			notWant: []string{"return 301"},
+		},
+		{
+			name:  "redirects keep a non standard port",
+			route: testRoute("shop", "example.com", 8080, onPort(8443), withTls("/etc/ssl/example.com.crt"), redirect),
+			want:  []string{"return 301 https://example.com:8443$request_uri;"},
+		},
+		{
+			name:  "hsts is sent by tls servers and aliases",
+			route: secure(hsts, alias("/etc/ssl/www.example.com.crt")),
+			want: []string{
+				"server_name www.example.com;\n    add_header Strict-Transport-Security \"max-age=31536000\" always;\n    return 301 https://example.com$request_uri;",
+				"server_name example.com;\n    add_header Strict-Transport-Security \"max-age=31536000\" always;",
+			},
+		},
+		{
+			name:    "hsts is repeated in locations with their own headers",
+			route:   secure(hsts, func(route *Route) { route.Headers = []RouteHeader{{Name: "X-Frame-Options", Value: "DENY"}} }),
+			want:    []string{"# add_header in a location replaces the ones from the server\n        add_header Strict-Transport-Security"},
+			notWant: []string{"listen 0.0.0.0:80;"},
+		},
+		{
+			name:    "tls aliases without a certificate are only redirected over plain http",
+			route:   secure(redirect, alias("")),
+			want:    []string{"server_name example.com www.example.com;\n", "return 301 https://example.com$request_uri;"},
+			notWant: []string{"server_name www.example.com;"},
+		},
+		{
+			name:    "plain http aliases redirect to the domain",
+			route:   testRoute("shop", "example.com", 8080, alias("")),
+			want:    []string{"server_name www.example.com;\n", "return 301 http://example.com$request_uri;"},
+			notWant: []string{"listen 0.0.0.0:443"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := renderNginx(t, test.config, test.route)
+			expectContent(t, "GenerateFilesForNginxRoutes()", got, test.want, test.notWant)
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"gopkg.in/yaml.v2"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// TraefikFileSuffix ends the name of every dynamic configuration file written for traefik. Every file in the output
+// directory with this suffix is treated as generated by nqk, so stale ones can be removed without keeping a manifest
+// in the directory traefik watches
+const TraefikFileSuffix = ".nqkd.yml"
+
+// TraefikConfiguration controls how routes are mapped onto traefik entrypoints. Entrypoints are part of the traefik
+// static configuration so they must be defined there, the names used for ports which are not the standard http ports
+// are <protocol>-<port> (ie tcp-5432, udp-53 or http-8080)
+type TraefikConfiguration struct {
+	// HttpEntrypoint is the entrypoint which serves plain http on port 80
+	HttpEntrypoint string
+	// HttpsEntrypoint is the entrypoint which serves https on port 443
+	HttpsEntrypoint string
+}
+
+type traefikDynamic struct {
+	Http *traefikHttp `yaml:"http,omitempty"`
+	Tcp  *traefikTcp  `yaml:"tcp,omitempty"`
+	Udp  *traefikUdp  `yaml:"udp,omitempty"`
+	Tls  *traefikTls  `yaml:"tls,omitempty"`
+}
+
+type traefikHttp struct {
+	Routers           map[string]traefikRouter           `yaml:"routers"`
+	Services          map[string]traefikHttpService      `yaml:"services"`
+	Middlewares       map[string]traefikMiddleware       `yaml:"middlewares,omitempty"`
+	ServersTransports map[string]traefikServersTransport `yaml:"serversTransports,omitempty"`
+}
+
+type traefikTcp struct {
+	Routers  map[string]traefikRouter     `yaml:"routers"`
+	Services map[string]traefikTcpService `yaml:"services"`
+}
+
+type traefikUdp struct {
+	Routers  map[string]traefikRouter     `yaml:"routers"`
+	Services map[string]traefikTcpService `yaml:"services"`
+}
+
+type traefikRouter struct {
+	Rule        string            `yaml:"rule,omitempty"`
+	EntryPoints []string          `yaml:"entryPoints"`
+	Middlewares []string          `yaml:"middlewares,omitempty"`
+	Service     string            `yaml:"service"`
+	Tls         *traefikRouterTls `yaml:"tls,omitempty"`
+}
+
+type traefikMiddleware struct {
+	StripPrefix *traefikStripPrefix `yaml:"stripPrefix,omitempty"`
+}
+
+type traefikStripPrefix struct {
+	Prefixes []string `yaml:"prefixes"`
+}
+
+type traefikRouterTls struct {
+	Passthrough bool `yaml:"passthrough,omitempty"`
+}
+
+type traefikHttpService struct {
+	LoadBalancer traefikHttpLoadBalancer `yaml:"loadBalancer"`
+}
+
+type traefikHttpLoadBalancer struct {
+	Servers          []traefikHttpServer `yaml:"servers"`
+	ServersTransport string              `yaml:"serversTransport,omitempty"`
+}
+
+type traefikServersTransport struct {
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+}
+
+type traefikHttpServer struct {
+	Url string `yaml:"url"`
+}
+
+type traefikTcpService struct {
+	LoadBalancer traefikTcpLoadBalancer `yaml:"loadBalancer"`
+}
+
+type traefikTcpLoadBalancer struct {
+	Servers []traefikTcpServer `yaml:"servers"`
+}
+
+type traefikTcpServer struct {
+	Address string `yaml:"address"`
+}
+
+type traefikTls struct {
+	Certificates []traefikCertificate `yaml:"certificates"`
+}
+
+type traefikCertificate struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// TraefikEntrypoint returns the name of the entrypoint the route should be attached to
+func TraefikEntrypoint(route Route, config TraefikConfiguration) string {
+	if route.IsHttp() {
+		if route.Tls && route.ListenPort == 443 {
+			return config.HttpsEntrypoint
+		}
+		if !route.Tls && route.ListenPort == 80 {
+			return config.HttpEntrypoint
+		}
+		return "http-" + strconv.Itoa(int(route.ListenPort))
+	}
+
+	return route.Protocol + "-" + strconv.Itoa(int(route.ListenPort))
+}
+
+// traefikName returns a router, service or middleware name made from the parts. Cleaning the parts can map different
+// values onto the same name (ie a-b and a_b), so a hash of the original parts is appended to keep every name unique
+func traefikName(parts ...string) string {
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return CleanName(strings.Join(parts, "_")) + "_" + hex.EncodeToString(hash[:4])
+}
+
+// GenerateTraefikProjectConfiguration renders the routes of a single project into traefik dynamic configuration. Http
+// routes sharing a domain, path and entrypoint become one router with a load balanced service (with a stripPrefix
+// middleware when the path should be stripped, and a servers transport which skips certificate verification for https
+// upstreams like the other bindings do), tcp routes are matched by SNI when tls is enabled or passed through (and any
+// SNI otherwise), and udp routes are bound to their entrypoint. Names are made unique with the project so files from
+// multiple projects can be loaded from one directory
+func GenerateTraefikProjectConfiguration(project string, routes []Route, config TraefikConfiguration) (string, error) {
+	dynamic := traefikDynamic{}
+	certificates := make(map[string]bool)
+
+	for _, route := range routes {
+		if route.Asleep {
+			slog.Warn("Skipping route because waking asleep projects is only supported by the nginx binding", "project", route.Project, "container", route.Container, "port", route.ContainerPort)
+			continue
+		}
+		if route.HasAccessControl() {
+			slog.Warn("Skipping route because access control labels are only supported by the nginx binding", "project", route.Project, "container", route.Container, "port", route.ContainerPort)
+			continue
+		}
+		entrypoint := TraefikEntrypoint(route, config)
+		name := traefikName(project, route.Domain, entrypoint)
+
+		if route.Tls && route.Certificate != "" && !certificates[route.Certificate] {
+			certificates[route.Certificate] = true
+			if dynamic.Tls == nil {
+				dynamic.Tls = &traefikTls{Certificates: make([]traefikCertificate, 0)}
+			}
+			dynamic.Tls.Certificates = append(dynamic.Tls.Certificates, traefikCertificate{CertFile: route.Certificate, KeyFile: route.PrivateKey})
+		}
+
+		switch {
+		case route.IsHttp():
+			if dynamic.Http == nil {
+				dynamic.Http = &traefikHttp{Routers: map[string]traefikRouter{}, Services: map[string]traefikHttpService{}}
+			}
+
+			router := traefikRouter{
+				Rule:        "Host(`" + route.Domain + "`)",
+				EntryPoints: []string{entrypoint},
+				Service:     name,
+			}
+			if route.Path != "/" {
+				name = traefikName(project, route.Domain, entrypoint, route.Path)
+				router.Rule += " && PathPrefix(`" + route.Path + "`)"
+				router.Service = name
+			}
+			if route.StripPath {
+				if dynamic.Http.Middlewares == nil {
+					dynamic.Http.Middlewares = map[string]traefikMiddleware{}
+				}
+				dynamic.Http.Middlewares[name] = traefikMiddleware{StripPrefix: &traefikStripPrefix{Prefixes: []string{route.Path}}}
+				router.Middlewares = []string{name}
+			}
+			if route.Tls {
+				router.Tls = &traefikRouterTls{}
+			}
+			dynamic.Http.Routers[name] = router
+
+			service := dynamic.Http.Services[name]
+			service.LoadBalancer.Servers = append(service.LoadBalancer.Servers, traefikHttpServer{Url: route.Upstream.UrlScheme() + "://" + route.Upstream.Address()})
+			if route.Upstream.IsTls() {
+				transport := traefikName(project, "insecure")
+				if dynamic.Http.ServersTransports == nil {
+					dynamic.Http.ServersTransports = map[string]traefikServersTransport{}
+				}
+				dynamic.Http.ServersTransports[transport] = traefikServersTransport{InsecureSkipVerify: true}
+				service.LoadBalancer.ServersTransport = transport
+			}
+			dynamic.Http.Services[name] = service
+		case route.Protocol == ValueTypeTcp:
+			if dynamic.Tcp == nil {
+				dynamic.Tcp = &traefikTcp{Routers: map[string]traefikRouter{}, Services: map[string]traefikTcpService{}}
+			}
+
+			router := traefikRouter{
+				Rule:        "HostSNI(`*`)",
+				EntryPoints: []string{entrypoint},
+				Service:     name,
+			}
+			if route.Tls || route.Passthrough {
+				router.Rule = "HostSNI(`" + route.Domain + "`)"
+				router.Tls = &traefikRouterTls{Passthrough: route.Passthrough}
+			}
+			dynamic.Tcp.Routers[name] = router
+
+			service := dynamic.Tcp.Services[name]
+			service.LoadBalancer.Servers = append(service.LoadBalancer.Servers, traefikTcpServer{Address: route.Upstream.Address()})
+			dynamic.Tcp.Services[name] = service
+		case route.Protocol == ValueTypeUdp:
+			if dynamic.Udp == nil {
+				dynamic.Udp = &traefikUdp{Routers: map[string]traefikRouter{}, Services: map[string]traefikTcpService{}}
+			}
+
+			dynamic.Udp.Routers[name] = traefikRouter{
+				EntryPoints: []string{entrypoint},
+				Service:     name,
+			}
+
+			service := dynamic.Udp.Services[name]
+			service.LoadBalancer.Servers = append(service.LoadBalancer.Servers, traefikTcpServer{Address: route.Upstream.Address()})
+			dynamic.Udp.Services[name] = service
+		default:
+			slog.Warn("Failed to create binding because the protocol was not recognised", "protocol", route.Protocol)
+		}
+	}
+
+	marshal, err := yaml.Marshal(dynamic)
+	if err != nil {
+		return "", err
+	}
+
+	return string(marshal), nil
+}
+
+// GenerateFilesForTraefikRoutes will generate a traefik dynamic configuration file for each project in the format
+// `<project>.nqkd.yml`, suitable for the traefik file provider watching a directory. Projects without routes produce no
+// file. The result is compatible with SyncSuffixedFileSetWithDiff using TraefikFileSuffix
+func GenerateFilesForTraefikRoutes(routes []Route, config TraefikConfiguration) (map[string]string, error) {
+	projects := make(map[string][]Route)
+	for _, route := range routes {
+		projects[route.Project] = append(projects[route.Project], route)
+	}
+
+	result := make(map[string]string)
+	for project, projectRoutes := range projects {
+		content, err := GenerateTraefikProjectConfiguration(project, projectRoutes, config)
+		if err != nil {
+			slog.Error("Failed to generate traefik configuration for project", "project", project, "error", err)
+			return nil, err
+		}
+
+		result[project+TraefikFileSuffix] = content
+	}
+
+	return result, nil
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"golang.org/x/exp/maps"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// generateTraefik renders the routes for the project and parses the result back
+func generateTraefik(t *testing.T, project string, routes ...Route) traefikDynamic {
+	t.Helper()
+	generated, err := GenerateTraefikProjectConfiguration(project, routes, TraefikConfiguration{HttpEntrypoint: "web", HttpsEntrypoint: "websecure"})
+	if err != nil {
+		t.Fatalf("GenerateTraefikProjectConfiguration() error = %v", err)
+	}
+
+	var dynamic traefikDynamic
+	if err := yaml.Unmarshal([]byte(generated), &dynamic); err != nil {
+		t.Fatalf("GenerateTraefikProjectConfiguration() produced invalid yaml: %v", err)
+	}
+	return dynamic
+}
+
+func TestTraefikEntrypoint(t *testing.T) {
+	config := TraefikConfiguration{HttpEntrypoint: "web", HttpsEntrypoint: "websecure"}
+	tests := []struct {
+		name   string
+		modify func(route *Route)
+		want   string
+	}{
+		{name: "plain http on 80", modify: func(route *Route) {}, want: "web"},
+		{name: "https on 443", modify: func(route *Route) { route.Tls, route.ListenPort = true, 443 }, want: "websecure"},
+		{name: "http on another port", modify: func(route *Route) { route.ListenPort = 8080 }, want: "http-8080"},
+		{name: "tcp", modify: func(route *Route) { route.Protocol, route.ListenPort = ValueTypeTcp, 5432 }, want: "tcp-5432"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route := testRoute("shop", "example.com", 8080)
+			test.modify(&route)
+			if got := TraefikEntrypoint(route, config); got != test.want {
+				t.Errorf("TraefikEntrypoint() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTraefikNamesAreUnique(t *testing.T) {
+	dynamic := generateTraefik(t, "shop", testRoute("shop", "a-b.example.com", 8080), testRoute("shop", "a_b.example.com", 8081))
+	if len(dynamic.Http.Routers) != 2 || len(dynamic.Http.Services) != 2 {
+		t.Fatalf("got routers %v, want one per domain", maps.Keys(dynamic.Http.Routers))
+	}
+	for name, router := range dynamic.Http.Routers {
+		if len(dynamic.Http.Services[router.Service].LoadBalancer.Servers) != 1 {
+			t.Errorf("router %v has service %+v, want one server", name, dynamic.Http.Services[router.Service])
+		}
+	}
+
+	if traefikName("a_b", "c") == traefikName("a", "b_c") {
+		t.Errorf("traefikName() is the same for parts which clean to the same name")
+	}
+}
+
+func TestGenerateTraefikProjectConfiguration(t *testing.T) {
+	t.Run("replicas share a service", func(t *testing.T) {
+		dynamic := generateTraefik(t, "shop", testRoute("shop", "example.com", 8080), testRoute("shop", "example.com", 8081))
+		if len(dynamic.Http.Routers) != 1 {
+			t.Fatalf("got %v routers, want 1", len(dynamic.Http.Routers))
+		}
+		for _, router := range dynamic.Http.Routers {
+			if router.Rule != "Host(`example.com`)" || router.EntryPoints[0] != "web" {
+				t.Errorf("router = %+v, want a host rule on web", router)
+			}
+			if servers := dynamic.Http.Services[router.Service].LoadBalancer.Servers; len(servers) != 2 {
+				t.Errorf("service servers = %v, want both replicas", servers)
+			}
+		}
+	})
+
+	t.Run("paths are stripped with a middleware", func(t *testing.T) {
+		route := testRoute("shop", "example.com", 8080)
+		route.Path, route.StripPath = "/api/", true
+		dynamic := generateTraefik(t, "shop", route)
+		for _, router := range dynamic.Http.Routers {
+			if router.Rule != "Host(`example.com`) && PathPrefix(`/api/`)" || len(router.Middlewares) != 1 {
+				t.Fatalf("router = %+v, want a path rule with a middleware", router)
+			}
+			if middleware := dynamic.Http.Middlewares[router.Middlewares[0]]; middleware.StripPrefix == nil || middleware.StripPrefix.Prefixes[0] != "/api/" {
+				t.Errorf("middleware = %+v, want /api/ stripped", middleware)
+			}
+		}
+	})
+
+	t.Run("https upstreams skip verification", func(t *testing.T) {
+		secure := testRoute("shop", "secure.example.com", 8443)
+		secure.Upstream.Scheme = ValueTypeHttps
+		dynamic := generateTraefik(t, "shop", secure, testRoute("shop", "plain.example.com", 8080))
+		for _, router := range dynamic.Http.Routers {
+			service := dynamic.Http.Services[router.Service]
+			transport, ok := dynamic.Http.ServersTransports[service.LoadBalancer.ServersTransport]
+			if router.Rule == "Host(`secure.example.com`)" && (!ok || !transport.InsecureSkipVerify || service.LoadBalancer.Servers[0].Url != "https://127.0.0.1:8443") {
+				t.Errorf("https service = %+v, want an https server with an insecure transport", service)
+			}
+			if router.Rule == "Host(`plain.example.com`)" && service.LoadBalancer.ServersTransport != "" {
+				t.Errorf("http service = %+v, want the default transport", service)
+			}
+		}
+	})
+
+	t.Run("tcp and udp routes", func(t *testing.T) {
+		tcp := testRoute("shop", "db.example.com", 5432)
+		tcp.Protocol, tcp.ListenPort, tcp.Passthrough = ValueTypeTcp, 5432, true
+		udp := testRoute("shop", "dns.example.com", 53)
+		udp.Protocol, udp.ListenPort = ValueTypeUdp, 53
+		dynamic := generateTraefik(t, "shop", tcp, udp)
+		for _, router := range dynamic.Tcp.Routers {
+			if router.Rule != "HostSNI(`db.example.com`)" || router.Tls == nil || !router.Tls.Passthrough {
+				t.Errorf("tcp router = %+v, want passthrough by SNI", router)
+			}
+		}
+		for _, router := range dynamic.Udp.Routers {
+			if router.EntryPoints[0] != "udp-53" {
+				t.Errorf("udp router = %+v, want the udp-53 entrypoint", router)
+			}
+		}
+	})
+}
+
+func TestSyncTraefikFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"old.nqkd.yml": "stale", "manual.yml": "kept"})
+	files, err := GenerateFilesForTraefikRoutes([]Route{testRoute("shop", "example.com", 8080)}, TraefikConfiguration{HttpEntrypoint: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := SyncSuffixedFileSetWithDiff(files, dir, TraefikFileSuffix)
+	if err != nil || !changed {
+		t.Fatalf("SyncSuffixedFileSetWithDiff() = %v, %v, want changed", changed, err)
+	}
+	got := readTree(t, dir)
+	if _, ok := got["old.nqkd.yml"]; ok || got["manual.yml"] != "kept" || got["shop.nqkd.yml"] == "" {
+		t.Errorf("directory = %v, want the stale file replaced and other files kept", maps.Keys(got))
+	}
+	if _, ok := got[ManifestFile]; ok {
+		t.Errorf("a manifest was written into the directory traefik watches")
+	}
+
+	// touching leaves the content alone
+	if err := TouchFileSet(files, dir); err != nil {
+		t.Fatalf("TouchFileSet() error = %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "shop.nqkd.yml")); string(data) != files["shop.nqkd.yml"] {
+		t.Errorf("TouchFileSet() changed the file")
+	}
+}
@@ -1,9 +1,7 @@
 package internal
 
 import (
-	"context"
 	"errors"
-	"github.com/docker/docker/client"
 	"gopkg.in/yaml.v2"
 	"log/slog"
 	"os"
@@ -136,15 +134,6 @@ func ProcessDockerComposeFile(file string) (*ProcessedDockerComposeFile, error)
 	}, nil
 }
 
-// NginxProjectBinding is a binding for a single project, including any http specific bindings, and general TCP/UDP
-// bindings
-type NginxProjectBinding struct {
-	// The contents of the nginx config which handle HTTP traffic to and from the service
-	HttpContent string
-	// The contents of the nginx config which handle normal UDP/TCP traffic to and from the service
-	ServiceContent string
-}
-
 // GetLabelForPort will attempt to search the label map from a docker container to resolve the most specific labelling
 // possible. As both global and local labels are supported, this will try to resolve the portLabel with the $port
 // term substituted for the actual port, falling back to the global level if present. Returns nil if neither label is
@@ -171,145 +160,35 @@ func StringOrElse(data *string, fallback string) string {
 	return fallback
 }
 
-// GenerateFilesForContainerNginxBinding will generate two files for a given container binding, one for HTTP
-// traffic, and one for normal UDP/TCP traffic. This is based off the set of labels defined in constants.go, prefixed
-// with Label*. This handles skipping hidden ports, ssl, bind addresses, domain mapping and HTTP vs TCP vs UDP traffic
-// to produce the configurations. Each configuration is based on the Nginx* templates in constants.go
-func GenerateFilesForContainerNginxBinding(container BindingContainer, labels map[string]string, config BindingConfiguration) (NginxProjectBinding, error) {
-	http := ""
-	service := ""
-
-	for _, port := range container.Ports {
-		hide := StringOrElse(GetLabelForPort(labels, "", LabelPortHide, port.ContainerPort), "false") == "true"
-		if hide {
-			slog.Debug("Skipping port because it is marked as hidden", "port", port, "container", container.Name)
-			continue
-		}
-
-		if port.Binding == "::" {
-			slog.Debug("Skipping port because its ipv6", "binding", port.Binding, "port", port, "container", container.Name)
-			continue
-		}
-
-		portType := StringOrElse(GetLabelForPort(labels, LabelGlobalType, LabelPortType, port.ContainerPort), port.Type)
-		if (portType == ValueTypeTcp && port.Type == ValueTypeUdp) || (portType == ValueTypeUdp && port.Type == ValueTypeTcp) || (portType == ValueTypeHttp && port.Type == ValueTypeUdp) || (portType == ValueTypeHttps && port.Type == ValueTypeUdp) {
-			slog.Error("Cannot create mapping for port as it is currently defined! Inconsistency in defined port and docker port identity, defaulting to docker identity!", "defined", portType, "docker", port.Type, "port", port.ContainerPort)
-			portType = port.Type
-		}
-
-		useSsl := StringOrElse(GetLabelForPort(labels, LabelGlobalSsl, LabelPortSsl, port.ContainerPort), "true") == "true"
-		bindAddress := StringOrElse(GetLabelForPort(labels, LabelGlobalBind, LabelPortBind, port.ContainerPort), "0.0.0.0")
-		domain := StringOrElse(GetLabelForPort(labels, LabelGlobalDomain, LabelPortDomain, port.ContainerPort), config.DefaultDomain)
-
-		if portType == ValueTypeHttp || portType == ValueTypeHttps {
-			nonstandardPort := StringOrElse(GetLabelForPort(labels, LabelGlobalNonstandardHttp, LabelPortNonstandardHttp, port.ContainerPort), "false") == "true"
-
-			var portString string
-			if nonstandardPort {
-				portString = StringOrElse(GetLabelForPort(labels, LabelGlobalPortOverride, LabelPortPortOverride, port.ContainerPort), strconv.Itoa(int(port.ContainerPort)))
-			} else if useSsl {
-				portString = "443"
-			} else {
-				portString = "80"
-			}
-
-			slog.Debug("Port configuration", "type", portType, "ssl", useSsl, "bind", bindAddress, "domain", domain, "nonstandard", nonstandardPort, "port", portString, "port", port.ContainerPort, "binding", port.Binding)
-
-			http += NginxHttp(
-				bindAddress+":"+portString,
-				useSsl,
-				domain,
-				portType,
-				port.Binding,
-				port.HostPort,
-				config,
-			)
-		} else if portType == ValueTypeTcp {
-			slog.Debug("Port configuration", "type", portType, "ssl", useSsl, "bind", bindAddress, "domain", domain, "port", port.ContainerPort, "binding", port.Binding)
-
-			service += NginxTcp(
-				bindAddress+":"+strconv.Itoa(int(port.ContainerPort)),
-				useSsl,
-				port.Binding,
-				port.HostPort,
-				config,
-			)
-		} else if portType == ValueTypeUdp {
-			slog.Debug("Port configuration", "type", portType, "ssl", useSsl, "bind", bindAddress, "domain", domain, "port", port.ContainerPort, "binding", port.Binding)
-
-			service += NginxUdp(
-				bindAddress+":"+strconv.Itoa(int(port.ContainerPort)),
-				port.Binding,
-				port.HostPort,
-			)
-		} else {
-			slog.Warn("Failed to create binding because the protocol was not recognised", "protocol", portType)
-		}
-	}
-
-	return NginxProjectBinding{
-		HttpContent:    http,
-		ServiceContent: service,
-	}, nil
-}
-
-// GenerateFilesForProjectNginxBinding will iterate through the list of containers in the provided project, and for each
-// inspect them, and generate the corresponding nginx configs using GenerateFilesForContainerNginxBinding. The resulting
-// configs are merged and returned as a new single config instance
-func GenerateFilesForProjectNginxBinding(cli *client.Client, ctx context.Context, project BindingProject, config BindingConfiguration) (*NginxProjectBinding, error) {
-	result := NginxProjectBinding{
-		HttpContent:    "",
-		ServiceContent: "",
-	}
-
-	for _, container := range project.Containers {
-		cnt, err := cli.ContainerInspect(ctx, container.Name)
-		if err != nil {
-			slog.Error("Failed to create bindings for container due to an error retrieving container from docker host", "project", project.Project, "container", container.Name, "error", err)
-			return nil, err
-		}
-
-		binding, err := GenerateFilesForContainerNginxBinding(
-			container,
-			cnt.Config.Labels,
-			config,
-		)
-		if err != nil {
-			slog.Error("Failed to create bindings for container due to an error", "project", project.Project, "container", container.Name, "error", err)
-			return nil, err
+// GenerateFilesForNginxRoutes will generate the nginx configurations for routing traffic for every route by rendering
+// the DefaultNginxTemplates set. Http routes sharing a domain and listen address are merged into one server with a
+// location per path (see GroupHttpServers), generated in the format `http.d/<domain>.<address>.<port>.svc.http.conf`,
+// and UDP/TCP traffic is generated in the format `stream.d/<project>.svc.stream.conf` as it is only valid in a stream
+// block. `nqkd-http.include` and `nqkd-stream.include` include each directory from the right context of nginx.conf, see
+// CheckNginxIncludes. The replicas of each service port are load balanced through a named upstream (see
+// GroupUpstreams). Conflicting paths are logged and left out. Tls routes without a certificate are left out, as nginx
+// would refuse the whole config, and are picked up on a later run once a certificate exists (ie from ACME). Tls routes
+// get a port 80 server which redirects to them, and which serves http-01 challenges when an ACME webroot is configured.
+// Aliases get their own servers which permanently redirect to the route's domain. The result is compatible with
+// WriteFileSetWithDiff
+func GenerateFilesForNginxRoutes(routes []Route, config BindingConfiguration) (map[string]string, error) {
+	for _, route := range routes {
+		if route.Tls && route.Protocol != ValueTypeUdp && route.Certificate == "" {
+			slog.Warn("Leaving route out of the nginx config because it has no certificate", "project", route.Project, "container", route.Container, "port", route.ContainerPort, "domain", route.Domain)
 		}
-
-		result.HttpContent += binding.HttpContent
-		result.ServiceContent += binding.ServiceContent
 	}
 
-	return &result, nil
+	return RenderTemplateSet(DefaultNginxTemplates, routes, config)
 }
 
-// GenerateFilesForNginxBinding will iterate through the provided set of projects and for each generate the required
-// nginx configurations for routing traffic. Each config file will be generated in the format `<project>.svc.http.conf`
-// for http traffic  and `<project>.svc.plain.conf` for UDP/TCP traffic. The result is compatible with
-// WriteFileSetWithDiff
-func GenerateFilesForNginxBinding(cli *client.Client, ctx context.Context, binding BindingResult, config BindingConfiguration) (map[string]string, error) {
-	result := make(map[string]string)
-
-	for _, project := range binding.Projects {
-		httpFilename := project.Project + ".svc.http.conf"
-		serviceFilename := project.Project + ".svc.plain.conf"
-
-		nginxBinding, err := GenerateFilesForProjectNginxBinding(cli, ctx, project, config)
-		if err != nil {
-			slog.Error("Failed to generate files for nginx binding", "project", project.Project, "error", err)
-			return nil, err
-		}
-
-		if len(nginxBinding.HttpContent) > 0 {
-			result[httpFilename] = nginxBinding.HttpContent
-		}
-		if len(nginxBinding.ServiceContent) > 0 {
-			result[serviceFilename] = nginxBinding.ServiceContent
-		}
+// GenerateFilesForNginxBinding will resolve the provided set of projects into routes with ResolveRoutes and generate
+// the required nginx configurations for them with GenerateFilesForNginxRoutes
+func GenerateFilesForNginxBinding(binding BindingResult, config BindingConfiguration) (map[string]string, error) {
+	routes, err := ResolveRoutes(binding, config)
+	if err != nil {
+		slog.Error("Failed to resolve routes for nginx binding", "error", err)
+		return nil, err
 	}
 
-	return result, nil
+	return GenerateFilesForNginxRoutes(routes, config)
 }
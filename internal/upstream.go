@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"log/slog"
+	"slices"
+	"strconv"
+)
+
+const (
+	// BalanceRoundRobin sends requests to each replica in turn, this is the default
+	BalanceRoundRobin = "round_robin"
+	// BalanceLeastConn sends requests to the replica with the fewest active connections
+	BalanceLeastConn = "least_conn"
+	// BalanceIpHash sends every request from a client address to the same replica
+	BalanceIpHash = "ip_hash"
+)
+
+// UpstreamGroup is every route for the same port of the same service, which are the replicas of a scaled service.
+// Proxies load balance between the routes in a group, and all of their settings are taken from the first route
+type UpstreamGroup struct {
+	// Name identifies the group, this is unique per project, service and port and is safe to use as an identifier
+	Name string `json:"name"`
+	// Project is the name of the nqk project the service belongs to
+	Project string `json:"project"`
+	// Service is the compose service, or the container name if the container isn't part of a service
+	Service string `json:"service"`
+	// ContainerPort is the port exposed by every replica
+	ContainerPort uint16 `json:"container_port"`
+	// Protocol is the resolved port type, one of the ValueType* constants
+	Protocol string `json:"protocol"`
+	// Scheme is the protocol used to talk to the replicas, see RouteUpstream
+	Scheme string `json:"scheme"`
+	// Path is the path the group is served under, see Route
+	Path string `json:"path,omitempty"`
+	// StripPath is whether Path is removed before forwarding, see Route
+	StripPath bool `json:"strip_path,omitempty"`
+	// Balance is the load balancing method, one of the Balance* constants
+	Balance string `json:"balance"`
+	// MaxFails is the number of failed attempts after which a replica is considered unavailable, nil to use the proxy
+	// default
+	MaxFails *int `json:"max_fails,omitempty"`
+	// FailTimeout is how long a replica is considered unavailable for after MaxFails (ie 10s), empty to use the proxy
+	// default
+	FailTimeout string `json:"fail_timeout,omitempty"`
+	// Routes are the routes of every replica
+	Routes []Route `json:"routes"`
+}
+
+// First returns the route every setting of the group is taken from
+func (u UpstreamGroup) First() Route {
+	return u.Routes[0]
+}
+
+// UpstreamName returns the name of the group the route belongs to. Routes share a name when they come from the same
+// port of the same service in the same project
+func UpstreamName(route Route) string {
+	service := route.Service
+	if service == "" {
+		service = route.Container
+	}
+	return CleanName("nqkd_" + route.Project + "_" + service + "_" + strconv.Itoa(int(route.ContainerPort)))
+}
+
+// GroupUpstreams merges the routes into groups of replicas (see UpstreamName). Groups are in the order their first
+// route appears, as are the routes within them
+func GroupUpstreams(routes []Route) []UpstreamGroup {
+	groups := make([]UpstreamGroup, 0)
+	for _, route := range routes {
+		name := UpstreamName(route)
+		index := slices.IndexFunc(groups, func(g UpstreamGroup) bool { return g.Name == name })
+		if index == -1 {
+			service := route.Service
+			if service == "" {
+				service = route.Container
+			}
+			balance := route.Balance
+			if balance == "" {
+				balance = BalanceRoundRobin
+			}
+
+			groups = append(groups, UpstreamGroup{
+				Name:          name,
+				Project:       route.Project,
+				Service:       service,
+				ContainerPort: route.ContainerPort,
+				Protocol:      route.Protocol,
+				Scheme:        route.Upstream.Scheme,
+				Path:          route.Path,
+				StripPath:     route.StripPath,
+				Balance:       balance,
+				MaxFails:      route.MaxFails,
+				FailTimeout:   route.FailTimeout,
+				Routes:        make([]Route, 0),
+			})
+			index = len(groups) - 1
+		}
+		groups[index].Routes = append(groups[index].Routes, route)
+	}
+
+	return groups
+}
+
+// resolveUpstreamOptions sets the load balancing method and passive health checks of the upstream of the route,
+// ignoring any labels which aren't valid
+func resolveUpstreamOptions(route *Route, labels portLabels) {
+	route.Balance = labels.value(LabelGlobalBalance, LabelPortBalance, "")
+	if route.Balance != "" && route.Balance != BalanceRoundRobin && route.Balance != BalanceLeastConn && route.Balance != BalanceIpHash {
+		slog.Error("Ignoring balance label because it is not round_robin, least_conn or ip_hash", "balance", route.Balance, "port", labels.port, "container", labels.container)
+		route.Balance = ""
+	}
+	if maxFails := labels.get(LabelGlobalMaxFails, LabelPortMaxFails); maxFails != nil {
+		value, err := strconv.Atoi(*maxFails)
+		if err != nil || value < 0 {
+			slog.Error("Ignoring max fails label because it is not a positive number", "max_fails", *maxFails, "port", labels.port, "container", labels.container)
+		} else {
+			route.MaxFails = &value
+		}
+	}
+	route.FailTimeout = labels.value(LabelGlobalFailTimeout, LabelPortFailTimeout, "")
+	if route.FailTimeout != "" && !durationRegex.MatchString(route.FailTimeout) {
+		slog.Error("Ignoring fail timeout label because it is not a duration like 10s", "fail_timeout", route.FailTimeout, "port", labels.port, "container", labels.container)
+		route.FailTimeout = ""
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+)
+
+// replica is the web route of the project served by another container of the same service
+func replica(project string, number string, upstream uint16, options ...func(route *Route)) Route {
+	route := testRoute(project, "example.com", upstream, options...)
+	route.Container = project + "-web-" + number
+	return route
+}
+
+func TestUpstreamName(t *testing.T) {
+	tests := []struct {
+		name  string
+		route Route
+		want  string
+	}{
+		{name: "service and port", route: testRoute("shop", "example.com", 8080), want: "nqkd_shop_web_80"},
+		{name: "replicas share the name", route: replica("shop", "2", 8081), want: "nqkd_shop_web_80"},
+		{name: "other ports are separate", route: testRoute("shop", "example.com", 8080, func(route *Route) { route.ContainerPort = 8443 }), want: "nqkd_shop_web_8443"},
+		{name: "containers without a service use their name", route: testRoute("shop", "example.com", 8080, func(route *Route) { route.Service = "" }), want: "nqkd_shop_shop_web_1_80"},
+		{name: "names are cleaned", route: testRoute("My.Shop", "example.com", 8080), want: "nqkd_my_shop_web_80"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := UpstreamName(test.route); got != test.want {
+				t.Errorf("UpstreamName() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGroupUpstreams(t *testing.T) {
+	maxFails := 3
+	first := replica("shop", "1", 8080, func(route *Route) {
+		route.Balance, route.MaxFails, route.FailTimeout = BalanceLeastConn, &maxFails, "30s"
+	})
+	routes := []Route{
+		first,
+		testRoute("blog", "blog.example.com", 9000),
+		replica("shop", "2", 8081),
+		replica("shop", "3", 8082),
+	}
+
+	groups := GroupUpstreams(routes)
+	names := make([]string, 0)
+	for _, group := range groups {
+		names = append(names, group.Name)
+	}
+	if !slices.Equal(names, []string{"nqkd_shop_web_80", "nqkd_blog_web_80"}) {
+		t.Fatalf("GroupUpstreams() = %v, want groups in the order they first appear", names)
+	}
+
+	shop := groups[0]
+	containers := make([]string, 0)
+	for _, route := range shop.Routes {
+		containers = append(containers, route.Container)
+	}
+	if !slices.Equal(containers, []string{"shop-web-1", "shop-web-2", "shop-web-3"}) {
+		t.Errorf("group routes = %v, want every replica in order", containers)
+	}
+	if shop.Balance != BalanceLeastConn || shop.MaxFails == nil || *shop.MaxFails != 3 || shop.FailTimeout != "30s" {
+		t.Errorf("group = %+v, want the settings of the first route", shop)
+	}
+	if blog := groups[1]; blog.Balance != BalanceRoundRobin || blog.MaxFails != nil {
+		t.Errorf("group = %+v, want round robin by default", blog)
+	}
+}
+
+func TestNginxUpstreamBalance(t *testing.T) {
+	balanced := func(balance string) func(route *Route) {
+		return func(route *Route) { route.Balance = balance }
+	}
+	tcp := func(route *Route) {
+		withProtocol(ValueTypeTcp)(route)
+		route.ListenPort = 5432
+	}
+	maxFails := 2
+
+	tests := []struct {
+		name    string
+		routes  []Route
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "replicas are servers of one upstream",
+			routes:  []Route{replica("shop", "1", 8080), replica("shop", "2", 8081)},
+			want:    []string{"upstream nqkd_shop_web_80 {\n    server 127.0.0.1:8080;\n    server 127.0.0.1:8081;\n}"},
+			notWant: []string{"least_conn", "hash"},
+		},
+		{
+			name:   "least connections",
+			routes: []Route{replica("shop", "1", 8080, balanced(BalanceLeastConn))},
+			want:   []string{"upstream nqkd_shop_web_80 {\n    least_conn;"},
+		},
+		{
+			name:    "http ip hash",
+			routes:  []Route{replica("shop", "1", 8080, balanced(BalanceIpHash))},
+			want:    []string{"upstream nqkd_shop_web_80 {\n    ip_hash;"},
+			notWant: []string{"hash $remote_addr"},
+		},
+		{
+			name:    "stream ip hash",
+			routes:  []Route{replica("shop", "1", 5432, tcp, balanced(BalanceIpHash))},
+			want:    []string{"upstream nqkd_shop_web_80 {\n    hash $remote_addr consistent;"},
+			notWant: []string{"ip_hash"},
+		},
+		{
+			name: "passive health checks",
+			routes: []Route{replica("shop", "1", 8080, func(route *Route) {
+				route.MaxFails, route.FailTimeout = &maxFails, "10s"
+			})},
+			want: []string{"server 127.0.0.1:8080 max_fails=2 fail_timeout=10s;"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := renderNginx(t, BindingConfiguration{}, test.routes...)
+			expectContent(t, "GenerateFilesForNginxRoutes()", got, test.want, test.notWant)
+		})
+	}
+}
@@ -1,10 +1,17 @@
 package internal
 
 import (
+	"errors"
 	"github.com/kylelemons/godebug/diff"
+	"golang.org/x/exp/maps"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // WriteFileSetWithDiff will write the provided set of files as long as the contents are different. For any file for which
@@ -12,17 +19,23 @@ import (
 // of the provided set.
 //
 // The keys in the files map will correspond to the file names, which are joined with the given prefix using
-// filepath.Join. If an error is encountered while reading the file, the file will be written, any errors encountered
-// during the process will be returned immediately meaning not all writes will be attempted, however the boolean status
-// will always be accurate.
+// filepath.Join. Names may contain forward slashes to write into subdirectories, which are created as needed. If an
+// error is encountered while reading the file, the file will be written, any errors encountered during the process
+// will be returned immediately meaning not all writes will be attempted, however the boolean status will always be
+// accurate.
 func WriteFileSetWithDiff(files map[string]string, filePrefix string) (bool, error) {
 	hasWritten := false
 	for key, value := range files {
-		path := filepath.Join(filePrefix, key)
+		path := filepath.Join(filePrefix, filepath.FromSlash(key))
 		data, err := os.ReadFile(path)
 		if err != nil {
 			slog.Debug("Writing file because there was an error reading", "file", path, "error", err)
-			err := os.WriteFile(path, []byte(value), 0666)
+			err := os.MkdirAll(filepath.Dir(path), 0777)
+			if err != nil {
+				slog.Error("Failed to create the directory for file", "file", path, "error", err)
+				return hasWritten, err
+			}
+			err = os.WriteFile(path, []byte(value), 0666)
 			if err != nil {
 				slog.Error("Failed to write file with nginx binding", "file", path, "error", err)
 				return hasWritten, err
@@ -48,3 +61,456 @@ func WriteFileSetWithDiff(files map[string]string, filePrefix string) (bool, err
 
 	return hasWritten, nil
 }
+
+// ManifestFile is the name of the file written to an output directory listing every file nqk generated in it. Only
+// files named in the manifest are ever removed, so files written by hand in the same directory are left alone
+const ManifestFile = ".nqkd-manifest"
+
+// ReadManifest returns the set of file names recorded in the manifest of the given directory, relative to it with
+// forward slashes. A missing manifest is treated as empty
+func ReadManifest(dir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	files := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		// the manifest controls what is deleted, so never trust anything that could escape the directory
+		if !filepath.IsLocal(filepath.FromSlash(line)) || line != filepath.ToSlash(filepath.Clean(line)) || line == ManifestFile {
+			slog.Warn("Ignoring manifest entry which is not a file inside the directory", "dir", dir, "entry", line)
+			continue
+		}
+		files = append(files, line)
+	}
+
+	return files, nil
+}
+
+// manifestContent returns the manifest recording the names of the given files
+func manifestContent(files map[string]string) string {
+	names := maps.Keys(files)
+	slices.Sort(names)
+
+	content := ""
+	for _, name := range names {
+		content += name + "\n"
+	}
+	return content
+}
+
+// WriteManifest records the names of the given files as the manifest of the directory
+func WriteManifest(dir string, files map[string]string) error {
+	return os.WriteFile(filepath.Join(dir, ManifestFile), []byte(manifestContent(files)), 0666)
+}
+
+// SyncFileSetWithDiff treats the directory as an owned set of files. The files are written using WriteFileSetWithDiff,
+// then any file listed in the previous manifest which is no longer in the set is removed, and finally the manifest is
+// updated to match the set. Returns whether any file was written or removed, which is accurate even when an error is
+// returned
+func SyncFileSetWithDiff(files map[string]string, dir string) (bool, error) {
+	previous, err := ReadManifest(dir)
+	if err != nil {
+		slog.Error("Failed to read the manifest of generated files", "dir", dir, "error", err)
+		return false, err
+	}
+
+	hasChanged, err := WriteFileSetWithDiff(files, dir)
+	if err != nil {
+		return hasChanged, err
+	}
+
+	for _, name := range previous {
+		if _, ok := files[name]; ok {
+			continue
+		}
+
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to remove stale generated file", "file", path, "error", err)
+			return hasChanged, err
+		}
+		if err == nil {
+			slog.Info("Removed stale generated file", "file", path)
+			hasChanged = true
+		}
+	}
+
+	err = WriteManifest(dir, files)
+	if err != nil {
+		slog.Error("Failed to write the manifest of generated files", "dir", dir, "error", err)
+		return hasChanged, err
+	}
+
+	return hasChanged, nil
+}
+
+// SyncSuffixedFileSetWithDiff treats every file directly in the directory whose name ends with suffix as owned, for
+// directories which another program watches and where a manifest would be picked up with the generated files. The
+// files, which must all be named with the suffix, are written using WriteFileSetWithDiff, then any other file with the
+// suffix is removed. Returns whether any file was written or removed, which is accurate even when an error is returned
+func SyncSuffixedFileSetWithDiff(files map[string]string, dir string, suffix string) (bool, error) {
+	hasChanged, err := WriteFileSetWithDiff(files, dir)
+	if err != nil {
+		return hasChanged, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("Failed to list the directory of generated files", "dir", dir, "error", err)
+		return hasChanged, err
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), suffix) {
+			continue
+		}
+		if _, ok := files[entry.Name()]; ok {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to remove stale generated file", "file", path, "error", err)
+			return hasChanged, err
+		}
+		if err == nil {
+			slog.Info("Removed stale generated file", "file", path)
+			hasChanged = true
+		}
+	}
+
+	return hasChanged, nil
+}
+
+// TouchFileSet updates the modification time of every file in the set which exists in the directory, so programs
+// watching it load them again even though their content is the same (ie when a certificate they name was replaced)
+func TouchFileSet(files map[string]string, dir string) error {
+	now := time.Now()
+	for name := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.Chtimes(path, now, now)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to touch generated file", "file", path, "error", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+const (
+	// stagedSuffix is added to the output directory to name the sibling directory a new file set is prepared in
+	stagedSuffix = ".nqkd-staged"
+	// previousSuffix is added to the output directory to name the sibling directory the live files are kept in until
+	// a swap is committed
+	previousSuffix = ".nqkd-previous"
+)
+
+// StagedFileSet is a generated file set prepared in a sibling of the output directory, holding a copy of everything
+// in the live directory with the generated files replaced, ready to be swapped in by renaming the directories. Only
+// the files nqk owns (those in the set and the previous manifest) differ from the live directory, so anything else in
+// it, including symlinks, is carried over as it is. The parent of the output directory must be writable and the
+// output directory can't be a mount point, as it is replaced on every swap
+type StagedFileSet struct {
+	// Dir is the live output directory
+	Dir string
+	// Staged is the directory the new file set is prepared in, which becomes Dir once swapped
+	Staged string
+	// Changed is whether any generated file is written or removed by the swap, if false there is nothing to swap
+	Changed bool
+	// swapped is whether Swap has moved the staged directory into place
+	swapped bool
+}
+
+// previous is the directory the live files are moved to by Swap
+func (s *StagedFileSet) previous() string {
+	return s.Dir + previousSuffix
+}
+
+// copyOwnership gives path the mode and owner of the existing file, so replacing it doesn't change who can read it
+func copyOwnership(path string, info os.FileInfo) error {
+	err := os.Chmod(path, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if owner, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(path, int(owner.Uid), int(owner.Gid)); err != nil {
+			slog.Debug("Failed to copy the owner of the live file to the staged file", "file", path, "error", err)
+		}
+	}
+	return nil
+}
+
+// copyTree copies every directory, regular file and symlink in src to dst, keeping their mode and owner and leaving
+// out the names for which skip returns true
+func copyTree(src string, dst string, skip func(name string) bool) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if relative != "." && skip(filepath.ToSlash(relative)) {
+			return nil
+		}
+		target := filepath.Join(dst, relative)
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir():
+			if err := os.MkdirAll(target, 0777); err != nil {
+				return err
+			}
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case entry.Type().IsRegular():
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(target, data, 0666); err != nil {
+				return err
+			}
+		default:
+			slog.Warn("Leaving out file from the staged directory because it is not a regular file", "file", path)
+			return nil
+		}
+		return copyOwnership(target, info)
+	})
+}
+
+// RecoverFileSet puts the output directory back the way it was before a swap which was interrupted, ie by nqkd being
+// killed, and removes any staged directory left behind. A swap which was never committed is rolled back so the files
+// are generated, validated and reloaded again by the next run
+func RecoverFileSet(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	previous := dir + previousSuffix
+	staged := dir + stagedSuffix
+
+	if _, err := os.Lstat(previous); err == nil {
+		slog.Warn("Restoring the previous generated files left by an interrupted swap", "dir", dir)
+		if _, err := os.Lstat(dir); err == nil {
+			if err := os.RemoveAll(staged); err != nil {
+				return err
+			}
+			if err := os.Rename(dir, staged); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(previous, dir); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Lstat(staged); err == nil {
+		slog.Debug("Removing staged directory left by a previous run", "dir", staged)
+		return os.RemoveAll(staged)
+	}
+	return nil
+}
+
+// StageFileSet works out which generated files differ from the live ones in dir and which files in the previous
+// manifest are stale, then prepares the new file set in the staged directory, leaving every live file untouched. Any
+// swap left over from an interrupted run is recovered first (see RecoverFileSet). If nothing changed the result is
+// not Changed and nothing is staged, other than updating a manifest which was out of date. Otherwise Swap, then either
+// Commit or Rollback, or Discard must be called
+func StageFileSet(files map[string]string, dir string) (*StagedFileSet, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	staged := &StagedFileSet{Dir: dir, Staged: dir + stagedSuffix}
+
+	err = RecoverFileSet(staged.Dir)
+	if err != nil {
+		slog.Error("Failed to recover from an interrupted swap", "dir", staged.Dir, "error", err)
+		return nil, err
+	}
+
+	err = os.MkdirAll(staged.Dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := ReadManifest(staged.Dir)
+	if err != nil {
+		slog.Error("Failed to read the manifest of generated files", "dir", staged.Dir, "error", err)
+		return nil, err
+	}
+
+	stale := make(map[string]bool)
+	for _, name := range previous {
+		if _, ok := files[name]; ok {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(staged.Dir, filepath.FromSlash(name))); err == nil {
+			stale[name] = true
+		}
+	}
+
+	names := maps.Keys(files)
+	slices.Sort(names)
+	for _, name := range names {
+		path := filepath.Join(staged.Dir, filepath.FromSlash(name))
+		data, err := os.ReadFile(path)
+		if err == nil && string(data) == files[name] {
+			continue
+		}
+		slog.Debug("Staging file because content is different", "file", path, "diff", diff.Diff(string(data), files[name]))
+		staged.Changed = true
+	}
+	staged.Changed = staged.Changed || len(stale) > 0
+
+	manifest := manifestContent(files)
+	if !staged.Changed {
+		// the manifest isn't read by the proxy so it can be brought up to date on its own
+		data, err := os.ReadFile(filepath.Join(staged.Dir, ManifestFile))
+		if err != nil || string(data) != manifest {
+			err = WriteManifest(staged.Dir, files)
+			if err != nil {
+				slog.Error("Failed to update the manifest of generated files", "dir", staged.Dir, "error", err)
+				return nil, err
+			}
+		}
+		return staged, nil
+	}
+
+	err = copyTree(staged.Dir, staged.Staged, func(name string) bool {
+		return stale[name] || name == ManifestFile
+	})
+	if err != nil {
+		slog.Error("Failed to copy the live files into the staged directory", "dir", staged.Staged, "error", err)
+		staged.Discard()
+		return nil, err
+	}
+	for name := range stale {
+		slog.Info("Removing stale generated file", "file", filepath.Join(staged.Dir, filepath.FromSlash(name)))
+	}
+
+	err = staged.Write(files)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(staged.Staged, ManifestFile), []byte(manifest), 0666)
+	}
+	if err != nil {
+		slog.Error("Failed to stage generated files", "dir", staged.Staged, "error", err)
+		staged.Discard()
+		return nil, err
+	}
+
+	return staged, nil
+}
+
+// Write replaces the generated files in the staged directory, keeping the mode and owner of the live file each one
+// replaces. This is also used to stage a version of the files which refers to the staged directory for validation
+func (s *StagedFileSet) Write(files map[string]string) error {
+	for name, content := range files {
+		path := filepath.Join(s.Staged, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			return err
+		}
+		if info, err := os.Stat(filepath.Join(s.Dir, filepath.FromSlash(name))); err == nil {
+			if err := copyOwnership(path, info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Discard removes the staged directory without swapping it in
+func (s *StagedFileSet) Discard() {
+	err := os.RemoveAll(s.Staged)
+	if err != nil {
+		slog.Error("Failed to clean up the staged directory", "dir", s.Staged, "error", err)
+	}
+}
+
+// Swap moves the live directory aside and renames the staged directory into its place. If the staged directory can't
+// be moved into place the live directory is put back, the staged directory discarded and the error returned
+func (s *StagedFileSet) Swap() error {
+	err := os.Rename(s.Dir, s.previous())
+	if err != nil {
+		slog.Error("Failed to move the live directory aside", "dir", s.Dir, "error", err)
+		s.Discard()
+		return err
+	}
+
+	err = os.Rename(s.Staged, s.Dir)
+	if err != nil {
+		slog.Error("Failed to move the staged directory into place", "dir", s.Dir, "error", err)
+		if restoreErr := os.Rename(s.previous(), s.Dir); restoreErr != nil {
+			slog.Error("Failed to restore the previous directory!", "dir", s.Dir, "error", restoreErr)
+		}
+		s.Discard()
+		return err
+	}
+
+	s.swapped = true
+	return nil
+}
+
+// Rollback puts the live directory Swap moved aside back in place, discarding the swapped in files
+func (s *StagedFileSet) Rollback() error {
+	if !s.swapped {
+		s.Discard()
+		return nil
+	}
+
+	err := os.Rename(s.Dir, s.Staged)
+	if err == nil {
+		err = os.Rename(s.previous(), s.Dir)
+	}
+	if err != nil {
+		slog.Error("Failed to restore the previous directory!", "dir", s.Dir, "error", err)
+		return err
+	}
+
+	s.swapped = false
+	s.Discard()
+	return nil
+}
+
+// Commit discards the live directory which was kept aside by Swap, making the swap permanent
+func (s *StagedFileSet) Commit() error {
+	if !s.swapped {
+		return nil
+	}
+
+	// the previous directory is renamed out of the way first, so a removal which fails part way through is never
+	// mistaken for an interrupted swap and restored by RecoverFileSet
+	err := os.Rename(s.previous(), s.Staged)
+	if err != nil {
+		slog.Error("Failed to remove the previous directory", "dir", s.previous(), "error", err)
+		return err
+	}
+
+	s.swapped = false
+	s.Discard()
+	return nil
+}
@@ -0,0 +1,376 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeTree creates every file in the map under dir, creating directories as needed
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree returns the content of every regular file under dir, keyed by its slash separated relative path
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	result := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		relative, _ := filepath.Rel(dir, path)
+		result[filepath.ToSlash(relative)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func stringRef(value string) *string {
+	return &value
+}
+
+func equalTree(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, content := range a {
+		if other, ok := b[name]; !ok || other != content {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReadManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest *string
+		want     []string
+	}{
+		{name: "missing manifest", manifest: nil, want: []string{}},
+		{name: "plain entries", manifest: stringRef("a.conf\nhttp.d/b.conf\n"), want: []string{"a.conf", "http.d/b.conf"}},
+		{name: "blank lines and whitespace", manifest: stringRef("\n  a.conf  \n\n"), want: []string{"a.conf"}},
+		{name: "entries escaping the directory", manifest: stringRef("../a.conf\n/etc/passwd\nhttp.d/../../b\nc.conf\n"), want: []string{"c.conf"}},
+		{name: "unclean entries", manifest: stringRef("./a.conf\nhttp.d//b.conf\n"), want: []string{}},
+		{name: "the manifest itself", manifest: stringRef(ManifestFile + "\n"), want: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if test.manifest != nil {
+				writeTree(t, dir, map[string]string{ManifestFile: *test.manifest})
+			}
+
+			got, err := ReadManifest(dir)
+			if err != nil {
+				t.Fatalf("ReadManifest() error = %v", err)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("ReadManifest() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSyncFileSetWithDiff(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    map[string]string
+		files       map[string]string
+		wantChanged bool
+		want        map[string]string
+	}{
+		{
+			name:        "empty directory",
+			existing:    map[string]string{},
+			files:       map[string]string{"a.conf": "a", "http.d/b.conf": "b"},
+			wantChanged: true,
+			want:        map[string]string{"a.conf": "a", "http.d/b.conf": "b", ManifestFile: "a.conf\nhttp.d/b.conf\n"},
+		},
+		{
+			name:        "unchanged files",
+			existing:    map[string]string{"a.conf": "a", ManifestFile: "a.conf\n"},
+			files:       map[string]string{"a.conf": "a"},
+			wantChanged: false,
+			want:        map[string]string{"a.conf": "a", ManifestFile: "a.conf\n"},
+		},
+		{
+			name:        "changed file",
+			existing:    map[string]string{"a.conf": "a", ManifestFile: "a.conf\n"},
+			files:       map[string]string{"a.conf": "changed"},
+			wantChanged: true,
+			want:        map[string]string{"a.conf": "changed", ManifestFile: "a.conf\n"},
+		},
+		{
+			name:        "stale generated file is removed",
+			existing:    map[string]string{"a.conf": "a", "b.conf": "b", ManifestFile: "a.conf\nb.conf\n"},
+			files:       map[string]string{"a.conf": "a"},
+			wantChanged: true,
+			want:        map[string]string{"a.conf": "a", ManifestFile: "a.conf\n"},
+		},
+		{
+			name:        "hand written files are left alone",
+			existing:    map[string]string{"a.conf": "a", "custom.conf": "mine", ManifestFile: "a.conf\n"},
+			files:       map[string]string{},
+			wantChanged: true,
+			want:        map[string]string{"custom.conf": "mine", ManifestFile: ""},
+		},
+		{
+			name:        "manifest entry already removed by hand",
+			existing:    map[string]string{ManifestFile: "gone.conf\n"},
+			files:       map[string]string{"a.conf": "a"},
+			wantChanged: true,
+			want:        map[string]string{"a.conf": "a", ManifestFile: "a.conf\n"},
+		},
+		{
+			name:        "manifest cannot remove files outside the directory",
+			existing:    map[string]string{ManifestFile: "../outside.conf\n"},
+			files:       map[string]string{},
+			wantChanged: false,
+			want:        map[string]string{ManifestFile: ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTree(t, root, map[string]string{"outside.conf": "outside"})
+			dir := filepath.Join(root, "out")
+			writeTree(t, dir, test.existing)
+
+			changed, err := SyncFileSetWithDiff(test.files, dir)
+			if err != nil {
+				t.Fatalf("SyncFileSetWithDiff() error = %v", err)
+			}
+			if changed != test.wantChanged {
+				t.Errorf("SyncFileSetWithDiff() changed = %v, want %v", changed, test.wantChanged)
+			}
+			if got := readTree(t, dir); !equalTree(got, test.want) {
+				t.Errorf("directory = %v, want %v", got, test.want)
+			}
+			if _, err := os.Stat(filepath.Join(root, "outside.conf")); errors.Is(err, os.ErrNotExist) {
+				t.Errorf("file outside the directory was removed")
+			}
+		})
+	}
+}
+
+func TestStageFileSet(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    map[string]string
+		files       map[string]string
+		wantChanged bool
+		want        map[string]string
+	}{
+		{
+			name:        "new files",
+			existing:    map[string]string{},
+			files:       map[string]string{"a.conf": "a", "http.d/b.conf": "b"},
+			wantChanged: true,
+			want:        map[string]string{"a.conf": "a", "http.d/b.conf": "b", ManifestFile: "a.conf\nhttp.d/b.conf\n"},
+		},
+		{
+			name:        "unchanged files",
+			existing:    map[string]string{"a.conf": "a", ManifestFile: "a.conf\n"},
+			files:       map[string]string{"a.conf": "a"},
+			wantChanged: false,
+			want:        map[string]string{"a.conf": "a", ManifestFile: "a.conf\n"},
+		},
+		{
+			name:        "only the manifest is out of date",
+			existing:    map[string]string{"a.conf": "a"},
+			files:       map[string]string{"a.conf": "a"},
+			wantChanged: false,
+			want:        map[string]string{"a.conf": "a", ManifestFile: "a.conf\n"},
+		},
+		{
+			name:        "changed and stale files",
+			existing:    map[string]string{"a.conf": "a", "b.conf": "b", "custom.conf": "mine", ManifestFile: "a.conf\nb.conf\n"},
+			files:       map[string]string{"a.conf": "changed"},
+			wantChanged: true,
+			want:        map[string]string{"a.conf": "changed", "custom.conf": "mine", ManifestFile: "a.conf\n"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTree(t, dir, test.existing)
+			before := readTree(t, dir)
+
+			staged, err := StageFileSet(test.files, dir)
+			if err != nil {
+				t.Fatalf("StageFileSet() error = %v", err)
+			}
+			if staged.Changed != test.wantChanged {
+				t.Errorf("StageFileSet() changed = %v, want %v", staged.Changed, test.wantChanged)
+			}
+			if !staged.Changed {
+				if got := readTree(t, dir); !equalTree(got, test.want) {
+					t.Errorf("directory = %v, want %v", got, test.want)
+				}
+				return
+			}
+
+			// nothing live changes until the swap
+			live := readTree(t, dir)
+			for name, content := range before {
+				if live[name] != content {
+					t.Errorf("live file %v changed while staging", name)
+				}
+			}
+
+			if err := staged.Swap(); err != nil {
+				t.Fatalf("Swap() error = %v", err)
+			}
+			if err := staged.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+			if got := readTree(t, dir); !equalTree(got, test.want) {
+				t.Errorf("directory = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStagedFileSetRollback(t *testing.T) {
+	dir := t.TempDir()
+	existing := map[string]string{"a.conf": "a", "stale.conf": "stale", "custom.conf": "mine", ManifestFile: "a.conf\nstale.conf\n"}
+	writeTree(t, dir, existing)
+
+	staged, err := StageFileSet(map[string]string{"a.conf": "changed", "http.d/new.conf": "new"}, dir)
+	if err != nil {
+		t.Fatalf("StageFileSet() error = %v", err)
+	}
+	if err := staged.Swap(); err != nil {
+		t.Fatalf("Swap() error = %v", err)
+	}
+	if got := readTree(t, dir)["a.conf"]; got != "changed" {
+		t.Errorf("swapped a.conf = %q, want changed", got)
+	}
+
+	if err := staged.Rollback(); err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+	if got := readTree(t, dir); !equalTree(got, existing) {
+		t.Errorf("directory after rollback = %v, want %v", got, existing)
+	}
+}
+
+func TestStageFileSetKeepsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(t.TempDir(), "site.conf")
+	writeTree(t, filepath.Dir(target), map[string]string{"site.conf": "site"})
+	writeTree(t, dir, map[string]string{"a.conf": "a", ManifestFile: "a.conf\n"})
+	if err := os.Symlink(target, filepath.Join(dir, "site.conf")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "a.conf"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	staged, err := StageFileSet(map[string]string{"a.conf": "changed"}, dir)
+	if err != nil {
+		t.Fatalf("StageFileSet() error = %v", err)
+	}
+	if err := staged.Swap(); err != nil {
+		t.Fatalf("Swap() error = %v", err)
+	}
+	if err := staged.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	link, err := os.Readlink(filepath.Join(dir, "site.conf"))
+	if err != nil || link != target {
+		t.Errorf("symlink = %q, %v, want it untouched pointing at %q", link, err, target)
+	}
+	info, err := os.Stat(filepath.Join(dir, "a.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("replaced file mode = %v, want 0640 copied from the live file", info.Mode().Perm())
+	}
+	for _, sibling := range []string{dir + stagedSuffix, dir + previousSuffix} {
+		if _, err := os.Lstat(sibling); err == nil {
+			t.Errorf("left behind %v after commit", sibling)
+		}
+	}
+}
+
+func TestRecoverFileSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		live     map[string]string
+		previous map[string]string
+		staged   map[string]string
+		want     map[string]string
+	}{
+		{
+			name:   "leftover staged directory is removed",
+			live:   map[string]string{"a.conf": "a"},
+			staged: map[string]string{"a.conf": "half written"},
+			want:   map[string]string{"a.conf": "a"},
+		},
+		{
+			name:     "uncommitted swap is rolled back",
+			live:     map[string]string{"a.conf": "new"},
+			previous: map[string]string{"a.conf": "old"},
+			want:     map[string]string{"a.conf": "old"},
+		},
+		{
+			name:     "swap interrupted between renames is rolled back",
+			previous: map[string]string{"a.conf": "old"},
+			staged:   map[string]string{"a.conf": "new"},
+			want:     map[string]string{"a.conf": "old"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "nginx")
+			if test.live != nil {
+				writeTree(t, dir, test.live)
+			}
+			if test.previous != nil {
+				writeTree(t, dir+previousSuffix, test.previous)
+			}
+			if test.staged != nil {
+				writeTree(t, dir+stagedSuffix, test.staged)
+			}
+
+			if err := RecoverFileSet(dir); err != nil {
+				t.Fatalf("RecoverFileSet() error = %v", err)
+			}
+			if got := readTree(t, dir); !equalTree(got, test.want) {
+				t.Errorf("directory = %v, want %v", got, test.want)
+			}
+			for _, sibling := range []string{dir + stagedSuffix, dir + previousSuffix} {
+				if _, err := os.Lstat(sibling); err == nil {
+					t.Errorf("left behind %v", sibling)
+				}
+			}
+		})
+	}
+}